@@ -4,38 +4,149 @@ import (
 	"fmt"
 	dvapi_db "github.com/lapuglisi/dvapi/database"
 	dvapi_http "github.com/lapuglisi/dvapi/http"
+	"log"
 	"os"
+	"time"
 )
 
 type ApiApplication struct {
 	server dvapi_http.ApiHttpServer
-	db     *dvapi_db.DuckDatabase
+	db     dvapi_db.DeviceStore
+
+	// Closed on shutdown, to stop the background goroutines
+	stop chan struct{}
+}
+
+// ApiAppConfig holds the settings of the application, given as flags to main
+type ApiAppConfig struct {
+	Host  string
+	Port  int
+	Store string // One of the ApiAppStore* constants
+	DSN   string // The connection string of the postgres store, the others use a file in PWD
+
+	Unique            string        // The dvapi_db.UniquePolicy of the devices
+	IdempotencyWindow time.Duration // How long responses are replayed for an 'Idempotency-Key'
+	NoAuth            bool          // Serve the API without requiring API keys
+	RequireIfMatch    bool          // Refuse device changes made without 'If-Match'
+	AdminKey          string        // The admin API key to create if there are none, see bootstrapKey
+}
+
+// ApiAppLeaseCheckInterval is how often devices whose lease expired are released
+const ApiAppLeaseCheckInterval time.Duration = 30 * time.Second
+
+// ApiAppIdempotencyPurgeInterval is how often expired idempotency keys are forgotten
+const ApiAppIdempotencyPurgeInterval time.Duration = 10 * time.Minute
+
+const (
+	ApiAppDBFileName     string = "dvapi.db"
+	ApiAppSqliteFileName string = "dvapi.sqlite"
+)
+
+// Storage backends selectable with '-store'
+const (
+	ApiAppStoreDuckDB   string = "duckdb"
+	ApiAppStoreSqlite   string = "sqlite"
+	ApiAppStorePostgres string = "postgres"
+)
+
+// Setup opens the 'config.Store' backend and prepares the HTTP server
+func (app *ApiApplication) Setup(config ApiAppConfig) (err error) {
+	if app.db, err = openStore(config); err != nil {
+		return err
+	}
+
+	if len(config.AdminKey) > 0 {
+		if err = bootstrapKey(app.db, config.AdminKey); err != nil {
+			app.db.Release()
+			return err
+		}
+	}
+
+	app.server.Setup(config.Host, config.Port, app.db)
+	app.server.SetIdempotencyWindow(config.IdempotencyWindow)
+	app.server.SetAuthentication(!config.NoAuth)
+	app.server.SetRequireIfMatch(config.RequireIfMatch)
+
+	if config.NoAuth {
+		log.Println("warning: API keys are not required, anyone reaching the API can change the devices")
+	}
+
+	return err
 }
 
-const ApiAppDBFileName string = "dvapi.db"
+// openStore opens the 'config.Store' backend, with the 'config.Unique' policy applied
+func openStore(config ApiAppConfig) (db dvapi_db.DeviceStore, err error) {
+	policy, err := dvapi_db.ParseUniquePolicy(config.Unique)
+	if err != nil {
+		return nil, err
+	}
+
+	if db, err = openBackend(config); err != nil {
+		return nil, err
+	}
+
+	if err = db.SetUniquePolicy(policy); err != nil {
+		db.Release()
+		return nil, fmt.Errorf("cannot apply the '%s' uniqueness policy: %w", policy, err)
+	}
 
-func (app *ApiApplication) Setup(host string, port int) (err error) {
-	app.db = dvapi_db.NewDatabase()
+	return db, nil
+}
 
+// openBackend opens the 'config.Store' backend as it is, leaving the devices alone
+func openBackend(config ApiAppConfig) (db dvapi_db.DeviceStore, err error) {
 	// Get PWDfor the database file as well
 	pwd, err := os.Getwd()
 	if err != nil {
 		pwd = "./"
 	}
 
-	err = app.db.Setup(fmt.Sprintf("%s/%s", pwd, ApiAppDBFileName))
-	if err != nil {
-		return err
-	}
+	switch config.Store {
+	case ApiAppStoreDuckDB, "":
+		var duckdb *dvapi_db.DuckDatabase = dvapi_db.NewDatabase()
 
-	app.server.Setup(host, port, app.db)
+		err = duckdb.Setup(fmt.Sprintf("%s/%s", pwd, ApiAppDBFileName))
+		if err != nil {
+			return nil, err
+		}
+		db = duckdb
 
-	return err
+	case ApiAppStoreSqlite:
+		var sqlite *dvapi_db.SqliteDatabase = dvapi_db.NewSqliteDatabase()
+
+		err = sqlite.Setup(fmt.Sprintf("%s/%s", pwd, ApiAppSqliteFileName))
+		if err != nil {
+			return nil, err
+		}
+		db = sqlite
+
+	case ApiAppStorePostgres:
+		var postgres *dvapi_db.PostgresDatabase = dvapi_db.NewPostgresDatabase()
+
+		if len(config.DSN) == 0 {
+			return nil, fmt.Errorf("store '%s' requires a DSN", config.Store)
+		}
+
+		if err = postgres.Setup(config.DSN); err != nil {
+			return nil, err
+		}
+		db = postgres
+
+	default:
+		return nil, fmt.Errorf("unknown store '%s' (use '%s', '%s' or '%s')", config.Store,
+			ApiAppStoreDuckDB, ApiAppStoreSqlite, ApiAppStorePostgres)
+	}
+
+	return db, nil
 }
 
 func (app *ApiApplication) Run() (err error) {
 	// defer app.shutdown()
 
+	app.stop = make(chan struct{})
+	go app.expireLeases(ApiAppLeaseCheckInterval)
+	go app.purgeIdempotencyKeys(ApiAppIdempotencyPurgeInterval)
+
 	err = app.server.Run()
 
 	app.shutdown()
@@ -44,5 +155,50 @@ func (app *ApiApplication) Run() (err error) {
 }
 
 func (app *ApiApplication) shutdown() (err error) {
+	if app.stop != nil {
+		close(app.stop)
+	}
+
 	return app.db.Release()
 }
+
+// expireLeases returns, every 'interval', the devices whose lease expired
+// to the available state. It runs until app.stop is closed.
+func (app *ApiApplication) expireLeases(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.stop:
+			return
+
+		case now := <-ticker.C:
+			expired, err := app.db.ExpireLeases(now)
+			if err != nil {
+				log.Println("could not expire device leases:", err)
+			} else if expired > 0 {
+				log.Printf("released %d device(s) whose lease expired\n", expired)
+			}
+		}
+	}
+}
+
+// purgeIdempotencyKeys forgets, every 'interval', the idempotency keys whose
+// window ended. It runs until app.stop is closed.
+func (app *ApiApplication) purgeIdempotencyKeys(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-app.stop:
+			return
+
+		case now := <-ticker.C:
+			if _, err := app.db.PurgeIdempotencyKeys(now); err != nil {
+				log.Println("could not purge idempotency keys:", err)
+			}
+		}
+	}
+}
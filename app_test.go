@@ -7,17 +7,16 @@ import (
 	dvapi_db "github.com/lapuglisi/dvapi/database"
 	dvapi_http "github.com/lapuglisi/dvapi/http"
 	dvapi_model "github.com/lapuglisi/dvapi/model"
-	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
-// For testing purposes, we will be using a separate database
-// This can be done by copying ./dvapi.db.dist to ./dvadpi.test.db
+// For testing purposes, we will be using a separate database.
+// It is created from scratch by the embedded migrations on every run
 const (
-	AppTestDistDBFile string = "./dvapi.db.dist"
 	AppTestDBFilePath string = "./dvapi.test.db"
 )
 
@@ -26,39 +25,18 @@ var devices dvapi_model.Devices
 var apiServer dvapi_http.ApiHttpServer
 
 func init() {
-	fmt.Printf("--- Creating/Resetting file '%s'.\n", AppTestDBFilePath)
+	fmt.Printf("--- Resetting file '%s'.\n", AppTestDBFilePath)
 	if _, err := os.Stat(AppTestDBFilePath); err == nil {
 		os.Remove(AppTestDBFilePath)
 		// Remove any ${AppTestDBFilePath}.wal if needed
 		os.Remove(fmt.Sprintf("%s.wal", AppTestDBFilePath))
 	}
 
-	// Copy ./dvapi.db.dist -> ./dvapi.test.db
-	// Opens the source file
-	fmt.Printf("--- Copying '%s' -> '%s'...\n", AppTestDistDBFile, AppTestDBFilePath)
-	source, err := os.Open(AppTestDistDBFile)
-	if err != nil {
-		panic(err)
-	}
-	defer source.Close()
-
-	// Opens the target file
-	target, err := os.OpenFile(AppTestDBFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		panic(err)
-	}
-	defer target.Close()
-
-	_, err = io.Copy(target, source)
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Printf("--- File '%s' created successfully.\n", AppTestDBFilePath)
-
 	// Setup the api Server
 	var db *dvapi_db.DuckDatabase = dvapi_db.NewDatabase()
-	db.Setup(AppTestDBFilePath)
+	if err := db.Setup(AppTestDBFilePath); err != nil {
+		panic(err)
+	}
 	apiServer.Setup("", 0, db)
 }
 
@@ -102,8 +80,8 @@ func TestDeviceCreate(t *testing.T) {
 		hh.ServeHTTP(rr, req)
 
 		// Check the return status
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("unexpected http status: got %d want %d\n", status, http.StatusOK)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Errorf("unexpected http status: got %d want %d\n", status, http.StatusCreated)
 			break
 		}
 
@@ -155,34 +133,17 @@ func TestDeviceUpdate(t *testing.T) {
 		hh := http.HandlerFunc(apiServer.HandleDevicesUpdate)
 		hh.ServeHTTP(rr, req)
 
-		// Is the device state 'in-use'? Must return an error
-		// Check the return status
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("unexpected http status: got %d want %d\n", status, http.StatusOK)
-			break
+		// Is the device state 'in-use'? Must return a conflict
+		want := http.StatusOK
+		if device.State == "in-use" {
+			want = http.StatusConflict
 		}
 
-		// Check if our returned json means success
-		ar := dvapi_http.HttpApiResponse{}
-		if err = json.Unmarshal(rr.Body.Bytes(), &ar); err != nil {
-			t.Errorf("unexpected reponse from API: '%s'\n", rr.Body.String())
+		if status := rr.Code; status != want {
+			t.Errorf("body: [%s]", rr.Body.String())
+			t.Errorf("unexpected http status for '%s' device: got %d want %d\n", device.State, status, want)
 			break
 		}
-
-		// Is the device in 'in-use' state? If so, it is fine to get status = 'error'
-		// Would be nice to have some regex to test the 'Reason' description
-		if device.State == "in-use" {
-			if ar.Status != "error" {
-				t.Errorf("unexpected API status for 'in-use' device: got '%s' want 'error'\n", ar.Status)
-				break
-			}
-		} else {
-			if ar.Status != "success" {
-				t.Errorf("body: [%s]", rr.Body.String())
-				t.Errorf("unexpected API status for 'not in-use' device: got '%s' want 'success'\n", ar.Status)
-				break
-			}
-		}
 	}
 }
 
@@ -205,60 +166,33 @@ func TestDeviceDelete(t *testing.T) {
 		hh := http.HandlerFunc(apiServer.HandleDevicesDelete)
 		hh.ServeHTTP(rr, req)
 
-		// Check the return status
-		if status := rr.Code; status != http.StatusOK {
-			t.Errorf("unexpected http status: got %d want %d\n", status, http.StatusOK)
-			break
-		}
-
-		// Check if our returned json means success
-		ar := dvapi_http.HttpApiResponse{}
-		if err = json.Unmarshal(rr.Body.Bytes(), &ar); err != nil {
-			t.Errorf("unexpected reponse from API: '%s'\n", rr.Body.String())
-			break
-		}
-
-		// Is the device in 'in-use' state? If so, it is fine to get status = 'error'
-		// Would be nice to have some regex to test the 'Reason' description
+		// Is the device in 'in-use' state? If so, it must be a conflict
 		if device.State == "in-use" {
-			if ar.Status != "error" {
-				t.Errorf("unexpected API status for 'in-use' device: got '%s' want 'error'\n", ar.Status)
+			if status := rr.Code; status != http.StatusConflict {
+				t.Errorf("unexpected http status for 'in-use' device: got %d want %d\n", status, http.StatusConflict)
 			}
 		} else {
-			if ar.Status != "success" {
-				t.Errorf("unexpected API status for 'not in-use' device: got '%s' want 'success'\n", ar.Status)
+			if status := rr.Code; status != http.StatusOK {
+				t.Errorf("unexpected http status for 'not in-use' device: got %d want %d\n", status, http.StatusOK)
 				continue
 			}
 
 			// Try to fetch the device that has been deleted
-			idJson := fmt.Sprintf(`{"id": %d}`, device.ID)
-			req, err := http.NewRequest("GET", "/fetch", bytes.NewBuffer([]byte(idJson)))
-
+			req, err := http.NewRequest("GET", "/devices", nil)
 			if err != nil {
 				t.Errorf("Error while trying to fetch the device: %s", err.Error())
 				continue
 			}
+			req.SetPathValue("id", fmt.Sprintf("%d", device.ID))
 
-			rr = nil
 			rr := httptest.NewRecorder()
 
 			hh := http.HandlerFunc(apiServer.HandleDevicesFetch)
 			hh.ServeHTTP(rr, req)
-			// Check the return status
-			if status := rr.Code; status != http.StatusOK {
-				t.Errorf("unexpected http status: got %d want %d\n", status, http.StatusOK)
-				continue
-			}
-
-			// Check if our returned json means success
-			ar := dvapi_http.HttpApiResponse{}
-			if err = json.Unmarshal(rr.Body.Bytes(), &ar); err != nil {
-				t.Errorf("unexpected reponse from API: '%s'\n", rr.Body.String())
-				continue
-			}
 
-			if ar.Status != "error" {
-				t.Errorf("unexpected status from API: got '%s' want 'error'\n", ar.Status)
+			// Check the return status
+			if status := rr.Code; status != http.StatusNotFound {
+				t.Errorf("unexpected http status: got %d want %d\n", status, http.StatusNotFound)
 				continue
 			}
 		}
@@ -342,3 +276,56 @@ func TestFetchByState(t *testing.T) {
 			ds[0].State)
 	}
 }
+
+// TestExpireLeases: a device checked out for a very short time must be
+// released by the lease expiry goroutine
+func TestExpireLeases(t *testing.T) {
+	app := ApiApplication{db: dvapi_db.NewMemoryDatabase(), stop: make(chan struct{})}
+
+	device := dvapi_model.Device{Name: "TestDeviceLeased", Brand: "BrandOne"}
+	app.db.CreateDevice(&device)
+
+	if _, err := app.db.CheckoutDevice(device.ID, "tester", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	go app.expireLeases(time.Millisecond)
+	defer close(app.stop)
+
+	for range 100 {
+		if ds, _ := app.db.Fetch(int(device.ID)); ds[0].State == dvapi_model.DeviceStateAvailable {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Errorf("device still in use after its lease expired\n")
+}
+
+func TestBootstrapKey(t *testing.T) {
+	db := dvapi_db.NewMemoryDatabase()
+	secret := dvapi_db.ApiKeyPrefix + "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	if err := bootstrapKey(db, "not-a-key"); err == nil {
+		t.Errorf("a malformed bootstrap key was accepted\n")
+	}
+
+	if err := bootstrapKey(db, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := db.FindApiKey(secret)
+	if err != nil || key == nil || key.Name != ApiAppBootstrapKeyName || !key.Allows(dvapi_db.ScopeDevicesAdmin) {
+		t.Fatalf("unexpected bootstrap key: %+v, %v\n", key, err)
+	}
+
+	// Restarting with another key changes nothing
+	if err = bootstrapKey(db, secret+"-other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, _ := db.ListApiKeys(); len(keys) != 1 {
+		t.Errorf("got %d keys after a second bootstrap want 1\n", len(keys))
+	}
+}
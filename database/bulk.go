@@ -0,0 +1,54 @@
+package dvapi_db
+
+import (
+	"errors"
+	api_model "github.com/lapuglisi/dvapi/model"
+)
+
+// The operations of a bulk request
+const (
+	BulkCreate string = "create"
+	BulkUpdate string = "update"
+	BulkDelete string = "delete"
+)
+
+// BulkOptions tell how ApplyBulk runs the operations
+type BulkOptions struct {
+	Atomic bool // The first operation that fails is returned as the error, and none is applied
+	DryRun bool // The operations are only checked: they run, then are rolled back
+}
+
+// errBulkDryRun rolls back the transaction of a dry run
+var errBulkDryRun = errors.New("bulk dry run")
+
+// BulkOperation is one create, update or delete of a bulk request. Updates and
+// deletes select the device by 'Device.ID', and require 'Device.Version' if set.
+type BulkOperation struct {
+	Op     string // One of the Bulk* constants
+	Device api_model.Device
+}
+
+// BulkResult is the outcome of a BulkOperation: the device as created or
+// updated (only its id for deletes), or the error that prevented it
+type BulkResult struct {
+	Device api_model.Device
+	Err    error
+}
+
+// validateBulk checks the operations themselves, before any is applied
+func validateBulk(operations []BulkOperation) error {
+	if len(operations) == 0 {
+		return invalidInputError(ErrCodeInvalidBulk, "no operation to apply")
+	}
+
+	for i, operation := range operations {
+		switch operation.Op {
+		case BulkCreate, BulkUpdate, BulkDelete:
+		default:
+			return invalidInputError(ErrCodeInvalidBulk, "operation %d: unknown operation '%s' (use '%s', '%s' or '%s')",
+				i, operation.Op, BulkCreate, BulkUpdate, BulkDelete)
+		}
+	}
+
+	return nil
+}
@@ -1,234 +1,961 @@
 package dvapi_db
 
 /*
-* We will be using DuckDB as the database provider
+* sqlDatabase holds the device operations shared by every database/sql backend.
+* The statements below are kept portable (numbered placeholders, RETURNING, ...)
+* so DuckDB and SQLite run the very same code, and thus the same rules.
  */
 import (
 	// "context" // We will not be using context specifics in this simple app
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	_ "github.com/duckdb/duckdb-go/v2"
 	api_model "github.com/lapuglisi/dvapi/model"
-	"log"
+	"iter"
 	"strings"
+	"sync"
 	"time"
 )
 
-// DuckDatabase is our main struct for the database interface
-type DuckDatabase struct {
+// sqlDatabase is embedded by the database/sql based stores
+type sqlDatabase struct {
 	db *sql.DB
+
+	// writes, when set, is held during every write, so they happen one at a time.
+	// DuckDB needs it: it fails concurrent writes to the same rows instead of
+	// waiting, and may even invalidate the database on them.
+	writes *sync.Mutex
+
+	// unique is the policy the 'unique_key' column follows, see SetUniquePolicy
+	unique UniquePolicy
+
+	// actor is recorded as the author of the changes, see WithActor
+	actor string
 }
 
+// sqlWriteRetries is how many times a write is run while the device it changes
+// is changed concurrently, waiting sqlWriteBackoff longer after each attempt
+const (
+	sqlWriteRetries int           = 10
+	sqlWriteBackoff time.Duration = 2 * time.Millisecond
+)
+
+// deviceColumns are the columns selected whenever devices are loaded,
+// in the order dbDevice.scan expects them
+const deviceColumns string = "id, name, brand, state, created_on, holder, held_since, lease_expires_on, lease_renewals, version, deleted_on"
+
 // dbDevice is somewhat a model to the table 'devices'
 type dbDevice struct {
 	ID        int64
 	Name      string
 	Brand     string
-	State     string
+	State     api_model.DeviceState
 	CreatedOn time.Time
+	Holder    sql.NullString
+	HeldSince sql.NullTime
+
+	LeaseExpiresOn sql.NullTime
+	LeaseRenewals  int
+	Version        int64
+	DeletedOn      sql.NullTime
 }
 
-// NewDatabse return a new pointer handle to a DuckDatabase instance
-func NewDatabase() *DuckDatabase {
-	return &DuckDatabase{}
+// sqlQuerier is either a *sql.DB or a *sql.Tx
+type sqlQuerier interface {
+	Prepare(query string) (*sql.Stmt, error)
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
-func (ddb *DuckDatabase) Setup(dbfile string) (err error) {
-	ddb.db, err = sql.Open("duckdb", fmt.Sprintf("%s?access_mode=READ_WRITE", dbfile))
-	if err != nil {
-		return err
+// errDeviceChanged is returned by the writes conditioned on the version of a device
+// that was changed in the meantime. The transaction doing it is then run again.
+var errDeviceChanged = errors.New("device changed concurrently")
+
+// rowScanner is either a *sql.Row or a *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scan reads the 'deviceColumns' of the current row
+func (d *dbDevice) scan(row rowScanner) error {
+	return row.Scan(&d.ID, &d.Name, &d.Brand, &d.State, &d.CreatedOn, &d.Holder, &d.HeldSince,
+		&d.LeaseExpiresOn, &d.LeaseRenewals, &d.Version, &d.DeletedOn)
+}
+
+// toDevice converts the row into its model
+func (d *dbDevice) toDevice() api_model.Device {
+	device := api_model.Device{
+		ID:        d.ID,
+		Name:      d.Name,
+		Brand:     d.Brand,
+		State:     d.State,
+		CreatedOn: d.CreatedOn,
+		Holder:    d.Holder.String,
+
+		LeaseRenewals: d.LeaseRenewals,
+		Version:       d.Version,
 	}
 
-	// TODO: What if duckdb opens the file but it is locked?
-	// It must be handled accordingly
+	if d.HeldSince.Valid {
+		heldSince := d.HeldSince.Time
+		device.HeldSince = &heldSince
+	}
 
-	return nil
+	if d.LeaseExpiresOn.Valid {
+		leaseExpiresOn := d.LeaseExpiresOn.Time
+		device.LeaseExpiresOn = &leaseExpiresOn
+	}
+
+	if d.DeletedOn.Valid {
+		deletedOn := d.DeletedOn.Time
+		device.DeletedOn = &deletedOn
+	}
+
+	return device
 }
 
 // 'CreateDevice', as it says, inserts the device 'device' in the database
-func (ddb *DuckDatabase) CreateDevice(device *api_model.Device) (err error) {
+func (sdb *sqlDatabase) CreateDevice(device *api_model.Device) (err error) {
+	err = sdb.inTx(func(tx *sql.Tx) error {
+		return sdb.createDevice(tx, device)
+	})
 
-	// I'm explicitly using 'nextval(seq)' here to make sure
-	// that 'LastInsertId' returns something
-	stmt, err := ddb.db.Prepare(`INSERT INTO devices (name, brand, state, created_on) 
-		VALUES(?, ?, ?, NOW()) RETURNING id, created_on`)
+	// A duplicate inserted concurrently only shows when the index rejects this one
+	if err != nil && !errors.As(err, new(*Error)) {
+		if duplicate := sdb.checkUnique(sdb.db, *device); duplicate != nil {
+			return duplicate
+		}
 
-	if err != nil {
+		return fmt.Errorf("could not get created params for device: %w", err)
+	}
+
+	return err
+}
+
+// createDevice inserts 'device' within 'tx', filling in its generated fields
+func (sdb *sqlDatabase) createDevice(tx *sql.Tx, device *api_model.Device) (err error) {
+	// New devices are available unless told otherwise
+	if len(device.State) == 0 {
+		device.State = api_model.DeviceStateAvailable
+	}
+
+	if err = validateState(device.State); err != nil {
+		return err
+	}
+
+	if err = sdb.checkUnique(tx, *device); err != nil {
 		return err
 	}
 
-	rows, err := stmt.Query(device.Name, device.Brand, device.State)
+	now := time.Now().UTC()
+	leaseExpiresOn := leaseExpiry(device.State, now)
+
+	// RETURNING gives us the id generated by the database.
+	// The creation time is always stored in UTC
+	err = tx.QueryRow(`INSERT INTO devices (name, brand, state, created_on, lease_expires_on, unique_key)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, created_on, lease_expires_on, version`,
+		device.Name, device.Brand, device.State, now, leaseExpiresOn, sdb.unique.key(device.Name, device.Brand)).
+		Scan(&device.ID, &device.CreatedOn, &leaseExpiresOn, &device.Version)
 	if err != nil {
 		return err
 	}
 
-	if rows.Next() {
-		if err = rows.Scan(&device.ID, &device.CreatedOn); err != nil {
-			log.Fatalf("could not get created params for device: %s", err.Error())
-		}
+	if leaseExpiresOn.Valid {
+		device.LeaseExpiresOn = &leaseExpiresOn.Time
 	}
 
-	return err
+	if err = indexDevice(tx, device.ID, device.Name, device.Brand); err != nil {
+		return err
+	}
+
+	return sdb.recordEvent(tx, EventCreate, nil, device)
 }
 
 // UpdateDevice updates the device 'device'.
 // Note that 'device.ID' MUST NOT be changed, so it's up to the developer
-// to handle it.
-func (ddb *DuckDatabase) UpdateDevice(device api_model.Device) (err error) {
+// to handle it. When 'device.Version' is set, the device is only updated
+// if it still is at that version.
+func (sdb *sqlDatabase) UpdateDevice(device api_model.Device) (err error) {
+	// The device is loaded, checked and written in one transaction. The write is
+	// conditioned on the version loaded, so the checks always hold when it happens.
+	return sdb.inTx(func(tx *sql.Tx) (err error) {
+		_, err = sdb.updateDevice(tx, device)
+
+		return err
+	})
+}
+
+// updateDevice updates 'device' within 'tx' and returns the result. Every check happens
+// before the first write, so a device that fails them leaves the transaction untouched.
+func (sdb *sqlDatabase) updateDevice(tx *sql.Tx, device api_model.Device) (updated *api_model.Device, err error) {
 	// Load the device first for fine-grained error messages
 	if device.ID <= 0 {
-		return fmt.Errorf("invalid device id %d", device.ID)
+		return nil, invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", device.ID)
+	}
+
+	if len(device.State) > 0 {
+		if err = validateState(device.State); err != nil {
+			return nil, err
+		}
 	}
 
-	current, err := ddb.loadDevice(device.ID)
+	current, err := sdb.loadDevice(tx, device.ID)
 	if err == sql.ErrNoRows {
-		return fmt.Errorf("device %d not found", device.ID)
+		return nil, notFoundError(ErrCodeDeviceNotFound, "device %d not found", device.ID)
 	} else if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err = checkVersion(*current, device.Version); err != nil {
+		return nil, err
 	}
 
 	// This is where we check if a device is in in-use state
 	if current.State == api_model.DeviceStateInUse {
-		return fmt.Errorf("cannot update a device in 'in-use' state")
+		return nil, conflictError(ErrCodeDeviceInUse, "cannot update a device in 'in-use' state")
 	}
 
 	// Now check for input parameters
 	// This should be done in a smart way, but for the sake of using
 	// only one function to update them all, this will do
-	if len(device.Name) == 0 {
-		device.Name = current.Name
+	update := device
+
+	if len(update.Name) == 0 {
+		update.Name = current.Name
 	}
 
-	if len(device.Brand) == 0 {
-		device.Brand = current.Brand
+	if len(update.Brand) == 0 {
+		update.Brand = current.Brand
 	}
 
-	if len(device.State) == 0 {
-		device.State = current.State
+	if len(update.State) == 0 {
+		update.State = current.State
 	}
 
-	stmt, err := ddb.db.Prepare("UPDATE devices SET name = $2, brand = $3, state = $4 WHERE id = $1")
-	if err != nil {
-		return err
+	if err = validateTransition(current.State, update.State); err != nil {
+		return nil, err
+	}
+
+	if err = sdb.checkUnique(tx, update); err != nil {
+		return nil, err
 	}
 
-	/*result*/
-	_, err = stmt.Exec(device.ID, device.Name, device.Brand, device.State)
+	result, err := tx.Exec(`UPDATE devices SET name = $2, brand = $3, state = $4, lease_expires_on = $5,
+		unique_key = $7, version = version + 1 WHERE id = $1 AND version = $6`,
+		update.ID, update.Name, update.Brand, update.State,
+		leaseExpiry(update.State, time.Now().UTC()), current.Version, sdb.unique.key(update.Name, update.Brand))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	if err = checkChanged(result); err != nil {
+		return nil, err
+	}
+
+	if update.Name != current.Name || update.Brand != current.Brand {
+		if err = indexDevice(tx, update.ID, update.Name, update.Brand); err != nil {
+			return nil, err
+		}
+	}
+
+	if updated, err = sdb.loadDevice(tx, update.ID); err != nil {
+		return nil, err
+	}
+
+	return updated, sdb.recordEvent(tx, EventUpdate, current, updated)
+}
+
+// DeleteDevice: delete the device with 'device.ID' from the db.
+// The row is only marked deleted, see RestoreDevice and PurgeDevices.
+func (sdb *sqlDatabase) DeleteDevice(device api_model.Device) (err error) {
+	// Same as UpdateDevice, the in-use check and the delete happen in one transaction
+	return sdb.inTx(func(tx *sql.Tx) error {
+		return sdb.deleteDevice(tx, device)
+	})
 }
 
-// DeleteDevice: delete the device with 'device.ID' from the db
-func (ddb *DuckDatabase) DeleteDevice(device api_model.Device) (err error) {
+// deleteDevice deletes 'device' within 'tx', checking it first as updateDevice does
+func (sdb *sqlDatabase) deleteDevice(tx *sql.Tx, device api_model.Device) (err error) {
 	// Load the device first for fine-grained error messages
 	if device.ID <= 0 {
-		return fmt.Errorf("invalid device id %d", device.ID)
+		return invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", device.ID)
 	}
 
-	current, err := ddb.loadDevice(device.ID)
+	current, err := sdb.loadDevice(tx, device.ID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return fmt.Errorf("device %d not found", device.ID)
+			return notFoundError(ErrCodeDeviceNotFound, "device %d not found", device.ID)
 		} else {
 			return err
 		}
 	}
 
+	if err = checkVersion(*current, device.Version); err != nil {
+		return err
+	}
+
 	// Apply some logic here
 	if current.State == api_model.DeviceStateInUse {
-		return fmt.Errorf("cannot delete a device in 'in-use' state")
+		return conflictError(ErrCodeDeviceInUse, "cannot delete a device in 'in-use' state")
+	}
+
+	// Its unique key goes with it, so a new device can take its name
+	result, err := tx.Exec("UPDATE devices SET deleted_on = $3, unique_key = NULL, version = version + 1 WHERE id = $1 AND version = $2",
+		device.ID, current.Version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if err = checkChanged(result); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM device_trigrams WHERE device_id = $1", device.ID); err != nil {
+		return err
+	}
+
+	return sdb.recordEvent(tx, EventDelete, current, nil)
+}
+
+// RestoreDevice brings back the deleted device 'id', unless another device took its name meanwhile
+func (sdb *sqlDatabase) RestoreDevice(id int64) (device api_model.Device, err error) {
+	if id <= 0 {
+		return device, invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", id)
+	}
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		var result dbDevice = dbDevice{}
+
+		// loadDevice leaves the deleted devices out
+		err = result.scan(tx.QueryRow(fmt.Sprintf("SELECT %s FROM devices WHERE id = $1", deviceColumns), id))
+		if err == sql.ErrNoRows {
+			return notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+		} else if err != nil {
+			return err
+		}
+
+		current := result.toDevice()
+		if current.DeletedOn == nil {
+			return conflictError(ErrCodeDeviceNotDeleted, "device %d is not deleted", id)
+		}
+
+		if err = sdb.checkUnique(tx, current); err != nil {
+			return err
+		}
+
+		changed, err := sdb.changeDevice(tx, current, EventRestore, "deleted_on = NULL, unique_key = $3",
+			sdb.unique.key(current.Name, current.Brand))
+		if err != nil {
+			return err
+		}
+
+		device = *changed
+
+		return indexDevice(tx, device.ID, device.Name, device.Brand)
+	})
+
+	return device, err
+}
+
+// PurgeDevices deletes for good the devices deleted by 'before'. Their history is kept.
+func (sdb *sqlDatabase) PurgeDevices(before time.Time) (purged int64, err error) {
+	if before.IsZero() {
+		return 0, invalidInputError(ErrCodeInvalidPurge, "the devices to purge are those deleted before a given time")
 	}
 
-	stmt, err := ddb.db.Prepare("DELETE FROM devices WHERE id = $1")
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		// All rows are read before writing, the transaction cannot do both at once
+		devices, err := queryDevices(tx, fmt.Sprintf("SELECT %s FROM devices WHERE deleted_on <= $1", deviceColumns), before.UTC())
+		if err != nil {
+			return err
+		}
+
+		for _, device := range devices {
+			result, err := tx.Exec("DELETE FROM devices WHERE id = $1 AND version = $2", device.ID, device.Version)
+			if err != nil {
+				return err
+			}
+
+			if err = checkChanged(result); err != nil {
+				return err
+			}
+
+			if err = sdb.recordEvent(tx, EventPurge, &device, nil); err != nil {
+				return err
+			}
+		}
+
+		purged = int64(len(devices))
+
+		return nil
+	})
+
 	if err != nil {
+		return 0, err
+	}
+
+	return purged, nil
+}
+
+// ApplyBulk runs 'operations' in a single transaction. Each operation is checked
+// before it writes anything, so those that fail leave the transaction untouched
+// and the others can go on.
+func (sdb *sqlDatabase) ApplyBulk(operations []BulkOperation, options BulkOptions) (results []BulkResult, err error) {
+	if err = validateBulk(operations); err != nil {
+		return nil, err
+	}
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		results = make([]BulkResult, len(operations))
+
+		for i, operation := range operations {
+			device := operation.Device
+
+			switch operation.Op {
+			case BulkCreate:
+				err = sdb.createDevice(tx, &device)
+			case BulkUpdate:
+				var updated *api_model.Device
+				if updated, err = sdb.updateDevice(tx, device); err == nil {
+					device = *updated
+				}
+			case BulkDelete:
+				err = sdb.deleteDevice(tx, device)
+			}
+
+			// Anything but a rule of the store failing dooms the whole transaction
+			switch {
+			case err == nil:
+				results[i].Device = device
+			case !errors.As(err, new(*Error)):
+				return err
+			case options.Atomic:
+				return fmt.Errorf("operation %d: %w", i, err)
+			default:
+				results[i].Err = err
+			}
+		}
+
+		if options.DryRun {
+			return errBulkDryRun
+		}
+
+		return nil
+	})
+
+	if err != nil && err != errBulkDryRun {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// checkUnique makes sure no device other than 'device' has its name (and brand),
+// according to the uniqueness policy
+func (sdb *sqlDatabase) checkUnique(q sqlQuerier, device api_model.Device) (err error) {
+	var existing int64
+
+	key := sdb.unique.key(device.Name, device.Brand)
+	if !key.Valid {
+		return nil
+	}
+
+	err = q.QueryRow("SELECT id FROM devices WHERE unique_key = $1 AND id <> $2", key, device.ID).Scan(&existing)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return sdb.unique.duplicateError(existing, device.Name, device.Brand)
+}
+
+// SetUniquePolicy makes devices unique according to 'policy' from now on.
+// The key of every device is computed again, which fails if some of them
+// already are duplicates: they have to be renamed or deleted first.
+func (sdb *sqlDatabase) SetUniquePolicy(policy UniquePolicy) (err error) {
+	type keyed struct {
+		id          int64
+		name, brand string
+		key         sql.NullString
+	}
+
+	if policy, err = ParseUniquePolicy(string(policy)); err != nil {
 		return err
 	}
 
-	/*result*/
-	_, err = stmt.Exec(device.ID)
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		rows, err := tx.Query("SELECT id, name, brand, unique_key FROM devices WHERE deleted_on IS NULL ORDER BY id")
+		if err != nil {
+			return err
+		}
+
+		// All rows are read before writing, the transaction cannot do both at once
+		var devices []keyed
+		for rows.Next() {
+			var device keyed
+			var name, brand sql.NullString
+
+			if err = rows.Scan(&device.id, &name, &brand, &device.key); err != nil {
+				rows.Close()
+				return err
+			}
+
+			device.name, device.brand = name.String, brand.String
+			devices = append(devices, device)
+		}
+
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		taken := map[string]int64{}
+		for _, device := range devices {
+			key := policy.key(device.name, device.brand)
+
+			if key.Valid {
+				if existing, found := taken[key.String]; found {
+					return policy.duplicateError(existing, device.name, device.brand)
+				}
+				taken[key.String] = device.id
+			}
+
+			if key == device.key {
+				continue
+			}
+
+			if _, err = tx.Exec("UPDATE devices SET unique_key = $2 WHERE id = $1", device.id, key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		sdb.unique = policy
+	}
+
+	return err
+}
+
+// checkChanged makes sure the statement of 'result', conditioned on the
+// version of a device, did change it
+func checkChanged(result sql.Result) error {
+	changed, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 
+	if changed == 0 {
+		return errDeviceChanged
+	}
+
 	return nil
 }
 
-func (ddb *DuckDatabase) Fetch(id int) (devices api_model.Devices, err error) {
-	sql := fmt.Sprintf("SELECT id, name, brand, state, created_on FROM devices WHERE id = %d", id)
+// releaseColumns is the SET clause of changeDevice putting a device back in the
+// state $3, without holder nor lease
+const releaseColumns string = "state = $3, holder = NULL, held_since = NULL, lease_expires_on = NULL, lease_renewals = 0"
+
+// CheckoutDevice marks the available device 'id' as in-use by 'holder', leased for 'ttl'.
+// The device is checked then changed in one transaction, the change conditioned on
+// the version checked, so two clients can never check out the same device. Checking
+// out a device one already holds changes nothing. Devices whose lease expired can be
+// checked out right away, without waiting for ExpireLeases.
+func (sdb *sqlDatabase) CheckoutDevice(id int64, holder string, ttl time.Duration) (device api_model.Device, err error) {
+	if err = validateCheckout(id, holder); err != nil {
+		return device, err
+	}
+
+	if err = validateLease(ttl); err != nil {
+		return device, err
+	}
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		current, err := sdb.loadHeldDevice(tx, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+
+		if current.State != api_model.DeviceStateAvailable && !leaseExpired(*current, now) {
+			if err = checkoutConflict(*current, holder); err != nil {
+				return err
+			}
+
+			device = *current
+
+			return nil
+		}
+
+		changed, err := sdb.changeDevice(tx, *current, EventCheckout,
+			"state = $3, holder = $4, held_since = $5, lease_expires_on = $6, lease_renewals = 0",
+			api_model.DeviceStateInUse.ToString(), holder, now, now.Add(ttl))
+		if err != nil {
+			return err
+		}
+
+		device = *changed
+
+		return nil
+	})
+
+	return device, err
+}
+
+// CheckinDevice returns the device 'id', checked out by 'holder', to the available state
+func (sdb *sqlDatabase) CheckinDevice(id int64, holder string) (device api_model.Device, err error) {
+	if err = validateCheckout(id, holder); err != nil {
+		return device, err
+	}
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		current, err := sdb.loadHeldDevice(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// Devices set in-use without a check-out have no holder, anyone can release those
+		if current.State != api_model.DeviceStateInUse || (len(current.Holder) > 0 && current.Holder != holder) {
+			return checkinConflict(*current, holder)
+		}
+
+		changed, err := sdb.changeDevice(tx, *current, EventCheckin, releaseColumns, api_model.DeviceStateAvailable.ToString())
+		if err != nil {
+			return err
+		}
+
+		device = *changed
+
+		return nil
+	})
+
+	return device, err
+}
+
+// RenewLease moves the end of the lease 'holder' has on device 'id' to 'ttl' from now.
+// Leases that already expired cannot be renewed, the device must be checked out again.
+func (sdb *sqlDatabase) RenewLease(id int64, holder string, ttl time.Duration) (device api_model.Device, err error) {
+	if err = validateCheckout(id, holder); err != nil {
+		return device, err
+	}
+
+	if err = validateLease(ttl); err != nil {
+		return device, err
+	}
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		current, err := sdb.loadHeldDevice(tx, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if err = renewConflict(*current, holder, now); err != nil {
+			return err
+		}
+
+		changed, err := sdb.changeDevice(tx, *current, EventRenew,
+			"lease_expires_on = $3, lease_renewals = lease_renewals + 1", now.Add(ttl))
+		if err != nil {
+			return err
+		}
+
+		device = *changed
+
+		return nil
+	})
+
+	return device, err
+}
+
+// ExpireLeases releases every in-use device whose lease ended by 'now'
+func (sdb *sqlDatabase) ExpireLeases(now time.Time) (expired int64, err error) {
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		// All rows are read before writing, the transaction cannot do both at once
+		devices, err := queryDevices(tx, fmt.Sprintf("SELECT %s FROM devices WHERE state = $1 AND lease_expires_on <= $2 AND deleted_on IS NULL",
+			deviceColumns), api_model.DeviceStateInUse.ToString(), now.UTC())
+		if err != nil {
+			return err
+		}
+
+		// Each device gets its own event in the history
+		for _, device := range devices {
+			if _, err = sdb.changeDevice(tx, device, EventExpire, releaseColumns, api_model.DeviceStateAvailable.ToString()); err != nil {
+				return err
+			}
+		}
+
+		expired = int64(len(devices))
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return expired, nil
+}
+
+// loadHeldDevice loads the device 'id' within 'tx', for the check-out operations
+func (sdb *sqlDatabase) loadHeldDevice(tx *sql.Tx, id int64) (device *api_model.Device, err error) {
+	device, err = sdb.loadDevice(tx, id)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	return device, err
+}
+
+// changeDevice applies 'set', the SET clause of an UPDATE whose arguments 'args' start at $3,
+// to the device 'current' within 'tx', and records the change as 'operation'. As in
+// updateDevice, the change is conditioned on the version of 'current'.
+func (sdb *sqlDatabase) changeDevice(tx *sql.Tx, current api_model.Device, operation string, set string, args ...any) (changed *api_model.Device, err error) {
+	var result dbDevice = dbDevice{}
+
+	row := tx.QueryRow(fmt.Sprintf("UPDATE devices SET %s, version = version + 1 WHERE id = $1 AND version = $2 RETURNING %s",
+		set, deviceColumns), append([]any{current.ID, current.Version}, args...)...)
+
+	if err = result.scan(row); err == sql.ErrNoRows {
+		return nil, errDeviceChanged
+	} else if err != nil {
+		return nil, err
+	}
+
+	device := result.toDevice()
+
+	return &device, sdb.recordEvent(tx, operation, &current, &device)
+}
+
+func (sdb *sqlDatabase) Fetch(id int) (devices api_model.Devices, err error) {
 	var result dbDevice = dbDevice{}
 
-	rows := ddb.db.QueryRow(sql)
+	rows := sdb.db.QueryRow(fmt.Sprintf("SELECT %s FROM devices WHERE id = $1 AND deleted_on IS NULL", deviceColumns), id)
 	if rows.Err() != nil {
 		return nil, rows.Err()
 	}
 
-	err = rows.Scan(&result.ID, &result.Name, &result.Brand, &result.State, &result.CreatedOn)
-	if err != nil {
+	err = result.scan(rows)
+	if err == sql.ErrNoRows {
+		return nil, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	} else if err != nil {
 		return nil, err
 	}
 
-	devices = append(devices, api_model.Device{
-		ID:        result.ID,
-		Name:      result.Name,
-		Brand:     result.Brand,
-		State:     result.State,
-		CreatedOn: result.CreatedOn,
-	})
+	devices = append(devices, result.toDevice())
 
 	return devices, nil
 }
 
 // FetchAll retrieves all devices in the database
 // Consider retrieving a JSON object directly
-func (ddb *DuckDatabase) FetchAll() (devices api_model.Devices, err error) {
-	var sql string = "SELECT id, name, brand, state, created_on from devices order by created_on"
+func (sdb *sqlDatabase) FetchAll() (devices api_model.Devices, err error) {
+	var sql string = fmt.Sprintf("SELECT %s from devices where deleted_on IS NULL order by created_on, id", deviceColumns)
 	var result dbDevice
 
-	rows, err := ddb.db.Query(sql)
+	rows, err := sdb.db.Query(sql)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		result = dbDevice{}
 
-		err = rows.Scan(&result.ID, &result.Name, &result.Brand, &result.State, &result.CreatedOn)
+		err = result.scan(rows)
 		if err != nil {
 			break
 		}
 
-		devices = append(devices, api_model.Device{
-			ID:        result.ID,
-			Name:      result.Name,
-			Brand:     result.Brand,
-			State:     result.State,
-			CreatedOn: result.CreatedOn,
-		})
+		devices = append(devices, result.toDevice())
 	}
 
 	return devices, err // Keep err here
 }
 
-func (ddb *DuckDatabase) FetchByBrand(brands []string) (devices api_model.Devices, err error) {
-	devices = api_model.Devices{}
+// FetchPage returns one page of devices. Pages start after the position of the
+// cursor (keyset pagination), so they stay consistent while devices are added.
+// The filter and the position make up a single parameterized query.
+func (sdb *sqlDatabase) FetchPage(query PageQuery) (page DevicePage, err error) {
+	after, err := query.validate()
+	if err != nil {
+		return page, err
+	}
+
+	// One more device than asked tells whether there is a next page
+	sql, args := listingQuery(query, after)
+	devices, err := queryDevices(sdb.db, fmt.Sprintf("%s LIMIT %d", sql, query.Limit+1), args...)
+	if err != nil {
+		return page, err
+	}
+
+	return query.paginate(devices), nil
+}
+
+// IterateDevices yields, one row at a time, every device 'query' selects from
+// 'query.After' on, whatever 'query.Limit'. The rows are read as the devices are
+// consumed, which holds a connection until the iteration ends.
+func (sdb *sqlDatabase) IterateDevices(query PageQuery) iter.Seq2[api_model.Device, error] {
+	return func(yield func(api_model.Device, error) bool) {
+		after, err := query.validateOrder()
+		if err != nil {
+			yield(api_model.Device{}, err)
+			return
+		}
+
+		sql, args := listingQuery(query, after)
+		rows, err := sdb.db.Query(sql, args...)
+		if err != nil {
+			yield(api_model.Device{}, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			r := dbDevice{}
+			if err = r.scan(rows); err != nil {
+				yield(api_model.Device{}, err)
+				return
+			}
+
+			if !yield(r.toDevice(), nil) {
+				return
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			yield(api_model.Device{}, err)
+		}
+	}
+}
+
+// versionColumns are the 'deviceColumns' of the table 'device_versions', whose devices are never deleted
+const versionColumns string = "device_id AS id, " + versionedColumns + ", CAST(NULL AS TIMESTAMP) AS deleted_on"
+
+// versionedColumns are the columns of 'devices' every version keeps
+const versionedColumns string = "name, brand, state, created_on, holder, held_since, lease_expires_on, lease_renewals, version"
+
+// listingQuery returns the SELECT, without a LIMIT, of the devices 'query' selects after 'after'
+func listingQuery(query PageQuery, after *pageCursor) (sql string, args []any) {
+	var where sqlConditions = filterConditions(query.Filter)
+	var order, direction string = ">", "ASC"
+	var table string = "devices"
+
+	// The versions valid at that time stand in for the devices
+	if !query.AsOf.IsZero() {
+		table = fmt.Sprintf(`(SELECT %[1]s FROM device_versions
+			WHERE valid_from <= %[2]s AND (valid_to IS NULL OR valid_to > %[2]s)) AS devices`,
+			versionColumns, where.arg(query.AsOf.UTC()))
+	} else if !query.IncludeDeleted {
+		where.add("deleted_on IS NULL")
+	}
+
+	if query.Desc {
+		order, direction = "<", "DESC"
+	}
+
+	// 'query.Sort' is one of the SortBy* constants, which are also column names
+	if after != nil {
+		var value any = after.Value
+		if query.Sort == SortByCreatedOn {
+			value, _ = time.Parse(time.RFC3339Nano, after.Value)
+		}
+
+		valueArg, idArg := where.arg(value), where.arg(after.ID)
+		where.add(fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND id %[2]s %[4]s))",
+			query.Sort, order, valueArg, idArg))
+	}
+
+	sql = fmt.Sprintf("SELECT %s FROM %s %s ORDER BY %s %s, id %s",
+		deviceColumns, table, where.clause(), query.Sort, direction, direction)
+
+	return sql, where.args
+}
+
+// filterConditions compiles 'filter' into the conditions of a WHERE clause
+func filterConditions(filter DeviceFilter) (where sqlConditions) {
+	if len(filter.Brands) > 0 {
+		where.add(fmt.Sprintf("brand IN (%s)", where.argList(filter.Brands)))
+	}
+
+	if len(filter.States) > 0 {
+		where.add(fmt.Sprintf("state IN (%s)", where.argList(filter.States)))
+	}
+
+	if len(filter.NamePattern) > 0 {
+		where.add(fmt.Sprintf("LOWER(name) LIKE LOWER(%s) ESCAPE '\\'", where.arg(globLike(filter.NamePattern))))
+	}
+
+	if !filter.CreatedAfter.IsZero() {
+		where.add(fmt.Sprintf("created_on > %s", where.arg(filter.CreatedAfter.UTC())))
+	}
+
+	if !filter.CreatedBefore.IsZero() {
+		where.add(fmt.Sprintf("created_on < %s", where.arg(filter.CreatedBefore.UTC())))
+	}
+
+	if !filter.LeaseExpiresBefore.IsZero() {
+		where.add(fmt.Sprintf("state = %s AND lease_expires_on <= %s",
+			where.arg(api_model.DeviceStateInUse.ToString()), where.arg(filter.LeaseExpiresBefore.UTC())))
+	}
+
+	return where
+}
+
+// sqlConditions builds a WHERE clause and the arguments of its placeholders
+type sqlConditions struct {
+	conditions []string
+	args       []any
+}
+
+// add appends a condition, joined to the others with AND
+func (c *sqlConditions) add(condition string) {
+	c.conditions = append(c.conditions, condition)
+}
+
+// arg returns the placeholder for 'value'
+func (c *sqlConditions) arg(value any) string {
+	c.args = append(c.args, value)
+
+	return fmt.Sprintf("$%d", len(c.args))
+}
+
+// argList returns the comma delimited placeholders for 'values'
+func (c *sqlConditions) argList(values []string) string {
+	placeholders := make([]string, len(values))
+	for i, value := range values {
+		placeholders[i] = c.arg(value)
+	}
+
+	return strings.Join(placeholders, ", ")
+}
+
+// clause returns the WHERE clause, empty if there are no conditions
+func (c *sqlConditions) clause() string {
+	if len(c.conditions) == 0 {
+		return ""
+	}
+
+	return "WHERE " + strings.Join(c.conditions, " AND ")
+}
+
+func (sdb *sqlDatabase) FetchByBrand(brands []string) (devices api_model.Devices, err error) {
 	var totalBrands int = len(brands)
 
 	if totalBrands == 0 {
-		return nil, fmt.Errorf("no brand defined")
+		return nil, invalidInputError(ErrCodeInvalidFilter, "no brand defined")
 	}
 
 	// I'll be using a poor man's approach
 	// This is quite dumb actually, but anyway...
-	sql := fmt.Sprintf("SELECT id, name, brand, state, created_on FROM devices WHERE brand IN (?%s)",
-		strings.Repeat(", ?", totalBrands-1))
-
-	stmt, err := ddb.db.Prepare(sql)
-	if err != nil {
-		return nil, err
-	}
+	sql := fmt.Sprintf("SELECT %s FROM devices WHERE brand IN (%s) AND deleted_on IS NULL",
+		deviceColumns, placeholders(1, totalBrands))
 
 	// Now prepare the arguments for stmt.Query
 	args := make([]any, totalBrands)
@@ -236,105 +963,390 @@ func (ddb *DuckDatabase) FetchByBrand(brands []string) (devices api_model.Device
 		args[i] = brand
 	}
 
-	rows, err := stmt.Query(args...)
+	return queryDevices(sdb.db, sql, args...)
+}
+
+func (sdb *sqlDatabase) FetchByState(states []string) (devices api_model.Devices, err error) {
+	var totalStates int = len(states)
+
+	if totalStates == 0 {
+		return nil, invalidInputError(ErrCodeInvalidFilter, "no state defined")
+	}
+
+	if _, err = parseStates(states); err != nil {
+		return nil, err
+	}
+
+	// I'll be using a poor man's approach (once again)
+	// This is quite dumb actually, but anyway...
+	sql := fmt.Sprintf("SELECT %s FROM devices WHERE state IN (%s) AND deleted_on IS NULL",
+		deviceColumns, placeholders(1, totalStates))
+
+	// Now prepare the arguments for stmt.Query
+	args := make([]any, totalStates)
+	for i, state := range states {
+		args[i] = state
+	}
+
+	return queryDevices(sdb.db, sql, args...)
+}
+
+// FetchLeasesExpiringBefore returns the in-use devices whose lease ends by 'before'
+func (sdb *sqlDatabase) FetchLeasesExpiringBefore(before time.Time) (devices api_model.Devices, err error) {
+	sql := fmt.Sprintf(`SELECT %s FROM devices WHERE state = $1 AND lease_expires_on <= $2 AND deleted_on IS NULL
+		ORDER BY lease_expires_on, id`, deviceColumns)
+
+	return queryDevices(sdb.db, sql, api_model.DeviceStateInUse.ToString(), before.UTC())
+}
+
+// SearchDevices returns the devices whose name or brand best match 'text',
+// at most 'limit' of them (DefaultSearchLimit if 0). The trigrams of 'text'
+// are looked up in the search index, the scores are computed from the counts.
+//
+// DuckDB uses this index too, rather than its 'fts' extension, for three reasons:
+//   - 'fts' is not linked into the duckdb-go bindings. 'INSTALL fts' downloads it from
+//     extensions.duckdb.org on first use, which fails on hosts without internet access.
+//   - 'PRAGMA create_fts_index' builds a snapshot of the table. It is not updated as
+//     devices change, so it would have to be rebuilt in full after every write.
+//   - 'match_bm25' scores whole stemmed words, so 'iph' or 'ipone' find no 'iPhone'.
+//     The scores would also differ from the other stores, which share the trigram
+//     similarity of pg_trgm.
+func (sdb *sqlDatabase) SearchDevices(text string, limit int) (results []SearchResult, err error) {
+	searched, limit, err := validateSearch(text, limit)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
 
+	// How many of the searched trigrams each indexed field has, and how many it has in all
+	var where sqlConditions
+	where.add(fmt.Sprintf("t.trigram IN (%s)", where.argList(searched)))
+
+	rows, err := sdb.db.Query(fmt.Sprintf(`SELECT t.device_id, COUNT(*),
+			(SELECT COUNT(*) FROM device_trigrams a WHERE a.device_id = t.device_id AND a.field = t.field)
+		FROM device_trigrams t %s GROUP BY t.device_id, t.field`, where.clause()), where.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := map[int64]float64{}
 	for rows.Next() {
-		// Retrieve current row and append it to 'devices'
-		r := api_model.Device{}
-		if err = rows.Scan(&r.ID, &r.Name, &r.Brand, &r.State, &r.CreatedOn); err != nil {
-			break
+		var id int64
+		var shared, indexed int
+
+		if err = rows.Scan(&id, &shared, &indexed); err != nil {
+			return nil, err
+		}
+
+		if score := similarity(shared, len(searched), indexed); score >= SearchMinScore {
+			scores[id] = max(scores[id], score)
 		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-		devices = append(devices, r)
+	results = []SearchResult{}
+	if len(scores) == 0 {
+		return results, nil
 	}
 
+	args := make([]any, 0, len(scores))
+	for id := range scores {
+		args = append(args, id)
+	}
+
+	devices, err := queryDevices(sdb.db, fmt.Sprintf("SELECT %s FROM devices WHERE id IN (%s) AND deleted_on IS NULL",
+		deviceColumns, placeholders(1, len(args))), args...)
 	if err != nil {
 		return nil, err
 	}
 
-	return devices, nil
+	for _, device := range devices {
+		results = append(results, SearchResult{Device: device, Score: scores[device.ID]})
+	}
+
+	return rankResults(results, limit), nil
 }
 
-func (ddb *DuckDatabase) FetchByState(states []string) (devices api_model.Devices, err error) {
-	devices = api_model.Devices{}
-	var totalStates int = len(states)
+// indexDevice replaces the trigrams of the device 'id' in the search index
+func indexDevice(q sqlQuerier, id int64, name string, brand string) (err error) {
+	if _, err = q.Exec("DELETE FROM device_trigrams WHERE device_id = $1", id); err != nil {
+		return err
+	}
 
-	if totalStates == 0 {
-		return nil, fmt.Errorf("no state defined")
+	var values sqlConditions
+	var rows []string
+
+	for _, field := range [][2]string{{searchFieldName, name}, {searchFieldBrand, brand}} {
+		for _, trigram := range trigrams(field[1]) {
+			rows = append(rows, fmt.Sprintf("(%s, %s, %s)", values.arg(id), values.arg(field[0]), values.arg(trigram)))
+		}
 	}
 
-	// I'll be using a poor man's approach (once again)
-	// This is quite dumb actually, but anyway...
-	sql := fmt.Sprintf("SELECT id, name, brand, state, created_on FROM devices WHERE state IN (?%s)",
-		strings.Repeat(", ?", totalStates-1))
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err = q.Exec("INSERT INTO device_trigrams (device_id, field, trigram) VALUES "+strings.Join(rows, ", "),
+		values.args...)
+
+	return err
+}
+
+// indexAllDevices adds every device to the search index, for databases that
+// had devices before it existed
+func indexAllDevices(tx *sql.Tx) (err error) {
+	type indexed struct {
+		id          int64
+		name, brand sql.NullString
+	}
+
+	rows, err := tx.Query("SELECT id, name, brand FROM devices")
+	if err != nil {
+		return err
+	}
+
+	// All rows are read before writing, the transaction cannot do both at once
+	var devices []indexed
+	for rows.Next() {
+		var device indexed
+		if err = rows.Scan(&device.id, &device.name, &device.brand); err != nil {
+			rows.Close()
+			return err
+		}
+
+		devices = append(devices, device)
+	}
+
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if err = indexDevice(tx, device.id, device.name.String, device.brand.String); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReserveIdempotencyKey saves 'key' as in progress, unless it is in use already.
+// A key that expired is taken over, without waiting for PurgeIdempotencyKeys.
+func (sdb *sqlDatabase) ReserveIdempotencyKey(key string, fingerprint string) (saved *IdempotentResponse, err error) {
+	now := time.Now().UTC()
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		if saved, err = loadIdempotentResponse(tx, key, now); saved != nil || err != nil {
+			return err
+		}
+
+		// Expired keys are updated rather than deleted then inserted, DuckDB cannot do both in a transaction
+		result, err := tx.Exec(`UPDATE idempotency_keys
+			SET fingerprint = $2, status = 0, headers = NULL, body = NULL, created_on = $3, expires_on = $4
+			WHERE idempotency_key = $1 AND expires_on <= $3`, key, fingerprint, now, now.Add(IdempotencyPendingTTL))
+		if err != nil {
+			return err
+		}
+
+		if taken, err := result.RowsAffected(); err != nil || taken > 0 {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO idempotency_keys (idempotency_key, fingerprint, created_on, expires_on)
+			VALUES ($1, $2, $3, $4)`, key, fingerprint, now, now.Add(IdempotencyPendingTTL))
+
+		return err
+	})
 
-	stmt, err := ddb.db.Prepare(sql)
+	// The same key inserted concurrently only shows when the primary key rejects this one
 	if err != nil {
+		if concurrent, _ := loadIdempotentResponse(sdb.db, key, now); concurrent != nil {
+			return concurrent, nil
+		}
+	}
+
+	return saved, err
+}
+
+// loadIdempotentResponse returns the response saved with 'key', nil if there is none or it expired by 'now'
+func loadIdempotentResponse(q sqlQuerier, key string, now time.Time) (saved *IdempotentResponse, err error) {
+	var headers, body sql.NullString
+
+	saved = &IdempotentResponse{}
+
+	err = q.QueryRow(`SELECT fingerprint, status, headers, body FROM idempotency_keys
+		WHERE idempotency_key = $1 AND expires_on > $2`, key, now).Scan(&saved.Fingerprint, &saved.Status, &headers, &body)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
 		return nil, err
 	}
 
-	// Now prepare the arguments for stmt.Query
-	args := make([]any, totalStates)
-	for i, state := range states {
-		args[i] = state
+	if headers.Valid {
+		if err = json.Unmarshal([]byte(headers.String), &saved.Header); err != nil {
+			return nil, err
+		}
 	}
 
-	rows, err := stmt.Query(args...)
+	saved.Body = []byte(body.String)
+
+	return saved, nil
+}
+
+// CompleteIdempotencyKey saves 'response' with the reserved 'key'
+func (sdb *sqlDatabase) CompleteIdempotencyKey(key string, response IdempotentResponse, expiresOn time.Time) (err error) {
+	headers, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+
+	return sdb.runWrite(func() (err error) {
+		_, err = sdb.db.Exec(`UPDATE idempotency_keys SET status = $2, headers = $3, body = $4, expires_on = $5
+			WHERE idempotency_key = $1 AND status = 0`, key, response.Status, string(headers), string(response.Body), expiresOn.UTC())
+
+		return err
+	})
+}
+
+// ReleaseIdempotencyKey forgets the reserved 'key'
+func (sdb *sqlDatabase) ReleaseIdempotencyKey(key string) (err error) {
+	return sdb.runWrite(func() (err error) {
+		_, err = sdb.db.Exec("DELETE FROM idempotency_keys WHERE idempotency_key = $1 AND status = 0", key)
+
+		return err
+	})
+}
+
+// PurgeIdempotencyKeys forgets the keys that expired by 'now'
+func (sdb *sqlDatabase) PurgeIdempotencyKeys(now time.Time) (purged int64, err error) {
+	var result sql.Result
+
+	err = sdb.runWrite(func() (err error) {
+		result, err = sdb.db.Exec("DELETE FROM idempotency_keys WHERE expires_on <= $1", now.UTC())
+
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// queryDevices runs the 'sql' query through 'q' and collects the devices it returns.
+// The query must select the 'deviceColumns'.
+func queryDevices(q sqlQuerier, sql string, args ...any) (devices api_model.Devices, err error) {
+	devices = api_model.Devices{}
+
+	stmt, err := q.Prepare(sql)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
 	for rows.Next() {
 		// Retrieve current row and append it to 'devices'
-		r := api_model.Device{}
-		if err = rows.Scan(&r.ID, &r.Name, &r.Brand, &r.State, &r.CreatedOn); err != nil {
-			break
+		r := dbDevice{}
+		if err = r.scan(rows); err != nil {
+			return nil, err
 		}
 
-		devices = append(devices, r)
+		devices = append(devices, r.toDevice())
 	}
 
-	if err != nil {
+	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
 	return devices, nil
 }
 
-func (ddb *DuckDatabase) loadDevice(id int64) (device *api_model.Device, err error) {
+// loadDevice reads the device 'id' through 'q', the database or a transaction.
+// Deleted devices are not loaded.
+func (sdb *sqlDatabase) loadDevice(q sqlQuerier, id int64) (device *api_model.Device, err error) {
 	var result dbDevice = dbDevice{}
 	var rows *sql.Row = nil
 
-	stmt, err := ddb.db.Prepare("SELECT id, name, brand, state, created_on FROM devices WHERE id = $1")
+	stmt, err := q.Prepare(fmt.Sprintf("SELECT %s FROM devices WHERE id = $1 AND deleted_on IS NULL", deviceColumns))
 
 	if err != nil {
 		return nil, err
 	}
+	defer stmt.Close()
 
 	if rows = stmt.QueryRow(id); rows.Err() != nil {
-		return nil, err
+		return nil, rows.Err()
 	}
 
-	err = rows.Scan(&result.ID, &result.Name, &result.Brand, &result.State, &result.CreatedOn)
-	if err != nil {
+	if err = result.scan(rows); err != nil {
 		return nil, err
 	}
 
-	return &api_model.Device{
-		ID:        result.ID,
-		Name:      result.Name,
-		Brand:     result.Brand,
-		State:     result.State,
-		CreatedOn: result.CreatedOn,
-	}, nil
+	loaded := result.toDevice()
+
+	return &loaded, nil
 }
 
-func (ddb *DuckDatabase) Release() (err error) {
+func (sdb *sqlDatabase) Release() (err error) {
 	// TODO: Check error type before return
-	return ddb.db.Close()
+	return sdb.db.Close()
+}
+
+// runWrite runs 'write', after the other writes if the store serializes them.
+// It is run again for as long as the device it changes is changed concurrently.
+func (sdb *sqlDatabase) runWrite(write func() error) (err error) {
+	if sdb.writes != nil {
+		sdb.writes.Lock()
+		defer sdb.writes.Unlock()
+	}
+
+	for attempt := range sqlWriteRetries {
+		if err = write(); err != errDeviceChanged {
+			return err
+		}
+
+		time.Sleep(time.Duration(attempt+1) * sqlWriteBackoff)
+	}
+
+	return conflictError(ErrCodeDeviceChanged, "the device kept being changed concurrently, try again")
+}
+
+// inTx runs 'write' in a transaction, committed if 'write' succeeds.
+// The whole transaction is run again if the device changed concurrently.
+func (sdb *sqlDatabase) inTx(write func(tx *sql.Tx) error) (err error) {
+	return sdb.runWrite(func() (err error) {
+		tx, err := sdb.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err = write(tx); err != nil {
+			tx.Rollback()
+
+			return err
+		}
+
+		return tx.Commit()
+	})
+}
+
+// placeholders returns 'count' numbered placeholders starting at $start: "$1, $2, $3"
+func placeholders(start int, count int) string {
+	list := make([]string, count)
+	for i := range list {
+		list[i] = fmt.Sprintf("$%d", start+i)
+	}
+
+	return strings.Join(list, ", ")
 }
@@ -0,0 +1,64 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"fmt"
+	_ "github.com/duckdb/duckdb-go/v2"
+	"sync"
+)
+
+// DuckDatabase is the DuckDB implementation of DeviceStore
+type DuckDatabase struct {
+	sqlDatabase
+}
+
+// NewDatabse return a new pointer handle to a DuckDatabase instance
+func NewDatabase() *DuckDatabase {
+	// DuckDB has a single writer process anyway, writing from one goroutine at a time costs little
+	return &DuckDatabase{
+		sqlDatabase: sqlDatabase{writes: &sync.Mutex{}},
+	}
+}
+
+func (ddb *DuckDatabase) Setup(dbfile string) (err error) {
+	ddb.db, err = sql.Open("duckdb", fmt.Sprintf("%s?access_mode=READ_WRITE", dbfile))
+	if err != nil {
+		return err
+	}
+
+	// TODO: What if duckdb opens the file but it is locked?
+	// It must be handled accordingly
+
+	// Bring the schema up to date; a fresh file gets every migration
+	if err = ddb.Migrate(); err != nil {
+		ddb.db.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Migrate applies every pending embedded migration to the database
+func (ddb *DuckDatabase) Migrate() (err error) {
+	migrations, err := loadMigrations(duckMigrationFiles, duckMigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	return migrateUp(ddb.db, migrations)
+}
+
+// MigrateDown reverts applied migrations until the schema is at version 'target'
+func (ddb *DuckDatabase) MigrateDown(target int) (err error) {
+	migrations, err := loadMigrations(duckMigrationFiles, duckMigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	return migrateDown(ddb.db, migrations, target)
+}
+
+// SchemaVersion returns the version of the latest migration applied
+func (ddb *DuckDatabase) SchemaVersion() (version int, err error) {
+	return schemaVersion(ddb.db)
+}
@@ -0,0 +1,84 @@
+package dvapi_db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of failure a DeviceStore reports. Match them with errors.Is:
+//
+//	if errors.Is(err, dvapi_db.ErrNotFound) { ... }
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrInvalidInput       = errors.New("invalid input")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Error codes are stable identifiers, meant to be switched on by API clients
+const (
+	ErrCodeDeviceNotFound    string = "device_not_found"
+	ErrCodeDeviceInUse       string = "device_in_use"
+	ErrCodeDeviceHeld        string = "device_held"
+	ErrCodeDeviceChanged     string = "device_changed"
+	ErrCodeDeviceNotHeld     string = "device_not_checked_out"
+	ErrCodeInvalidHolder     string = "invalid_holder"
+	ErrCodeInvalidLeaseTTL   string = "invalid_lease_ttl"
+	ErrCodeLeaseExpired      string = "lease_expired"
+	ErrCodeInvalidDeviceID   string = "invalid_device_id"
+	ErrCodeInvalidFilter     string = "invalid_filter"
+	ErrCodeInvalidSort       string = "invalid_sort"
+	ErrCodeInvalidPageLimit  string = "invalid_page_limit"
+	ErrCodeInvalidCursor     string = "invalid_cursor"
+	ErrCodeInvalidState      string = "invalid_state"
+	ErrCodeInvalidTransition string = "invalid_state_transition"
+	ErrCodeVersionMismatch   string = "version_mismatch"
+	ErrCodeInvalidSearch     string = "invalid_search"
+	ErrCodeDuplicateDevice   string = "duplicate_device"
+	ErrCodeInvalidBulk       string = "invalid_bulk"
+	ErrCodeInvalidImport     string = "invalid_import"
+	ErrCodeMissingField      string = "missing_field"
+	ErrCodeInvalidExport     string = "invalid_export"
+	ErrCodeDeviceNotDeleted  string = "device_not_deleted"
+	ErrCodeInvalidPurge      string = "invalid_purge"
+	ErrCodeInvalidApiKey     string = "invalid_api_key"
+	ErrCodeInvalidScope      string = "invalid_scope"
+	ErrCodeApiKeyNotFound    string = "api_key_not_found"
+
+	ErrCodeInvalidUniquePolicy string = "invalid_unique_policy"
+)
+
+// Error is the error returned by the stores for the failures a client can act on.
+// Anything else (a broken connection, for instance) is returned as is.
+type Error struct {
+	Kind    error  // ErrNotFound, ErrConflict, ErrInvalidInput or ErrPreconditionFailed
+	Code    string // One of the ErrCode* constants
+	Message string
+
+	// The device already there, for ErrCodeDuplicateDevice
+	ExistingID int64
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func notFoundError(code string, format string, args ...any) error {
+	return &Error{Kind: ErrNotFound, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func conflictError(code string, format string, args ...any) error {
+	return &Error{Kind: ErrConflict, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidInputError(code string, format string, args ...any) error {
+	return &Error{Kind: ErrInvalidInput, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func preconditionError(code string, format string, args ...any) error {
+	return &Error{Kind: ErrPreconditionFailed, Code: code, Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,224 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"strconv"
+	"time"
+)
+
+// The operations recorded in the history of a device
+const (
+	EventCreate   string = "create"
+	EventUpdate   string = "update"
+	EventDelete   string = "delete"
+	EventCheckout string = "checkout"
+	EventCheckin  string = "checkin"
+	EventRenew    string = "renew"
+	EventExpire   string = "expire"
+	EventRestore  string = "restore"
+	EventPurge    string = "purge"
+)
+
+// DeviceEvent is one change of a device, as recorded in its history.
+// 'Before' is nil for a creation, 'After' is nil for a deletion.
+type DeviceEvent struct {
+	ID         int64
+	DeviceID   int64
+	Operation  string // One of the Event* constants
+	Actor      string // Who made the change, empty if unknown
+	OccurredOn time.Time
+	Before     *api_model.Device
+	After      *api_model.Device
+}
+
+// HistoryQuery selects one page of the history of a device, newest event first
+type HistoryQuery struct {
+	Limit int    // How many events at most, DefaultPageLimit if 0
+	After string // The 'Next' cursor of the previous page, empty for the first page
+}
+
+// EventPage is a page of events, with the cursor of the next page if there is one
+type EventPage struct {
+	Events []DeviceEvent
+	Next   string
+}
+
+// validate checks the query and fills in its defaults.
+// The id of the event to start after is returned, 0 for the first page.
+func (q *HistoryQuery) validate(id int64) (after int64, err error) {
+	if id <= 0 {
+		return 0, invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", id)
+	}
+
+	if q.Limit == 0 {
+		q.Limit = DefaultPageLimit
+	}
+
+	if q.Limit < 0 || q.Limit > MaxPageLimit {
+		return 0, invalidInputError(ErrCodeInvalidPageLimit, "the page limit must be between 1 and %d", MaxPageLimit)
+	}
+
+	if len(q.After) == 0 {
+		return 0, nil
+	}
+
+	// Events are never deleted, their id is a cursor as good as any
+	if after, err = strconv.ParseInt(q.After, 10, 64); err != nil || after <= 0 {
+		return 0, invalidInputError(ErrCodeInvalidCursor, "invalid cursor '%s' for a device history", q.After)
+	}
+
+	return after, nil
+}
+
+// paginate makes a page out of the events following the query position,
+// of which there may be one more than the limit
+func (q *HistoryQuery) paginate(events []DeviceEvent) (page EventPage) {
+	if len(events) > q.Limit {
+		events = events[:q.Limit]
+		page.Next = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+
+	page.Events = events
+
+	return page
+}
+
+// WithActor returns the store recording 'actor' as the author of the changes it makes.
+// The copy shares the database, and is meant to last as long as a request does.
+func (sdb *sqlDatabase) WithActor(actor string) DeviceStore {
+	store := *sdb
+	store.actor = actor
+
+	return &store
+}
+
+// recordEvent appends the change of a device from 'before' to 'after' to its history,
+// and makes 'after' its current version, within 'tx'
+func (sdb *sqlDatabase) recordEvent(tx *sql.Tx, operation string, before *api_model.Device, after *api_model.Device) (err error) {
+	var deviceID int64
+	var beforeJson, afterJson sql.NullString
+
+	now := time.Now().UTC()
+
+	for _, saved := range []struct {
+		device *api_model.Device
+		json   *sql.NullString
+	}{{before, &beforeJson}, {after, &afterJson}} {
+		if saved.device == nil {
+			continue
+		}
+
+		jsonBytes, err := json.Marshal(saved.device)
+		if err != nil {
+			return err
+		}
+
+		deviceID = saved.device.ID
+		*saved.json = sql.NullString{String: string(jsonBytes), Valid: true}
+	}
+
+	_, err = tx.Exec(`INSERT INTO device_events (device_id, operation, actor, occurred_on, before_json, after_json)
+		VALUES ($1, $2, $3, $4, $5, $6)`, deviceID, operation, sql.NullString{String: sdb.actor, Valid: len(sdb.actor) > 0},
+		now, beforeJson, afterJson)
+	if err != nil {
+		return err
+	}
+
+	return versionDevice(tx, deviceID, after != nil, now)
+}
+
+// versionDevice ends the current version of the device 'id' at 'now', and starts
+// the next one from the row in 'devices' if it 'exists' still, within 'tx'
+func versionDevice(tx *sql.Tx, id int64, exists bool, now time.Time) (err error) {
+	if _, err = tx.Exec("UPDATE device_versions SET valid_to = $2 WHERE device_id = $1 AND valid_to IS NULL", id, now); err != nil {
+		return err
+	}
+
+	if !exists {
+		return nil
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`INSERT INTO device_versions (device_id, %[1]s, valid_from)
+		SELECT id, %[1]s, $2 FROM devices WHERE id = $1`, versionedColumns), id, now)
+
+	return err
+}
+
+// FetchHistory returns a page of the changes made to the device 'id', newest first.
+// The history outlives the device: it is still there once the device is deleted.
+func (sdb *sqlDatabase) FetchHistory(id int64, query HistoryQuery) (page EventPage, err error) {
+	after, err := query.validate(id)
+	if err != nil {
+		return page, err
+	}
+
+	var where sqlConditions
+	where.add(fmt.Sprintf("device_id = %s", where.arg(id)))
+
+	if after > 0 {
+		where.add(fmt.Sprintf("id < %s", where.arg(after)))
+	}
+
+	// One more event than asked tells whether there is a next page
+	rows, err := sdb.db.Query(fmt.Sprintf(`SELECT id, device_id, operation, actor, occurred_on, before_json, after_json
+		FROM device_events %s ORDER BY id DESC LIMIT %d`, where.clause(), query.Limit+1), where.args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	events := []DeviceEvent{}
+	for rows.Next() {
+		var event DeviceEvent
+		var actor, beforeJson, afterJson sql.NullString
+
+		err = rows.Scan(&event.ID, &event.DeviceID, &event.Operation, &actor, &event.OccurredOn, &beforeJson, &afterJson)
+		if err != nil {
+			return page, err
+		}
+
+		event.Actor = actor.String
+		if event.Before, err = unmarshalDevice(beforeJson); err != nil {
+			return page, err
+		}
+
+		if event.After, err = unmarshalDevice(afterJson); err != nil {
+			return page, err
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+
+	// A device that never existed has no history, rather than an empty one.
+	// Devices created before the history was kept do have an empty one.
+	if len(events) == 0 && after == 0 {
+		if _, err = sdb.loadDevice(sdb.db, id); err == sql.ErrNoRows {
+			return page, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+		} else if err != nil {
+			return page, err
+		}
+	}
+
+	return query.paginate(events), nil
+}
+
+// unmarshalDevice reads the device saved as 'saved' in the history, nil if there is none
+func unmarshalDevice(saved sql.NullString) (device *api_model.Device, err error) {
+	if !saved.Valid {
+		return nil, nil
+	}
+
+	device = &api_model.Device{}
+	if err = device.FromJsonBytes([]byte(saved.String)); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
@@ -0,0 +1,301 @@
+package dvapi_db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/duckdb/duckdb-go/v2"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"io"
+	"iter"
+	"os"
+	"strings"
+	"time"
+)
+
+// The formats devices can be exported to
+const (
+	ExportCSV     string = "csv"
+	ExportNDJSON  string = "ndjson"
+	ExportParquet string = "parquet"
+	ExportArrow   string = "arrow"
+)
+
+// ExportArrowBatchSize is how many devices each record of an Arrow stream holds
+const ExportArrowBatchSize int = 1024
+
+// ExportFlushEvery is how many devices are written to NDJSON between flushes,
+// when the writer can flush (a http.ResponseWriter, for instance)
+const ExportFlushEvery int = 100
+
+// flusher is a writer that can send what it buffered right away, as http.Flusher
+type flusher interface {
+	Flush()
+}
+
+// exportTable holds the devices to export. Its columns are those of every format,
+// times being in UTC.
+const exportTable string = `CREATE TABLE devices (
+	id BIGINT,
+	name VARCHAR,
+	brand VARCHAR,
+	state VARCHAR,
+	created_on TIMESTAMP,
+	holder VARCHAR,
+	held_since TIMESTAMP,
+	lease_expires_on TIMESTAMP,
+	lease_renewals INTEGER,
+	version BIGINT,
+	deleted_on TIMESTAMP
+)`
+
+// exportCopyOptions are the COPY options writing each format DuckDB exports
+var exportCopyOptions = map[string]string{
+	ExportCSV:     "FORMAT csv, HEADER true",
+	ExportParquet: "FORMAT parquet",
+}
+
+// exportSchema is the Arrow schema of the exported devices, the same as exportTable
+var exportSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "name", Type: arrow.BinaryTypes.String},
+	{Name: "brand", Type: arrow.BinaryTypes.String},
+	{Name: "state", Type: arrow.BinaryTypes.String},
+	{Name: "created_on", Type: arrow.FixedWidthTypes.Timestamp_us},
+	{Name: "holder", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "held_since", Type: arrow.FixedWidthTypes.Timestamp_us, Nullable: true},
+	{Name: "lease_expires_on", Type: arrow.FixedWidthTypes.Timestamp_us, Nullable: true},
+	{Name: "lease_renewals", Type: arrow.PrimitiveTypes.Int32},
+	{Name: "version", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "deleted_on", Type: arrow.FixedWidthTypes.Timestamp_us, Nullable: true},
+}, nil)
+
+// ExportDevices writes the devices yielded by 'devices' to 'w' in 'format', one of the
+// Export* formats. NDJSON and Arrow are written as the devices come, and flushed along
+// the way if 'w' can. CSV and Parquet are written by an in-memory DuckDB, with COPY,
+// once every device is read. Nothing is written if the first device fails.
+func ExportDevices(w io.Writer, format string, devices iter.Seq2[api_model.Device, error]) (err error) {
+	switch format {
+	case ExportCSV, ExportParquet:
+		return copyDevices(w, format, devices)
+	case ExportNDJSON:
+		return writeNDJSON(w, devices)
+	case ExportArrow:
+		return writeArrow(w, devices)
+	}
+
+	return invalidInputError(ErrCodeInvalidExport, "unknown export format '%s' (use '%s', '%s', '%s' or '%s')",
+		format, ExportCSV, ExportNDJSON, ExportParquet, ExportArrow)
+}
+
+// copyDevices loads 'devices' into an in-memory DuckDB, then has it COPY them to a
+// temporary file in 'format', which is sent to 'w'
+func copyDevices(w io.Writer, format string, devices iter.Seq2[api_model.Device, error]) (err error) {
+	ctx := context.Background()
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The appender and the COPY use the same connection to the in-memory database
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, exportTable); err != nil {
+		return err
+	}
+
+	err = conn.Raw(func(driverConn any) error {
+		appender, err := duckdb.NewAppenderFromConn(driverConn.(driver.Conn), "", "devices")
+		if err != nil {
+			return err
+		}
+
+		for device, err := range devices {
+			if err != nil {
+				appender.Close()
+				return err
+			}
+
+			err = appender.AppendRow(device.ID, device.Name, device.Brand, device.State.ToString(),
+				device.CreatedOn.UTC(), nullString(device.Holder), nullTime(device.HeldSince),
+				nullTime(device.LeaseExpiresOn), int32(device.LeaseRenewals), device.Version, nullTime(device.DeletedOn))
+			if err != nil {
+				appender.Close()
+				return err
+			}
+		}
+
+		return appender.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp("", "dvapi-export-*")
+	if err != nil {
+		return err
+	}
+	temp.Close()
+	defer os.Remove(temp.Name())
+
+	path := strings.ReplaceAll(temp.Name(), "'", "''")
+	if _, err = conn.ExecContext(ctx, fmt.Sprintf("COPY devices TO '%s' (%s)", path, exportCopyOptions[format])); err != nil {
+		return fmt.Errorf("could not export the devices: %w", err)
+	}
+
+	file, err := os.Open(temp.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+
+	return err
+}
+
+// writeNDJSON writes the devices to 'w' one JSON object per line, as the API sends them
+func writeNDJSON(w io.Writer, devices iter.Seq2[api_model.Device, error]) (err error) {
+	encoder := json.NewEncoder(w)
+	written := 0
+
+	for device, err := range devices {
+		if err != nil {
+			return err
+		}
+
+		if err = encoder.Encode(device); err != nil {
+			return err
+		}
+
+		if written++; written%ExportFlushEvery == 0 {
+			flush(w)
+		}
+	}
+
+	return nil
+}
+
+// writeArrow writes the devices to 'w' as an Arrow IPC stream, of records of
+// ExportArrowBatchSize devices at most. Each record is flushed once written.
+func writeArrow(w io.Writer, devices iter.Seq2[api_model.Device, error]) (err error) {
+	var writer *ipc.Writer
+	var batched int
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, exportSchema)
+	defer builder.Release()
+
+	// The stream starts with the first record, so that a failure before it leaves 'w' untouched
+	start := func() *ipc.Writer {
+		if writer == nil {
+			writer = ipc.NewWriter(w, ipc.WithSchema(exportSchema))
+		}
+
+		return writer
+	}
+
+	writeBatch := func() error {
+		record := builder.NewRecord()
+		defer record.Release()
+
+		batched = 0
+		if err := start().Write(record); err != nil {
+			return err
+		}
+
+		flush(w)
+
+		return nil
+	}
+
+	for device, err := range devices {
+		if err != nil {
+			return err
+		}
+
+		appendArrow(builder, device)
+
+		if batched++; batched == ExportArrowBatchSize {
+			if err = writeBatch(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if batched > 0 {
+		if err = writeBatch(); err != nil {
+			return err
+		}
+	}
+
+	// An empty listing still gets its schema
+	return start().Close()
+}
+
+// flush sends what 'w' buffered, if it can
+func flush(w io.Writer) {
+	if f, can := w.(flusher); can {
+		f.Flush()
+	}
+}
+
+// appendArrow appends 'device' to the columns of 'builder', in the order of exportSchema
+func appendArrow(builder *array.RecordBuilder, device api_model.Device) {
+	timestamp := func(column int, at *time.Time) {
+		field := builder.Field(column).(*array.TimestampBuilder)
+		if at == nil {
+			field.AppendNull()
+			return
+		}
+
+		field.Append(arrow.Timestamp(at.UTC().UnixMicro()))
+	}
+
+	builder.Field(0).(*array.Int64Builder).Append(device.ID)
+	builder.Field(1).(*array.StringBuilder).Append(device.Name)
+	builder.Field(2).(*array.StringBuilder).Append(device.Brand)
+	builder.Field(3).(*array.StringBuilder).Append(device.State.ToString())
+	timestamp(4, &device.CreatedOn)
+
+	if holder := builder.Field(5).(*array.StringBuilder); len(device.Holder) > 0 {
+		holder.Append(device.Holder)
+	} else {
+		holder.AppendNull()
+	}
+
+	timestamp(6, device.HeldSince)
+	timestamp(7, device.LeaseExpiresOn)
+	builder.Field(8).(*array.Int32Builder).Append(int32(device.LeaseRenewals))
+	builder.Field(9).(*array.Int64Builder).Append(device.Version)
+	timestamp(10, device.DeletedOn)
+}
+
+// nullString returns 'value' for the appender, NULL if empty
+func nullString(value string) driver.Value {
+	if len(value) == 0 {
+		return nil
+	}
+
+	return value
+}
+
+// nullTime returns 'at' in UTC for the appender, NULL if not set
+func nullTime(at *time.Time) driver.Value {
+	if at == nil {
+		return nil
+	}
+
+	return at.UTC()
+}
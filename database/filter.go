@@ -0,0 +1,105 @@
+package dvapi_db
+
+import (
+	api_model "github.com/lapuglisi/dvapi/model"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DeviceFilter selects the devices of a listing. Every field given must match,
+// the zero DeviceFilter matches every device.
+type DeviceFilter struct {
+	Brands []string // The brand is one of these
+	States []string // The state is one of these
+
+	// The name matches this pattern, regardless of case. '*' matches any
+	// number of characters and '?' exactly one, eg: 'lab-*'
+	NamePattern string
+
+	CreatedAfter  time.Time // Created after this time
+	CreatedBefore time.Time // Created before this time
+
+	// In use with a lease ending by this time
+	LeaseExpiresBefore time.Time
+}
+
+// validate checks the filter values
+func (f *DeviceFilter) validate() (err error) {
+	if slices.Contains(f.Brands, "") {
+		return invalidInputError(ErrCodeInvalidFilter, "empty brand in brand filter")
+	}
+
+	if _, err = parseStates(f.States); err != nil {
+		return err
+	}
+
+	if !f.CreatedAfter.IsZero() && !f.CreatedBefore.IsZero() && !f.CreatedAfter.Before(f.CreatedBefore) {
+		return invalidInputError(ErrCodeInvalidFilter, "devices cannot be created after %s and before %s",
+			f.CreatedAfter.Format(time.RFC3339), f.CreatedBefore.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// matches tells whether 'device' is selected by the filter
+func (f *DeviceFilter) matches(device api_model.Device) bool {
+	switch {
+	case len(f.Brands) > 0 && !slices.Contains(f.Brands, device.Brand):
+		return false
+	case len(f.States) > 0 && !slices.Contains(f.States, device.State.ToString()):
+		return false
+	case len(f.NamePattern) > 0 && !globRegexp(f.NamePattern).MatchString(device.Name):
+		return false
+	case !f.CreatedAfter.IsZero() && !device.CreatedOn.After(f.CreatedAfter):
+		return false
+	case !f.CreatedBefore.IsZero() && !device.CreatedOn.Before(f.CreatedBefore):
+		return false
+	case !f.LeaseExpiresBefore.IsZero() && !leaseExpired(device, f.LeaseExpiresBefore):
+		return false
+	}
+
+	return true
+}
+
+// globRegexp converts the name 'pattern' of a filter into a case-insensitive regexp
+func globRegexp(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+
+	expr.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.MustCompile(expr.String())
+}
+
+// globLike converts the name 'pattern' of a filter into a LIKE pattern, escaped with '\'
+func globLike(pattern string) string {
+	var like strings.Builder
+
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			like.WriteRune('%')
+		case '?':
+			like.WriteRune('_')
+		case '%', '_', '\\':
+			like.WriteRune('\\')
+			like.WriteRune(r)
+		default:
+			like.WriteRune(r)
+		}
+	}
+
+	return like.String()
+}
@@ -0,0 +1,22 @@
+package dvapi_db
+
+import (
+	"time"
+)
+
+// IdempotencyPendingTTL is how long a key stays reserved for a request in progress.
+// Should the request never complete (a crash, say), the key can be used again afterwards.
+const IdempotencyPendingTTL time.Duration = time.Minute
+
+// IdempotentResponse is the saved outcome of a request made with an idempotency key
+type IdempotentResponse struct {
+	Fingerprint string            // Identifies the request the key was first used with
+	Status      int               // The status of the response, 0 while the request is in progress
+	Header      map[string]string // The headers of the response worth replaying
+	Body        []byte
+}
+
+// InProgress tells whether the request the key was first used with is still running
+func (r *IdempotentResponse) InProgress() bool {
+	return r.Status == 0
+}
@@ -0,0 +1,287 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"errors"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The file formats devices can be imported from
+const (
+	ImportCSV     string = "csv"
+	ImportParquet string = "parquet"
+)
+
+// The device fields the columns of an imported file can fill
+const (
+	ImportFieldName  string = "name"
+	ImportFieldBrand string = "brand"
+	ImportFieldState string = "state"
+)
+
+// importFields lists every field, the required ones first
+var importFields = []string{ImportFieldName, ImportFieldBrand, ImportFieldState}
+
+// importQueries read every column of an imported file as text
+var importQueries = map[string]string{
+	ImportCSV:     `SELECT * FROM read_csv($1, all_varchar=true, header=true)`,
+	ImportParquet: `SELECT COLUMNS(*)::VARCHAR FROM read_parquet($1)`,
+}
+
+// ColumnMapping tells which column of an imported file fills each device field,
+// as in {"name": "Device Name"}. A field left out is filled by the column of the
+// same name, regardless of case.
+type ColumnMapping map[string]string
+
+// ImportOptions tell how ImportDevices reads a file
+type ImportOptions struct {
+	Format  string // One of the Import* formats
+	Columns ColumnMapping
+	DryRun  bool // The rows are checked and reported, but no device is kept
+}
+
+// ImportRejection is a row of an imported file that did not become a device
+type ImportRejection struct {
+	Row    int    // The position of the row among the data rows, from 1
+	Code   string // One of the ErrCode* constants
+	Reason string
+}
+
+// ImportReport is the outcome of ImportDevices
+type ImportReport struct {
+	DryRun   bool
+	Rows     int                // The data rows read from the file
+	Imported []api_model.Device // The devices created, without ids on dry runs
+	Rejected []ImportRejection  // Ordered by row
+}
+
+// importRow is the device read from the data row 'row' of an imported file
+type importRow struct {
+	row    int
+	device api_model.Device
+}
+
+// ParseColumnMapping reads a ColumnMapping given as 'field=column' pairs
+// separated by commas, as in "name=Device Name,brand=Maker"
+func ParseColumnMapping(text string) (columns ColumnMapping, err error) {
+	columns = ColumnMapping{}
+
+	if len(strings.TrimSpace(text)) == 0 {
+		return columns, nil
+	}
+
+	for _, pair := range strings.Split(text, ",") {
+		field, column, found := strings.Cut(pair, "=")
+		field, column = strings.ToLower(strings.TrimSpace(field)), strings.TrimSpace(column)
+
+		if !found || len(column) == 0 {
+			return nil, invalidInputError(ErrCodeInvalidImport, "invalid column mapping '%s', expected 'field=column'", pair)
+		}
+
+		if !slices.Contains(importFields, field) {
+			return nil, invalidInputError(ErrCodeInvalidImport, "unknown device field '%s' (use %s)",
+				field, strings.Join(importFields, ", "))
+		}
+
+		columns[field] = column
+	}
+
+	return columns, nil
+}
+
+// ImportFormatFor returns the import format of 'filename' from its extension, empty if unknown
+func ImportFormatFor(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return ImportCSV
+	case ".parquet", ".pq":
+		return ImportParquet
+	}
+
+	return ""
+}
+
+// ImportDevices creates in 'store' a device for each row of the file at 'path'.
+// Rows that are invalid, or that the store refuses, are reported and skipped;
+// the others are created in a single transaction.
+func ImportDevices(store DeviceStore, path string, options ImportOptions) (report ImportReport, err error) {
+	rows, count, rejected, err := readImport(path, options)
+	if err != nil {
+		return report, err
+	}
+
+	report = ImportReport{DryRun: options.DryRun, Rows: count, Rejected: rejected}
+
+	if len(rows) == 0 {
+		return report, nil
+	}
+
+	operations := make([]BulkOperation, len(rows))
+	for i, row := range rows {
+		operations[i] = BulkOperation{Op: BulkCreate, Device: row.device}
+	}
+
+	results, err := store.ApplyBulk(operations, BulkOptions{DryRun: options.DryRun})
+	if err != nil {
+		return report, err
+	}
+
+	for i, result := range results {
+		if result.Err != nil {
+			var storeErr *Error
+			if !errors.As(result.Err, &storeErr) {
+				return report, result.Err
+			}
+
+			report.Rejected = append(report.Rejected, ImportRejection{Row: rows[i].row, Code: storeErr.Code, Reason: storeErr.Message})
+			continue
+		}
+
+		// The ids of a dry run were given back with its transaction
+		if options.DryRun {
+			result.Device.ID, result.Device.Version = 0, 0
+		}
+
+		report.Imported = append(report.Imported, result.Device)
+	}
+
+	slices.SortFunc(report.Rejected, func(a, b ImportRejection) int {
+		return a.Row - b.Row
+	})
+
+	return report, nil
+}
+
+// readImport reads the devices of the file at 'path'. Whatever the store, the
+// file is read by an in-memory DuckDB. The rows that do not hold a valid device
+// are returned as rejections, 'count' is the number of data rows.
+func readImport(path string, options ImportOptions) (rows []importRow, count int, rejected []ImportRejection, err error) {
+	query, known := importQueries[options.Format]
+	if !known {
+		return nil, 0, nil, invalidInputError(ErrCodeInvalidImport, "unknown import format '%s' (use '%s' or '%s')",
+			options.Format, ImportCSV, ImportParquet)
+	}
+
+	reader, err := sql.Open("duckdb", "")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer reader.Close()
+
+	result, err := reader.Query(query, path)
+	if err != nil {
+		return nil, 0, nil, unreadableImport(options.Format, err)
+	}
+	defer result.Close()
+
+	names, err := result.Columns()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	fields, err := mapColumns(names, options.Columns)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	values := make([]sql.NullString, len(names))
+	targets := make([]any, len(names))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+
+	value := func(field string) string {
+		if i, mapped := fields[field]; mapped {
+			return strings.TrimSpace(values[i].String)
+		}
+
+		return ""
+	}
+
+	for result.Next() {
+		if err = result.Scan(targets...); err != nil {
+			return nil, 0, nil, err
+		}
+		count++
+
+		device, err := importDevice(value(ImportFieldName), value(ImportFieldBrand), value(ImportFieldState))
+		if err != nil {
+			var storeErr *Error
+			errors.As(err, &storeErr)
+
+			rejected = append(rejected, ImportRejection{Row: count, Code: storeErr.Code, Reason: storeErr.Message})
+			continue
+		}
+
+		rows = append(rows, importRow{row: count, device: device})
+	}
+
+	if err = result.Err(); err != nil {
+		return nil, 0, nil, unreadableImport(options.Format, err)
+	}
+
+	return rows, count, rejected, nil
+}
+
+// mapColumns returns the index, among 'names', of the column filling each field.
+// The name and brand must have a column, the state may not.
+func mapColumns(names []string, columns ColumnMapping) (fields map[string]int, err error) {
+	fields = map[string]int{}
+
+	for _, field := range importFields {
+		column, mapped := columns[field]
+		if !mapped {
+			column = field
+		}
+
+		i := slices.Index(names, column)
+		if i < 0 {
+			i = slices.IndexFunc(names, func(name string) bool {
+				return strings.EqualFold(name, column)
+			})
+		}
+
+		switch {
+		case i >= 0:
+			fields[field] = i
+		case mapped:
+			return nil, invalidInputError(ErrCodeInvalidImport, "the file has no column '%s' for the device %s", column, field)
+		case field != ImportFieldState:
+			return nil, invalidInputError(ErrCodeInvalidImport, "the file has no '%s' column, map one with '%s=<column>'", field, field)
+		}
+	}
+
+	return fields, nil
+}
+
+// importDevice checks the values read from a row, and returns the device they describe.
+// An empty state is left to the store, which makes new devices available.
+func importDevice(name string, brand string, state string) (device api_model.Device, err error) {
+	if len(name) == 0 {
+		return device, invalidInputError(ErrCodeMissingField, "the device has no name")
+	}
+
+	if len(brand) == 0 {
+		return device, invalidInputError(ErrCodeMissingField, "the device has no brand")
+	}
+
+	device = api_model.Device{Name: name, Brand: brand}
+
+	if len(state) > 0 {
+		if device.State, err = api_model.ParseDeviceState(strings.ToLower(state)); err != nil {
+			return device, invalidInputError(ErrCodeInvalidState, "%s", err.Error())
+		}
+	}
+
+	return device, nil
+}
+
+// unreadableImport reports a file DuckDB could not read, with the first line of its error
+func unreadableImport(format string, err error) error {
+	reason, _, _ := strings.Cut(err.Error(), "\n")
+
+	return invalidInputError(ErrCodeInvalidImport, "could not read the %s file: %s", format, reason)
+}
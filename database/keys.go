@@ -0,0 +1,325 @@
+package dvapi_db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The scopes an API key can be granted. Each one grants the ones before it:
+// writing devices implies reading them, administering them implies both.
+const (
+	ScopeDevicesRead  string = "devices:read"
+	ScopeDevicesWrite string = "devices:write"
+	ScopeDevicesAdmin string = "devices:admin"
+)
+
+// scopeRanks orders the scopes, a scope granting those of a lower rank
+var scopeRanks = map[string]int{ScopeDevicesRead: 1, ScopeDevicesWrite: 2, ScopeDevicesAdmin: 3}
+
+// ApiKeyPrefix starts every API key, which makes them easy to spot in a leak
+const ApiKeyPrefix string = "dvapi_"
+
+// apiKeyShownLength is how many characters of a key are kept in the clear, to tell keys apart
+const apiKeyShownLength int = len(ApiKeyPrefix) + 6
+
+// ApiKey is a key the HTTP API can be used with. The key itself is never kept.
+type ApiKey struct {
+	ID        int64
+	Name      string   // Who the key is for, recorded as the author of the changes made with it
+	Prefix    string   // The first characters of the key
+	Scopes    []string // The Scope* constants granted, lowest first
+	CreatedOn time.Time
+	RevokedOn *time.Time // When the key was revoked, nil while it can be used
+}
+
+// Allows tells whether the key grants 'scope', directly or through a higher scope
+func (k *ApiKey) Allows(scope string) bool {
+	for _, granted := range k.Scopes {
+		if scopeRanks[granted] >= scopeRanks[scope] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseScopes reads a comma delimited list of scopes, as in 'devices:read,devices:write'
+func ParseScopes(scopes string) (parsed []string, err error) {
+	parsed = []string{}
+
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope = strings.TrimSpace(scope); len(scope) == 0 {
+			continue
+		}
+
+		if _, valid := scopeRanks[scope]; !valid {
+			return nil, invalidInputError(ErrCodeInvalidScope, "unknown scope '%s' (use '%s', '%s' or '%s')", scope,
+				ScopeDevicesRead, ScopeDevicesWrite, ScopeDevicesAdmin)
+		}
+
+		if !slices.Contains(parsed, scope) {
+			parsed = append(parsed, scope)
+		}
+	}
+
+	return parsed, nil
+}
+
+// apiKeyMinSecretLength is the shortest secret accepted from outside, see BootstrapApiKey.
+// The ones made by newApiKey are longer, their 32 random bytes giving 43 characters.
+const apiKeyMinSecretLength int = len(ApiKeyPrefix) + 32
+
+// newApiKey validates the 'name' and 'scopes' of a key to create, and returns
+// it along with its secret: 'given', or a new random one if empty
+func newApiKey(name string, scopes []string, given string) (key ApiKey, secret string, err error) {
+	if name = strings.TrimSpace(name); len(name) == 0 {
+		return key, "", invalidInputError(ErrCodeInvalidApiKey, "an API key needs a name")
+	}
+
+	if len(scopes) == 0 {
+		return key, "", invalidInputError(ErrCodeInvalidScope, "an API key needs at least one scope")
+	}
+
+	if scopes, err = ParseScopes(strings.Join(scopes, ",")); err != nil {
+		return key, "", err
+	}
+
+	slices.SortFunc(scopes, func(a, b string) int {
+		return scopeRanks[a] - scopeRanks[b]
+	})
+
+	if secret = given; len(secret) == 0 {
+		random := make([]byte, 32)
+		if _, err = rand.Read(random); err != nil {
+			return key, "", err
+		}
+
+		secret = ApiKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+	} else if !strings.HasPrefix(secret, ApiKeyPrefix) || len(secret) < apiKeyMinSecretLength {
+		return key, "", invalidInputError(ErrCodeInvalidApiKey, "an API key starts with '%s' followed by at least %d characters",
+			ApiKeyPrefix, apiKeyMinSecretLength-len(ApiKeyPrefix))
+	}
+
+	key = ApiKey{Name: name, Prefix: secret[:apiKeyShownLength], Scopes: scopes, CreatedOn: time.Now().UTC()}
+
+	return key, secret, nil
+}
+
+// hashApiKey returns the hash 'secret' is kept as. Keys are random enough for a
+// plain SHA-256 to do, they cannot be guessed the way passwords are.
+func hashApiKey(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateApiKey creates a key named 'name' granting 'scopes', and returns it along
+// with the secret to present. The secret is not kept, it cannot be shown again.
+func (sdb *sqlDatabase) CreateApiKey(name string, scopes []string) (key ApiKey, secret string, err error) {
+	if key, secret, err = newApiKey(name, scopes, ""); err != nil {
+		return key, "", err
+	}
+
+	err = sdb.runWrite(func() (err error) {
+		return sdb.db.QueryRow(`INSERT INTO api_keys (name, prefix, key_hash, scopes, created_on)
+			VALUES ($1, $2, $3, $4, $5) RETURNING id`, key.Name, key.Prefix, hashApiKey(secret),
+			strings.Join(key.Scopes, ","), key.CreatedOn).Scan(&key.ID)
+	})
+
+	if err != nil {
+		return ApiKey{}, "", err
+	}
+
+	return key, secret, nil
+}
+
+// BootstrapApiKey creates the key 'secret', named 'name' and granting 'scopes', only
+// if there are no keys at all yet, revoked ones included. It returns the key, or nil
+// if there were keys already. Deployments hand their first key this way.
+func (sdb *sqlDatabase) BootstrapApiKey(name string, scopes []string, secret string) (key *ApiKey, err error) {
+	created, secret, err := newApiKey(name, scopes, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var existing int64
+
+	err = sdb.inTx(func(tx *sql.Tx) (err error) {
+		if err = tx.QueryRow("SELECT COUNT(*) FROM api_keys").Scan(&existing); err != nil || existing > 0 {
+			return err
+		}
+
+		return tx.QueryRow(`INSERT INTO api_keys (name, prefix, key_hash, scopes, created_on)
+			VALUES ($1, $2, $3, $4, $5) RETURNING id`, created.Name, created.Prefix, hashApiKey(secret),
+			strings.Join(created.Scopes, ","), created.CreatedOn).Scan(&created.ID)
+	})
+
+	if err != nil || existing > 0 {
+		return nil, err
+	}
+
+	return &created, nil
+}
+
+// apiKeyColumns are the columns scanned by scanApiKey
+const apiKeyColumns string = "id, name, prefix, scopes, created_on, revoked_on"
+
+// scanApiKey reads the 'apiKeyColumns' of 'row' into a key
+func scanApiKey(row rowScanner) (key ApiKey, err error) {
+	var scopes string
+	var revokedOn sql.NullTime
+
+	if err = row.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedOn, &revokedOn); err != nil {
+		return key, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	if revokedOn.Valid {
+		key.RevokedOn = &revokedOn.Time
+	}
+
+	return key, nil
+}
+
+// ListApiKeys returns every key, revoked ones included, oldest first
+func (sdb *sqlDatabase) ListApiKeys() (keys []ApiKey, err error) {
+	rows, err := sdb.db.Query("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys = []ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeApiKey makes the key 'id' unusable from now on, and returns it.
+// Revoking a key twice keeps the time it was first revoked.
+func (sdb *sqlDatabase) RevokeApiKey(id int64) (key ApiKey, err error) {
+	err = sdb.runWrite(func() (err error) {
+		_, err = sdb.db.Exec("UPDATE api_keys SET revoked_on = $2 WHERE id = $1 AND revoked_on IS NULL", id, time.Now().UTC())
+
+		return err
+	})
+
+	if err != nil {
+		return key, err
+	}
+
+	key, err = scanApiKey(sdb.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return key, notFoundError(ErrCodeApiKeyNotFound, "API key %d not found", id)
+	}
+
+	return key, err
+}
+
+// FindApiKey returns the key whose secret is 'secret', nil if there is none or it was revoked
+func (sdb *sqlDatabase) FindApiKey(secret string) (key *ApiKey, err error) {
+	found, err := scanApiKey(sdb.db.QueryRow("SELECT "+apiKeyColumns+` FROM api_keys
+		WHERE key_hash = $1 AND revoked_on IS NULL`, hashApiKey(secret)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &found, nil
+}
+
+// CreateApiKey follows the same rules as DuckDatabase.CreateApiKey
+func (mdb *MemoryDatabase) CreateApiKey(name string, scopes []string) (key ApiKey, secret string, err error) {
+	if key, secret, err = newApiKey(name, scopes, ""); err != nil {
+		return key, "", err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	key.ID = int64(len(mdb.apiKeys) + 1)
+	mdb.apiKeys = append(mdb.apiKeys, memoryApiKey{key: key, hash: hashApiKey(secret)})
+
+	return key, secret, nil
+}
+
+// BootstrapApiKey follows the same rules as DuckDatabase.BootstrapApiKey
+func (mdb *MemoryDatabase) BootstrapApiKey(name string, scopes []string, secret string) (key *ApiKey, err error) {
+	created, secret, err := newApiKey(name, scopes, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	if len(mdb.apiKeys) > 0 {
+		return nil, nil
+	}
+
+	created.ID = 1
+	mdb.apiKeys = append(mdb.apiKeys, memoryApiKey{key: created, hash: hashApiKey(secret)})
+
+	return &created, nil
+}
+
+// ListApiKeys returns every key, revoked ones included, oldest first
+func (mdb *MemoryDatabase) ListApiKeys() (keys []ApiKey, err error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	keys = []ApiKey{}
+	for _, saved := range mdb.apiKeys {
+		keys = append(keys, saved.key)
+	}
+
+	return keys, nil
+}
+
+// RevokeApiKey follows the same rules as DuckDatabase.RevokeApiKey
+func (mdb *MemoryDatabase) RevokeApiKey(id int64) (key ApiKey, err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	if id <= 0 || id > int64(len(mdb.apiKeys)) {
+		return key, notFoundError(ErrCodeApiKeyNotFound, "API key %d not found", id)
+	}
+
+	saved := &mdb.apiKeys[id-1]
+	if saved.key.RevokedOn == nil {
+		now := time.Now().UTC()
+		saved.key.RevokedOn = &now
+	}
+
+	return saved.key, nil
+}
+
+// FindApiKey returns the key whose secret is 'secret', nil if there is none or it was revoked
+func (mdb *MemoryDatabase) FindApiKey(secret string) (key *ApiKey, err error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	hash := hashApiKey(secret)
+	for _, saved := range mdb.apiKeys {
+		if saved.hash == hash && saved.key.RevokedOn == nil {
+			found := saved.key
+			return &found, nil
+		}
+	}
+
+	return nil, nil
+}
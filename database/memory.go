@@ -0,0 +1,810 @@
+package dvapi_db
+
+import (
+	"cmp"
+	"fmt"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryDatabase is a DeviceStore that keeps every device in memory.
+// Nothing is persisted, which makes it handy for tests.
+type MemoryDatabase struct {
+	*memoryData
+
+	// actor is recorded as the author of the changes, see WithActor
+	actor string
+}
+
+// memoryData is what the copies of a MemoryDatabase made by WithActor share
+type memoryData struct {
+	mutex   sync.RWMutex
+	devices map[int64]api_model.Device
+	lastID  int64
+	unique  UniquePolicy
+
+	// deleted are the deleted devices, kept apart until restored or purged
+	deleted map[int64]api_model.Device
+
+	// events is the history of every device, the id of an event being its position plus one
+	events []DeviceEvent
+
+	idempotencyKeys map[string]memoryIdempotencyKey
+
+	// apiKeys are the API keys, the id of a key being its position plus one
+	apiKeys []memoryApiKey
+}
+
+// memoryIdempotencyKey is a response saved with an idempotency key
+type memoryIdempotencyKey struct {
+	response  IdempotentResponse
+	expiresOn time.Time
+}
+
+// memoryApiKey is an API key along with the hash of its secret
+type memoryApiKey struct {
+	key  ApiKey
+	hash string
+}
+
+// NewMemoryDatabase returns a new, empty, MemoryDatabase
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		memoryData: &memoryData{
+			devices:         map[int64]api_model.Device{},
+			deleted:         map[int64]api_model.Device{},
+			idempotencyKeys: map[string]memoryIdempotencyKey{},
+		},
+	}
+}
+
+// CreateDevice stores 'device', assigning it the next available id
+func (mdb *MemoryDatabase) CreateDevice(device *api_model.Device) (err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	return mdb.createDevice(device)
+}
+
+// createDevice stores 'device'. The caller holds the lock.
+func (mdb *MemoryDatabase) createDevice(device *api_model.Device) (err error) {
+	if len(device.State) == 0 {
+		device.State = api_model.DeviceStateAvailable
+	}
+
+	if err = validateState(device.State); err != nil {
+		return err
+	}
+
+	if err = mdb.checkUnique(*device); err != nil {
+		return err
+	}
+
+	mdb.lastID++
+
+	device.ID = mdb.lastID
+	device.CreatedOn = time.Now().UTC()
+	device.Version = 1
+
+	if leaseExpiresOn := leaseExpiry(device.State, device.CreatedOn); leaseExpiresOn.Valid {
+		device.LeaseExpiresOn = &leaseExpiresOn.Time
+	}
+
+	mdb.devices[device.ID] = *device
+	mdb.recordEvent(EventCreate, nil, device)
+
+	return nil
+}
+
+// UpdateDevice follows the same rules as DuckDatabase.UpdateDevice
+func (mdb *MemoryDatabase) UpdateDevice(device api_model.Device) (err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	_, err = mdb.updateDevice(device)
+
+	return err
+}
+
+// updateDevice applies 'device' and returns the result. The caller holds the lock.
+func (mdb *MemoryDatabase) updateDevice(device api_model.Device) (updated api_model.Device, err error) {
+	if device.ID <= 0 {
+		return updated, invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", device.ID)
+	}
+
+	if len(device.State) > 0 {
+		if err = validateState(device.State); err != nil {
+			return updated, err
+		}
+	}
+
+	current, exists := mdb.devices[device.ID]
+	if !exists {
+		return updated, notFoundError(ErrCodeDeviceNotFound, "device %d not found", device.ID)
+	}
+
+	if err = checkVersion(current, device.Version); err != nil {
+		return updated, err
+	}
+
+	if current.State == api_model.DeviceStateInUse {
+		return updated, conflictError(ErrCodeDeviceInUse, "cannot update a device in 'in-use' state")
+	}
+
+	if len(device.State) > 0 {
+		if err = validateTransition(current.State, device.State); err != nil {
+			return updated, err
+		}
+	}
+
+	if len(device.Name) > 0 {
+		current.Name = device.Name
+	}
+
+	if len(device.Brand) > 0 {
+		current.Brand = device.Brand
+	}
+
+	if len(device.State) > 0 {
+		current.State = device.State
+	}
+
+	if err = mdb.checkUnique(current); err != nil {
+		return updated, err
+	}
+
+	if leaseExpiresOn := leaseExpiry(current.State, time.Now().UTC()); leaseExpiresOn.Valid {
+		current.LeaseExpiresOn = &leaseExpiresOn.Time
+	} else {
+		current.LeaseExpiresOn = nil
+	}
+
+	before := mdb.devices[device.ID]
+
+	current.Version++
+	mdb.devices[device.ID] = current
+	mdb.recordEvent(EventUpdate, &before, &current)
+
+	return current, nil
+}
+
+// DeleteDevice follows the same rules as DuckDatabase.DeleteDevice
+func (mdb *MemoryDatabase) DeleteDevice(device api_model.Device) (err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	return mdb.deleteDevice(device)
+}
+
+// deleteDevice removes 'device'. The caller holds the lock.
+func (mdb *MemoryDatabase) deleteDevice(device api_model.Device) (err error) {
+	if device.ID <= 0 {
+		return invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", device.ID)
+	}
+
+	current, exists := mdb.devices[device.ID]
+	if !exists {
+		return notFoundError(ErrCodeDeviceNotFound, "device %d not found", device.ID)
+	}
+
+	if err = checkVersion(current, device.Version); err != nil {
+		return err
+	}
+
+	if current.State == api_model.DeviceStateInUse {
+		return conflictError(ErrCodeDeviceInUse, "cannot delete a device in 'in-use' state")
+	}
+
+	deleted, deletedOn := current, time.Now().UTC()
+	deleted.DeletedOn = &deletedOn
+	deleted.Version++
+
+	delete(mdb.devices, device.ID)
+	mdb.deleted[device.ID] = deleted
+	mdb.recordEvent(EventDelete, &current, nil)
+
+	return nil
+}
+
+// RestoreDevice follows the same rules as DuckDatabase.RestoreDevice
+func (mdb *MemoryDatabase) RestoreDevice(id int64) (device api_model.Device, err error) {
+	if id <= 0 {
+		return device, invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", id)
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	deleted, found := mdb.deleted[id]
+	if _, exists := mdb.devices[id]; exists {
+		return device, conflictError(ErrCodeDeviceNotDeleted, "device %d is not deleted", id)
+	} else if !found {
+		return device, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	if err = mdb.checkUnique(deleted); err != nil {
+		return device, err
+	}
+
+	device = deleted
+	device.DeletedOn = nil
+	device.Version++
+
+	delete(mdb.deleted, id)
+	mdb.devices[id] = device
+	mdb.recordEvent(EventRestore, &deleted, &device)
+
+	return device, nil
+}
+
+// PurgeDevices follows the same rules as DuckDatabase.PurgeDevices
+func (mdb *MemoryDatabase) PurgeDevices(before time.Time) (purged int64, err error) {
+	if before.IsZero() {
+		return 0, invalidInputError(ErrCodeInvalidPurge, "the devices to purge are those deleted before a given time")
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	// By id, so the events are recorded in the same order every time
+	for _, id := range slices.Sorted(maps.Keys(mdb.deleted)) {
+		if device := mdb.deleted[id]; !device.DeletedOn.After(before) {
+			delete(mdb.deleted, id)
+			mdb.recordEvent(EventPurge, &device, nil)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// ApplyBulk follows the same rules as DuckDatabase.ApplyBulk. The devices are
+// copied beforehand, to be put back if an atomic bulk fails or on dry runs.
+func (mdb *MemoryDatabase) ApplyBulk(operations []BulkOperation, options BulkOptions) (results []BulkResult, err error) {
+	if err = validateBulk(operations); err != nil {
+		return nil, err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	devices, deleted, lastID, events := maps.Clone(mdb.devices), maps.Clone(mdb.deleted), mdb.lastID, len(mdb.events)
+
+	results = make([]BulkResult, len(operations))
+	for i, operation := range operations {
+		device := operation.Device
+
+		switch operation.Op {
+		case BulkCreate:
+			err = mdb.createDevice(&device)
+		case BulkUpdate:
+			device, err = mdb.updateDevice(device)
+		case BulkDelete:
+			err = mdb.deleteDevice(device)
+		}
+
+		switch {
+		case err == nil:
+			results[i].Device = device
+		case options.Atomic:
+			mdb.devices, mdb.deleted, mdb.lastID, mdb.events = devices, deleted, lastID, mdb.events[:events]
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		default:
+			results[i].Err = err
+		}
+	}
+
+	if options.DryRun {
+		mdb.devices, mdb.deleted, mdb.lastID, mdb.events = devices, deleted, lastID, mdb.events[:events]
+	}
+
+	return results, nil
+}
+
+// checkUnique makes sure no device other than 'device' has its name (and brand).
+// The caller holds the lock.
+func (mdb *MemoryDatabase) checkUnique(device api_model.Device) error {
+	key := mdb.unique.key(device.Name, device.Brand)
+	if !key.Valid {
+		return nil
+	}
+
+	for id, other := range mdb.devices {
+		if id != device.ID && mdb.unique.key(other.Name, other.Brand) == key {
+			return mdb.unique.duplicateError(id, device.Name, device.Brand)
+		}
+	}
+
+	return nil
+}
+
+// SetUniquePolicy follows the same rules as DuckDatabase.SetUniquePolicy
+func (mdb *MemoryDatabase) SetUniquePolicy(policy UniquePolicy) (err error) {
+	if policy, err = ParseUniquePolicy(string(policy)); err != nil {
+		return err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	// Devices are checked by id, so the one reported is the oldest, as in the SQL stores
+	taken := map[string]int64{}
+	for _, id := range slices.Sorted(maps.Keys(mdb.devices)) {
+		device := mdb.devices[id]
+
+		if key := policy.key(device.Name, device.Brand); key.Valid {
+			if existing, found := taken[key.String]; found {
+				return policy.duplicateError(existing, device.Name, device.Brand)
+			}
+			taken[key.String] = id
+		}
+	}
+
+	mdb.unique = policy
+
+	return nil
+}
+
+// CheckoutDevice follows the same rules as DuckDatabase.CheckoutDevice
+func (mdb *MemoryDatabase) CheckoutDevice(id int64, holder string, ttl time.Duration) (device api_model.Device, err error) {
+	if err = validateCheckout(id, holder); err != nil {
+		return device, err
+	}
+
+	if err = validateLease(ttl); err != nil {
+		return device, err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	current, exists := mdb.devices[id]
+	if !exists {
+		return device, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	now := time.Now().UTC()
+
+	if current.State != api_model.DeviceStateAvailable && !leaseExpired(current, now) {
+		if err = checkoutConflict(current, holder); err != nil {
+			return device, err
+		}
+
+		return current, nil
+	}
+
+	before, leaseExpiresOn := current, now.Add(ttl)
+
+	current.State = api_model.DeviceStateInUse
+	current.Holder = holder
+	current.HeldSince = &now
+	current.LeaseExpiresOn = &leaseExpiresOn
+	current.LeaseRenewals = 0
+	current.Version++
+
+	mdb.devices[id] = current
+	mdb.recordEvent(EventCheckout, &before, &current)
+
+	return current, nil
+}
+
+// CheckinDevice follows the same rules as DuckDatabase.CheckinDevice
+func (mdb *MemoryDatabase) CheckinDevice(id int64, holder string) (device api_model.Device, err error) {
+	if err = validateCheckout(id, holder); err != nil {
+		return device, err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	current, exists := mdb.devices[id]
+	if !exists {
+		return device, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	if current.State != api_model.DeviceStateInUse || (len(current.Holder) > 0 && current.Holder != holder) {
+		return device, checkinConflict(current, holder)
+	}
+
+	device = release(current)
+
+	mdb.devices[id] = device
+	mdb.recordEvent(EventCheckin, &current, &device)
+
+	return device, nil
+}
+
+// RenewLease follows the same rules as DuckDatabase.RenewLease
+func (mdb *MemoryDatabase) RenewLease(id int64, holder string, ttl time.Duration) (device api_model.Device, err error) {
+	if err = validateCheckout(id, holder); err != nil {
+		return device, err
+	}
+
+	if err = validateLease(ttl); err != nil {
+		return device, err
+	}
+
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	current, exists := mdb.devices[id]
+	if !exists {
+		return device, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	now := time.Now().UTC()
+	if err = renewConflict(current, holder, now); err != nil {
+		return device, err
+	}
+
+	before, leaseExpiresOn := current, now.Add(ttl)
+
+	current.LeaseExpiresOn = &leaseExpiresOn
+	current.LeaseRenewals++
+	current.Version++
+
+	mdb.devices[id] = current
+	mdb.recordEvent(EventRenew, &before, &current)
+
+	return current, nil
+}
+
+// ExpireLeases releases every in-use device whose lease ended by 'now'
+func (mdb *MemoryDatabase) ExpireLeases(now time.Time) (expired int64, err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	// By id, so the events are recorded in the same order every time
+	for _, id := range slices.Sorted(maps.Keys(mdb.devices)) {
+		if device := mdb.devices[id]; leaseExpired(device, now) {
+			released := release(device)
+
+			mdb.devices[id] = released
+			mdb.recordEvent(EventExpire, &device, &released)
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+// WithActor returns the store recording 'actor' as the author of the changes it
+// makes, sharing the devices with 'mdb'
+func (mdb *MemoryDatabase) WithActor(actor string) DeviceStore {
+	return &MemoryDatabase{memoryData: mdb.memoryData, actor: actor}
+}
+
+// recordEvent appends the change of a device from 'before' to 'after' to its history.
+// The caller holds the lock.
+func (mdb *MemoryDatabase) recordEvent(operation string, before *api_model.Device, after *api_model.Device) {
+	event := DeviceEvent{
+		ID:         int64(len(mdb.events)) + 1,
+		Operation:  operation,
+		Actor:      mdb.actor,
+		OccurredOn: time.Now().UTC(),
+	}
+
+	// Copies, so that the history does not follow the devices
+	if before != nil {
+		saved := *before
+		event.DeviceID, event.Before = saved.ID, &saved
+	}
+
+	if after != nil {
+		saved := *after
+		event.DeviceID, event.After = saved.ID, &saved
+	}
+
+	mdb.events = append(mdb.events, event)
+}
+
+// FetchHistory follows the same rules as DuckDatabase.FetchHistory
+func (mdb *MemoryDatabase) FetchHistory(id int64, query HistoryQuery) (page EventPage, err error) {
+	after, err := query.validate(id)
+	if err != nil {
+		return page, err
+	}
+
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	events := []DeviceEvent{}
+	for i := len(mdb.events) - 1; i >= 0 && len(events) <= query.Limit; i-- {
+		if event := mdb.events[i]; event.DeviceID == id && (after == 0 || event.ID < after) {
+			events = append(events, event)
+		}
+	}
+
+	if _, exists := mdb.devices[id]; len(events) == 0 && after == 0 && !exists {
+		return page, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	return query.paginate(events), nil
+}
+
+// release returns 'device' back in the available state, without holder nor lease
+func release(device api_model.Device) api_model.Device {
+	device.State = api_model.DeviceStateAvailable
+	device.Holder = ""
+	device.HeldSince = nil
+	device.LeaseExpiresOn = nil
+	device.LeaseRenewals = 0
+	device.Version++
+
+	return device
+}
+
+// Fetch returns the device with 'id'
+func (mdb *MemoryDatabase) Fetch(id int) (devices api_model.Devices, err error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	device, exists := mdb.devices[int64(id)]
+	if !exists {
+		return nil, notFoundError(ErrCodeDeviceNotFound, "device %d not found", id)
+	}
+
+	return api_model.Devices{device}, nil
+}
+
+// FetchAll returns all devices ordered by creation
+func (mdb *MemoryDatabase) FetchAll() (devices api_model.Devices, err error) {
+	return mdb.filter(func(api_model.Device) bool { return true }), nil
+}
+
+// FetchPage returns one page of devices, following the same order as DuckDatabase.FetchPage
+func (mdb *MemoryDatabase) FetchPage(query PageQuery) (page DevicePage, err error) {
+	after, err := query.validate()
+	if err != nil {
+		return page, err
+	}
+
+	devices := mdb.listing(query, after)
+
+	return query.paginate(devices[:min(len(devices), query.Limit+1)]), nil
+}
+
+// IterateDevices yields the devices DuckDatabase.IterateDevices would, out of a
+// copy of them taken when the iteration starts
+func (mdb *MemoryDatabase) IterateDevices(query PageQuery) iter.Seq2[api_model.Device, error] {
+	return func(yield func(api_model.Device, error) bool) {
+		after, err := query.validateOrder()
+		if err != nil {
+			yield(api_model.Device{}, err)
+			return
+		}
+
+		for _, device := range mdb.listing(query, after) {
+			if !yield(device, nil) {
+				return
+			}
+		}
+	}
+}
+
+// listing returns, in the order of 'query', the devices it selects after 'after'
+func (mdb *MemoryDatabase) listing(query PageQuery, after *pageCursor) (devices api_model.Devices) {
+	var filter func(match func(api_model.Device) bool) api_model.Devices = mdb.filter
+
+	if !query.AsOf.IsZero() {
+		filter = func(match func(api_model.Device) bool) api_model.Devices {
+			return mdb.snapshot(query.AsOf, match)
+		}
+	} else if query.IncludeDeleted {
+		filter = func(match func(api_model.Device) bool) api_model.Devices {
+			return append(mdb.filter(match), mdb.filterDeleted(match)...)
+		}
+	}
+
+	devices = filter(func(d api_model.Device) bool {
+		if !query.Filter.matches(d) {
+			return false
+		} else if after == nil {
+			return true
+		} else if query.Desc {
+			return after.compare(d) < 0
+		}
+
+		return after.compare(d) > 0
+	})
+
+	slices.SortFunc(devices, func(a, b api_model.Device) int {
+		if query.Desc {
+			return compareDevices(b, a, query.Sort)
+		}
+
+		return compareDevices(a, b, query.Sort)
+	})
+
+	return devices
+}
+
+// FetchByBrand returns the devices whose brand is in 'brands'
+func (mdb *MemoryDatabase) FetchByBrand(brands []string) (devices api_model.Devices, err error) {
+	if len(brands) == 0 {
+		return nil, invalidInputError(ErrCodeInvalidFilter, "no brand defined")
+	}
+
+	return mdb.filter(func(d api_model.Device) bool {
+		return slices.Contains(brands, d.Brand)
+	}), nil
+}
+
+// FetchByState returns the devices whose state is in 'states'
+func (mdb *MemoryDatabase) FetchByState(states []string) (devices api_model.Devices, err error) {
+	if len(states) == 0 {
+		return nil, invalidInputError(ErrCodeInvalidFilter, "no state defined")
+	}
+
+	parsed, err := parseStates(states)
+	if err != nil {
+		return nil, err
+	}
+
+	return mdb.filter(func(d api_model.Device) bool {
+		return slices.Contains(parsed, d.State)
+	}), nil
+}
+
+// FetchLeasesExpiringBefore returns the in-use devices whose lease ends by 'before'
+func (mdb *MemoryDatabase) FetchLeasesExpiringBefore(before time.Time) (devices api_model.Devices, err error) {
+	devices = mdb.filter(func(d api_model.Device) bool {
+		return leaseExpired(d, before)
+	})
+
+	slices.SortStableFunc(devices, func(a, b api_model.Device) int {
+		return a.LeaseExpiresOn.Compare(*b.LeaseExpiresOn)
+	})
+
+	return devices, nil
+}
+
+// SearchDevices returns the devices whose name or brand best match 'text'.
+// There is no index, the trigrams of every device are computed on each search.
+func (mdb *MemoryDatabase) SearchDevices(text string, limit int) (results []SearchResult, err error) {
+	searched, limit, err := validateSearch(text, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results = []SearchResult{}
+	for _, device := range mdb.filter(func(api_model.Device) bool { return true }) {
+		score := max(fieldSimilarity(searched, device.Name), fieldSimilarity(searched, device.Brand))
+		if score >= SearchMinScore {
+			results = append(results, SearchResult{Device: device, Score: score})
+		}
+	}
+
+	return rankResults(results, limit), nil
+}
+
+// ReserveIdempotencyKey follows the same rules as DuckDatabase.ReserveIdempotencyKey
+func (mdb *MemoryDatabase) ReserveIdempotencyKey(key string, fingerprint string) (saved *IdempotentResponse, err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	now := time.Now().UTC()
+
+	if current, exists := mdb.idempotencyKeys[key]; exists && current.expiresOn.After(now) {
+		return &current.response, nil
+	}
+
+	mdb.idempotencyKeys[key] = memoryIdempotencyKey{
+		response:  IdempotentResponse{Fingerprint: fingerprint},
+		expiresOn: now.Add(IdempotencyPendingTTL),
+	}
+
+	return nil, nil
+}
+
+// CompleteIdempotencyKey saves 'response' with the reserved 'key'
+func (mdb *MemoryDatabase) CompleteIdempotencyKey(key string, response IdempotentResponse, expiresOn time.Time) (err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	if current, exists := mdb.idempotencyKeys[key]; exists && current.response.InProgress() {
+		response.Fingerprint = current.response.Fingerprint
+		mdb.idempotencyKeys[key] = memoryIdempotencyKey{response: response, expiresOn: expiresOn}
+	}
+
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets the reserved 'key'
+func (mdb *MemoryDatabase) ReleaseIdempotencyKey(key string) (err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	if current, exists := mdb.idempotencyKeys[key]; exists && current.response.InProgress() {
+		delete(mdb.idempotencyKeys, key)
+	}
+
+	return nil
+}
+
+// PurgeIdempotencyKeys forgets the keys that expired by 'now'
+func (mdb *MemoryDatabase) PurgeIdempotencyKeys(now time.Time) (purged int64, err error) {
+	mdb.mutex.Lock()
+	defer mdb.mutex.Unlock()
+
+	for key, current := range mdb.idempotencyKeys {
+		if !current.expiresOn.After(now) {
+			delete(mdb.idempotencyKeys, key)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// Release does nothing, there is nothing to release
+func (mdb *MemoryDatabase) Release() (err error) {
+	return nil
+}
+
+// filter returns, ordered by id (i.e. creation), the devices for which 'match' is true
+func (mdb *MemoryDatabase) filter(match func(api_model.Device) bool) (devices api_model.Devices) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	devices = api_model.Devices{}
+	for _, device := range mdb.devices {
+		if match(device) {
+			devices = append(devices, device)
+		}
+	}
+
+	slices.SortFunc(devices, func(a, b api_model.Device) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return devices
+}
+
+// filterDeleted returns the deleted devices that 'match', in no particular order
+func (mdb *MemoryDatabase) filterDeleted(match func(api_model.Device) bool) (devices api_model.Devices) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	for _, device := range mdb.deleted {
+		if match(device) {
+			devices = append(devices, device)
+		}
+	}
+
+	return devices
+}
+
+// snapshot returns, by id, the devices that were there at 'at' and that 'match', as they
+// were then. The history of the devices tells what they were.
+func (mdb *MemoryDatabase) snapshot(at time.Time, match func(api_model.Device) bool) (devices api_model.Devices) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	// The last change of each device by then, nil if it deleted the device
+	latest := map[int64]*api_model.Device{}
+	for _, event := range mdb.events {
+		if event.OccurredOn.After(at) {
+			break
+		}
+
+		latest[event.DeviceID] = event.After
+	}
+
+	devices = api_model.Devices{}
+	for _, device := range latest {
+		if device != nil && match(*device) {
+			devices = append(devices, *device)
+		}
+	}
+
+	slices.SortFunc(devices, func(a, b api_model.Device) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return devices
+}
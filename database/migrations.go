@@ -0,0 +1,219 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are plain SQL files named '<version>_<name>.up.sql' and
+// '<version>_<name>.down.sql', embedded in the binary so that a fresh
+// database file is always brought up to the current schema.
+//
+// Each backend has its own directory, since their SQL dialects differ.
+//
+//go:embed migrations/duckdb/*.sql
+var duckMigrationFiles embed.FS
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFiles embed.FS
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrationFiles embed.FS
+
+const (
+	duckMigrationsDir     string = "migrations/duckdb"
+	sqliteMigrationsDir   string = "migrations/sqlite"
+	postgresMigrationsDir string = "migrations/postgres"
+)
+
+// schema_migrations keeps one row per applied migration
+const schemaMigrationsTable string = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       VARCHAR NOT NULL,
+	applied_on TIMESTAMP NOT NULL
+)`
+
+// dataMigrations fill in, right after a schema migration and in its
+// transaction, the data SQL alone cannot compute. They are keyed by version.
+var dataMigrations = map[int]func(tx *sql.Tx) error{
+	5: indexAllDevices,
+}
+
+// migration holds both directions of a single schema version
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads every migration in 'dir' and returns them sorted by version
+func loadMigrations(fsys fs.FS, dir string) (migrations []migration, err error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+
+	for _, entry := range entries {
+		var direction string
+		fileName := entry.Name()
+
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		// '0001_create_devices.up.sql' -> version 1, name 'create_devices'
+		base := strings.TrimSuffix(fileName, fmt.Sprintf(".%s.sql", direction))
+		prefix, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: missing version prefix", fileName)
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version '%s'", fileName, prefix)
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d: conflicting names '%s' and '%s'", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	for _, m := range byVersion {
+		if len(m.Up) == 0 {
+			return nil, fmt.Errorf("migration %d (%s): missing up script", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// schemaVersion returns the highest applied migration version (0 for none)
+func schemaVersion(db *sql.DB) (version int, err error) {
+	if _, err = db.Exec(schemaMigrationsTable); err != nil {
+		return 0, err
+	}
+
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+
+	return version, err
+}
+
+// migrateUp applies, in order, every migration newer than the current schema version.
+// Each migration runs in its own transaction along with its schema_migrations row.
+func migrateUp(db *sql.DB, migrations []migration) (err error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(m.Up); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		if fill, found := dataMigrations[m.Version]; found {
+			if err = fill(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied_on) VALUES ($1, $2, CURRENT_TIMESTAMP)",
+			m.Version, m.Name)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateDown reverts, newest first, every applied migration above 'target'
+func migrateDown(db *sql.DB, migrations []migration, target int) (err error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version > current || m.Version <= target {
+			continue
+		}
+
+		if len(m.Down) == 0 {
+			return fmt.Errorf("migration %d (%s): no down script", m.Version, m.Name)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(m.Down); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("revert migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		if _, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.Version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("revert migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS devices;
+DROP SEQUENCE IF EXISTS devices_id_seq;
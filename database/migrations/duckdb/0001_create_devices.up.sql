@@ -0,0 +1,11 @@
+-- The initial schema, equivalent to what used to ship in dvapi.db.dist.
+-- 'IF NOT EXISTS' lets databases created from that file adopt migrations.
+CREATE SEQUENCE IF NOT EXISTS devices_id_seq START 1;
+
+CREATE TABLE IF NOT EXISTS devices (
+	id         INTEGER DEFAULT(nextval('devices_id_seq')) PRIMARY KEY,
+	name       VARCHAR,
+	brand      VARCHAR,
+	state      VARCHAR,
+	created_on TIMESTAMP
+);
@@ -0,0 +1,2 @@
+ALTER TABLE devices DROP COLUMN lease_renewals;
+ALTER TABLE devices DROP COLUMN lease_expires_on;
@@ -0,0 +1,11 @@
+-- The search index: the trigrams of the name and brand of every device.
+-- There is no primary key, DuckDB cannot delete and insert the same key
+-- in one transaction, which reindexing a device does.
+CREATE TABLE IF NOT EXISTS device_trigrams (
+	device_id BIGINT NOT NULL,
+	field     VARCHAR NOT NULL,
+	trigram   VARCHAR NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS device_trigrams_trigram ON device_trigrams (trigram);
+CREATE INDEX IF NOT EXISTS device_trigrams_device ON device_trigrams (device_id);
@@ -0,0 +1,4 @@
+-- DuckDB cannot drop a column in the transaction that drops its index,
+-- so the column stays, unused, and the up migration adopts it again.
+DROP INDEX IF EXISTS devices_unique_key;
+UPDATE devices SET unique_key = NULL;
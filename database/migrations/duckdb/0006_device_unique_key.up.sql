@@ -0,0 +1,5 @@
+-- Devices with the same key are duplicates, see dvapi_db.UniquePolicy.
+-- The key is NULL when devices may be duplicated.
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS unique_key VARCHAR;
+
+CREATE UNIQUE INDEX IF NOT EXISTS devices_unique_key ON devices (unique_key);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS device_events;
+DROP SEQUENCE IF EXISTS device_events_id_seq;
@@ -0,0 +1,4 @@
+-- Devices were deleted for good before, so are the deleted ones. DuckDB cannot
+-- drop a column of a table with indexes: the column stays, unused, and the up
+-- migration adopts it again.
+DELETE FROM devices WHERE deleted_on IS NOT NULL;
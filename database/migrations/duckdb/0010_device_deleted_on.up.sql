@@ -0,0 +1,3 @@
+-- When the device was deleted, NULL unless it was. Deleted devices are kept until
+-- purged, without their unique key, so that others can take their name.
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS deleted_on TIMESTAMP;
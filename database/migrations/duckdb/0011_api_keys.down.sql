@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS api_keys;
+DROP SEQUENCE IF EXISTS api_keys_id_seq;
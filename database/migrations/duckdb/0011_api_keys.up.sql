@@ -0,0 +1,17 @@
+-- The API keys the HTTP server accepts. Only the SHA-256 hash of a key is kept,
+-- the key itself is shown once when created. "prefix" is its first characters,
+-- enough to tell keys apart, and "scopes" a comma delimited list of scopes.
+-- Revoked keys are kept, with the time they were revoked, for the record.
+CREATE SEQUENCE IF NOT EXISTS api_keys_id_seq START 1;
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id          BIGINT DEFAULT(nextval('api_keys_id_seq')) PRIMARY KEY,
+	name        VARCHAR NOT NULL,
+	prefix      VARCHAR NOT NULL,
+	key_hash    VARCHAR NOT NULL,
+	scopes      VARCHAR NOT NULL,
+	created_on  TIMESTAMP NOT NULL,
+	revoked_on  TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS api_keys_hash ON api_keys (key_hash);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS devices (
+	id         BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	name       VARCHAR,
+	brand      VARCHAR,
+	state      VARCHAR,
+	created_on TIMESTAMP
+);
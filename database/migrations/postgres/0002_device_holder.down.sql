@@ -0,0 +1,2 @@
+ALTER TABLE devices DROP COLUMN held_since;
+ALTER TABLE devices DROP COLUMN holder;
@@ -0,0 +1,3 @@
+-- When the lease of an in-use device ends, and how many times it was renewed
+ALTER TABLE devices ADD COLUMN lease_expires_on TIMESTAMP;
+ALTER TABLE devices ADD COLUMN lease_renewals INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Increased on every change of the device, it is the device ETag in the API
+ALTER TABLE devices ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
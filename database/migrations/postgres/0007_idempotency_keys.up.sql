@@ -0,0 +1,13 @@
+-- The responses to the requests made with an 'Idempotency-Key' header, replayed
+-- when the request is retried. 'status' is 0 while the request is in progress.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	idempotency_key VARCHAR PRIMARY KEY,
+	fingerprint     VARCHAR NOT NULL,
+	status          INTEGER NOT NULL DEFAULT 0,
+	headers         VARCHAR,
+	body            VARCHAR,
+	created_on      TIMESTAMP NOT NULL,
+	expires_on      TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_on ON idempotency_keys (expires_on);
@@ -0,0 +1,14 @@
+-- The audit log: one row per change of a device, written in the transaction
+-- making it. Rows are only ever inserted. The device is saved as JSON before
+-- and after the change, NULL before a creation and after a deletion.
+CREATE TABLE IF NOT EXISTS device_events (
+	id          BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+	device_id   BIGINT NOT NULL,
+	operation   VARCHAR NOT NULL,
+	actor       VARCHAR,
+	occurred_on TIMESTAMP NOT NULL,
+	before_json VARCHAR,
+	after_json  VARCHAR
+);
+
+CREATE INDEX IF NOT EXISTS device_events_device ON device_events (device_id, id);
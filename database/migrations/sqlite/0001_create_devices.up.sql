@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS devices (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	name       VARCHAR,
+	brand      VARCHAR,
+	state      VARCHAR,
+	created_on TIMESTAMP
+);
@@ -0,0 +1,3 @@
+-- Who checked the device out, and since when. Both are NULL unless it is checked out
+ALTER TABLE devices ADD COLUMN holder VARCHAR;
+ALTER TABLE devices ADD COLUMN held_since TIMESTAMP;
@@ -0,0 +1,9 @@
+-- The search index: the trigrams of the name and brand of every device
+CREATE TABLE IF NOT EXISTS device_trigrams (
+	device_id BIGINT NOT NULL,
+	field     VARCHAR NOT NULL,
+	trigram   VARCHAR NOT NULL,
+	PRIMARY KEY (device_id, field, trigram)
+);
+
+CREATE INDEX IF NOT EXISTS device_trigrams_trigram ON device_trigrams (trigram);
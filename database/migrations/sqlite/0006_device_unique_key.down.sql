@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS devices_unique_key;
+ALTER TABLE devices DROP COLUMN unique_key;
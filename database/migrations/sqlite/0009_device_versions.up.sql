@@ -0,0 +1,24 @@
+-- Every version of every device, valid from 'valid_from' until 'valid_to', NULL for the
+-- current one. A deleted device has no current version. The devices already there
+-- start with a version valid since their creation.
+CREATE TABLE IF NOT EXISTS device_versions (
+	device_id        BIGINT NOT NULL,
+	name             VARCHAR,
+	brand            VARCHAR,
+	state            VARCHAR,
+	created_on       TIMESTAMP,
+	holder           VARCHAR,
+	held_since       TIMESTAMP,
+	lease_expires_on TIMESTAMP,
+	lease_renewals   INTEGER DEFAULT 0,
+	version          INTEGER DEFAULT 1,
+	valid_from       TIMESTAMP NOT NULL,
+	valid_to         TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS device_versions_device ON device_versions (device_id);
+
+INSERT INTO device_versions (device_id, name, brand, state, created_on, holder, held_since, lease_expires_on,
+	lease_renewals, version, valid_from)
+SELECT id, name, brand, state, created_on, holder, held_since, lease_expires_on, lease_renewals, version, created_on
+FROM devices;
@@ -0,0 +1,3 @@
+-- Devices were deleted for good before, so are the deleted ones
+DELETE FROM devices WHERE deleted_on IS NOT NULL;
+ALTER TABLE devices DROP COLUMN deleted_on;
@@ -0,0 +1,77 @@
+package dvapi_db
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+)
+
+// migratedStore is implemented by the stores backed by embedded migrations
+type migratedStore interface {
+	DeviceStore
+	Setup(dbfile string) error
+	Migrate() error
+	MigrateDown(target int) error
+	SchemaVersion() (int, error)
+}
+
+func TestMigrationsUpAndDown(t *testing.T) {
+	t.Run("duckdb", func(t *testing.T) {
+		testMigrationsUpAndDown(t, NewDatabase(), filepath.Join(t.TempDir(), "migrations.db"),
+			duckMigrationFiles, duckMigrationsDir)
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		testMigrationsUpAndDown(t, NewSqliteDatabase(), filepath.Join(t.TempDir(), "migrations.db"),
+			sqliteMigrationFiles, sqliteMigrationsDir)
+	})
+}
+
+// testMigrationsUpAndDown sets up 'ddb' with 'dsn' then walks its migrations down and up again
+func testMigrationsUpAndDown(t *testing.T, ddb migratedStore, dsn string, fsys fs.FS, dir string) {
+	if err := ddb.Setup(dsn); err != nil {
+		t.Fatal(err)
+	}
+	defer ddb.Release()
+
+	migrations, err := loadMigrations(fsys, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest := migrations[len(migrations)-1].Version
+
+	version, err := ddb.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != latest {
+		t.Fatalf("unexpected schema version after setup: got %d want %d", version, latest)
+	}
+
+	// Running it again must be a no-op
+	if err = ddb.Migrate(); err != nil {
+		t.Fatalf("second migrate failed: %s", err)
+	}
+
+	if err = ddb.MigrateDown(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if version, _ = ddb.SchemaVersion(); version != 0 {
+		t.Fatalf("unexpected schema version after migrating down: got %d want 0", version)
+	}
+
+	if _, err = ddb.FetchAll(); err == nil {
+		t.Fatal("devices table still exists after migrating down")
+	}
+
+	if err = ddb.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ddb.FetchAll(); err != nil {
+		t.Fatalf("devices table missing after migrating up again: %s", err)
+	}
+}
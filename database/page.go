@@ -0,0 +1,185 @@
+package dvapi_db
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"time"
+)
+
+// The device fields a listing can be sorted by
+const (
+	SortByName      string = "name"
+	SortByBrand     string = "brand"
+	SortByState     string = "state"
+	SortByCreatedOn string = "created_on"
+)
+
+// Page sizes of the device listings
+const (
+	DefaultPageLimit int = 100
+	MaxPageLimit     int = 1000
+)
+
+// PageQuery selects one page of a device listing.
+// Devices are ordered by 'Sort', then by id, so the order is always the same.
+type PageQuery struct {
+	Filter DeviceFilter // The devices to list, all of them by default
+	Sort   string       // One of the SortBy* constants, SortByCreatedOn if empty
+	Desc   bool         // Sort in descending order
+	Limit  int          // How many devices at most, DefaultPageLimit if 0
+	After  string       // The 'Next' cursor of the previous page, empty for the first page
+
+	// The devices as they were at that time, deleted ones included, rather than now
+	AsOf time.Time
+
+	// List the deleted devices that were not purged yet as well
+	IncludeDeleted bool
+}
+
+// DevicePage is a page of devices, with the cursor of the next page if there is one
+type DevicePage struct {
+	Devices api_model.Devices
+	Next    string
+}
+
+// pageCursor is the position of the last device of a page, carried in the
+// 'After' and 'Next' fields as opaque base64 JSON. It remembers the order
+// it was made for, it makes no sense in another.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// validate checks the query and fills in its defaults.
+// The position to start after is returned, if any.
+func (q *PageQuery) validate() (after *pageCursor, err error) {
+	if after, err = q.validateOrder(); err != nil {
+		return nil, err
+	}
+
+	if q.Limit == 0 {
+		q.Limit = DefaultPageLimit
+	}
+
+	if q.Limit < 0 || q.Limit > MaxPageLimit {
+		return nil, invalidInputError(ErrCodeInvalidPageLimit, "the page limit must be between 1 and %d", MaxPageLimit)
+	}
+
+	return after, nil
+}
+
+// validateOrder checks the filter, sort and cursor of the query, whatever its limit.
+// The position to start after is returned, if any.
+func (q *PageQuery) validateOrder() (after *pageCursor, err error) {
+	if err = q.Filter.validate(); err != nil {
+		return nil, err
+	}
+
+	if len(q.Sort) == 0 {
+		q.Sort = SortByCreatedOn
+	}
+
+	switch q.Sort {
+	case SortByName, SortByBrand, SortByState, SortByCreatedOn:
+	default:
+		return nil, invalidInputError(ErrCodeInvalidSort, "cannot sort devices by '%s'", q.Sort)
+	}
+
+	if len(q.After) == 0 {
+		return nil, nil
+	}
+
+	after = &pageCursor{}
+
+	jsonBytes, err := base64.RawURLEncoding.DecodeString(q.After)
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, after)
+	}
+
+	if err != nil || after.Sort != q.Sort || after.Desc != q.Desc {
+		return nil, invalidInputError(ErrCodeInvalidCursor, "invalid cursor '%s' for this sort order", q.After)
+	}
+
+	if q.Sort == SortByCreatedOn {
+		if _, err = time.Parse(time.RFC3339Nano, after.Value); err != nil {
+			return nil, invalidInputError(ErrCodeInvalidCursor, "invalid cursor '%s' for this sort order", q.After)
+		}
+	}
+
+	return after, nil
+}
+
+// cursorAfter returns the cursor of the page following 'last'
+func (q *PageQuery) cursorAfter(last api_model.Device) string {
+	cursor := pageCursor{Sort: q.Sort, Desc: q.Desc, Value: sortValue(last, q.Sort), ID: last.ID}
+
+	jsonBytes, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(jsonBytes)
+}
+
+// paginate makes a page out of the devices following the query position,
+// of which there may be one more than the limit
+func (q *PageQuery) paginate(devices api_model.Devices) (page DevicePage) {
+	if len(devices) > q.Limit {
+		devices = devices[:q.Limit]
+		page.Next = q.cursorAfter(devices[len(devices)-1])
+	}
+
+	page.Devices = devices
+
+	return page
+}
+
+// sortValue returns the 'sort' field of 'device' as kept in cursors
+func sortValue(device api_model.Device, sort string) string {
+	switch sort {
+	case SortByName:
+		return device.Name
+	case SortByBrand:
+		return device.Brand
+	case SortByState:
+		return device.State.ToString()
+	default:
+		return device.CreatedOn.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// compareDevices orders 'a' and 'b' by the 'sort' field, then by id
+func compareDevices(a api_model.Device, b api_model.Device, sort string) int {
+	var order int
+
+	if sort == SortByCreatedOn {
+		order = a.CreatedOn.Compare(b.CreatedOn)
+	} else {
+		order = cmp.Compare(sortValue(a, sort), sortValue(b, sort))
+	}
+
+	if order == 0 {
+		order = cmp.Compare(a.ID, b.ID)
+	}
+
+	return order
+}
+
+// compare orders 'device' against the cursor position, in ascending order
+func (c *pageCursor) compare(device api_model.Device) int {
+	var order int
+
+	if c.Sort == SortByCreatedOn {
+		at, _ := time.Parse(time.RFC3339Nano, c.Value)
+		order = device.CreatedOn.Compare(at)
+	} else {
+		order = cmp.Compare(sortValue(device, c.Sort), c.Value)
+	}
+
+	if order == 0 {
+		order = cmp.Compare(device.ID, c.ID)
+	}
+
+	return order
+}
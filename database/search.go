@@ -0,0 +1,104 @@
+package dvapi_db
+
+import (
+	"cmp"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Search limits
+const (
+	DefaultSearchLimit int = 20
+	MaxSearchLimit     int = 100
+
+	// SearchMinScore is the lowest score of the devices a search returns
+	SearchMinScore float64 = 0.2
+)
+
+// The device fields searched, as kept in the 'device_trigrams' table
+const (
+	searchFieldName  string = "name"
+	searchFieldBrand string = "brand"
+)
+
+// SearchResult is a device found by a search. 'Score' tells how well it matches,
+// from SearchMinScore to 1 for an exact match.
+type SearchResult struct {
+	Device api_model.Device
+	Score  float64
+}
+
+// validateSearch checks the search 'text' and 'limit', defaulting the latter.
+// The trigrams of 'text' are returned.
+func validateSearch(text string, limit int) (searched []string, validLimit int, err error) {
+	if searched = trigrams(text); len(searched) == 0 {
+		return nil, 0, invalidInputError(ErrCodeInvalidSearch, "nothing to search for in '%s'", text)
+	}
+
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+
+	if limit < 0 || limit > MaxSearchLimit {
+		return nil, 0, invalidInputError(ErrCodeInvalidPageLimit, "the search limit must be between 1 and %d", MaxSearchLimit)
+	}
+
+	return searched, limit, nil
+}
+
+// trigrams returns the distinct trigrams of the words in 'text', sorted.
+// As in PostgreSQL's pg_trgm, words are lower cased and padded with two
+// spaces in front and one at the end, so short words still have trigrams
+// and the beginning of words weighs more.
+func trigrams(text string) []string {
+	set := map[string]bool{}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for _, word := range words {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return slices.Sorted(maps.Keys(set))
+}
+
+// similarity is the share of trigrams two texts have in common: 'shared' out
+// of the 'searched' and 'indexed' ones, 1 if they have the same trigrams.
+func similarity(shared int, searched int, indexed int) float64 {
+	return float64(shared) / float64(searched+indexed-shared)
+}
+
+// fieldSimilarity returns the similarity of the 'searched' trigrams to 'text'
+func fieldSimilarity(searched []string, text string) float64 {
+	indexed := trigrams(text)
+
+	shared := 0
+	for _, trigram := range searched {
+		if _, found := slices.BinarySearch(indexed, trigram); found {
+			shared++
+		}
+	}
+
+	return similarity(shared, len(searched), len(indexed))
+}
+
+// rankResults orders 'results' by score, best first, then by id
+func rankResults(results []SearchResult, limit int) []SearchResult {
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		if order := cmp.Compare(b.Score, a.Score); order != 0 {
+			return order
+		}
+
+		return cmp.Compare(a.Device.ID, b.Device.ID)
+	})
+
+	return results[:min(len(results), limit)]
+}
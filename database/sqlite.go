@@ -0,0 +1,61 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"fmt"
+	_ "modernc.org/sqlite"
+)
+
+// SqliteDatabase is the SQLite implementation of DeviceStore.
+// It uses a pure Go driver, so no cgo is involved.
+type SqliteDatabase struct {
+	sqlDatabase
+}
+
+// NewSqliteDatabase returns a new pointer handle to a SqliteDatabase instance
+func NewSqliteDatabase() *SqliteDatabase {
+	return &SqliteDatabase{}
+}
+
+// Setup opens (creating it if needed) the SQLite database in 'dbfile'.
+// WAL mode lets readers run alongside the single writer, and the busy
+// timeout makes concurrent writers wait for the lock instead of failing.
+func (sdb *SqliteDatabase) Setup(dbfile string) (err error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate", dbfile)
+
+	if sdb.db, err = sql.Open("sqlite", dsn); err != nil {
+		return err
+	}
+
+	if err = sdb.Migrate(); err != nil {
+		sdb.db.Close()
+		return err
+	}
+
+	return nil
+}
+
+// Migrate applies every pending embedded migration to the database
+func (sdb *SqliteDatabase) Migrate() (err error) {
+	migrations, err := loadMigrations(sqliteMigrationFiles, sqliteMigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	return migrateUp(sdb.db, migrations)
+}
+
+// MigrateDown reverts applied migrations until the schema is at version 'target'
+func (sdb *SqliteDatabase) MigrateDown(target int) (err error) {
+	migrations, err := loadMigrations(sqliteMigrationFiles, sqliteMigrationsDir)
+	if err != nil {
+		return err
+	}
+
+	return migrateDown(sdb.db, migrations, target)
+}
+
+// SchemaVersion returns the version of the latest migration applied
+func (sdb *SqliteDatabase) SchemaVersion() (version int, err error) {
+	return schemaVersion(sdb.db)
+}
@@ -0,0 +1,175 @@
+package dvapi_db
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// StatsCount is how many devices share a brand or a state
+type StatsCount struct {
+	Key   string
+	Count int64
+}
+
+// MonthStats is how the inventory changed over a month, 'YYYY-mm' in UTC
+type MonthStats struct {
+	Month   string
+	Created int64 // Devices created that month, deleted since or not
+	Deleted int64 // Devices deleted that month
+	Total   int64 // Devices there were at the end of the month
+}
+
+// DeviceStats sums the devices up. Deleted devices only count in the months
+// they were created and deleted, and not at all once purged.
+type DeviceStats struct {
+	Total   int64
+	ByBrand []StatsCount // The most common brand first
+	ByState []StatsCount // The most common state first
+	ByMonth []MonthStats // The oldest month first, only those with a change
+}
+
+// statsMonth is the month, 'YYYY-mm', of the timestamp 'column' in every backend
+const statsMonth string = "SUBSTR(CAST(%s AS VARCHAR), 1, 7)"
+
+// FetchStats computes the stats of the devices with two aggregate queries: one
+// counting them by brand and by state, the other counting their creations and
+// deletions by month, the running total giving the growth of the inventory
+func (sdb *sqlDatabase) FetchStats() (stats DeviceStats, err error) {
+	stats = DeviceStats{ByBrand: []StatsCount{}, ByState: []StatsCount{}, ByMonth: []MonthStats{}}
+
+	rows, err := sdb.db.Query(`SELECT 'brand', brand, COUNT(*) FROM devices WHERE deleted_on IS NULL GROUP BY brand
+		UNION ALL
+		SELECT 'state', state, COUNT(*) FROM devices WHERE deleted_on IS NULL GROUP BY state`)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var group string
+		var key sql.NullString
+		var count StatsCount
+
+		if err = rows.Scan(&group, &key, &count.Count); err != nil {
+			return stats, err
+		}
+
+		count.Key = key.String
+		if group == "brand" {
+			stats.ByBrand = append(stats.ByBrand, count)
+			stats.Total += count.Count
+		} else {
+			stats.ByState = append(stats.ByState, count)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	// SUM is cast as DuckDB sums integers into a HUGEINT
+	rows, err = sdb.db.Query(fmt.Sprintf(`WITH changes AS (
+			SELECT %s AS month, 1 AS created, 0 AS deleted FROM devices
+			UNION ALL
+			SELECT %s AS month, 0 AS created, 1 AS deleted FROM devices WHERE deleted_on IS NOT NULL
+		)
+		SELECT month, CAST(SUM(created) AS BIGINT), CAST(SUM(deleted) AS BIGINT),
+			CAST(SUM(SUM(created) - SUM(deleted)) OVER (ORDER BY month) AS BIGINT)
+		FROM changes GROUP BY month ORDER BY month`,
+		fmt.Sprintf(statsMonth, "created_on"), fmt.Sprintf(statsMonth, "deleted_on")))
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var month MonthStats
+
+		if err = rows.Scan(&month.Month, &month.Created, &month.Deleted, &month.Total); err != nil {
+			return stats, err
+		}
+
+		stats.ByMonth = append(stats.ByMonth, month)
+	}
+
+	if err = rows.Err(); err != nil {
+		return stats, err
+	}
+
+	sortCounts(stats.ByBrand)
+	sortCounts(stats.ByState)
+
+	return stats, nil
+}
+
+// FetchStats follows the same rules as DuckDatabase.FetchStats
+func (mdb *MemoryDatabase) FetchStats() (stats DeviceStats, err error) {
+	mdb.mutex.RLock()
+	defer mdb.mutex.RUnlock()
+
+	brands, states := map[string]int64{}, map[string]int64{}
+	months := map[string]*MonthStats{}
+
+	month := func(at time.Time) *MonthStats {
+		key := at.UTC().Format("2006-01")
+		if months[key] == nil {
+			months[key] = &MonthStats{Month: key}
+		}
+
+		return months[key]
+	}
+
+	for _, device := range mdb.devices {
+		brands[device.Brand]++
+		states[device.State.ToString()]++
+		month(device.CreatedOn).Created++
+	}
+
+	for _, device := range mdb.deleted {
+		month(device.CreatedOn).Created++
+		month(*device.DeletedOn).Deleted++
+	}
+
+	stats = DeviceStats{Total: int64(len(mdb.devices)), ByMonth: []MonthStats{}}
+	stats.ByBrand, stats.ByState = toCounts(brands), toCounts(states)
+
+	for _, at := range slices.Sorted(maps.Keys(months)) {
+		month := *months[at]
+		month.Total = month.Created - month.Deleted
+
+		if len(stats.ByMonth) > 0 {
+			month.Total += stats.ByMonth[len(stats.ByMonth)-1].Total
+		}
+
+		stats.ByMonth = append(stats.ByMonth, month)
+	}
+
+	return stats, nil
+}
+
+// toCounts returns 'counts' as sorted StatsCount
+func toCounts(counts map[string]int64) (list []StatsCount) {
+	list = []StatsCount{}
+	for key, count := range counts {
+		list = append(list, StatsCount{Key: key, Count: count})
+	}
+
+	sortCounts(list)
+
+	return list
+}
+
+// sortCounts puts the highest count first, then orders by key
+func sortCounts(counts []StatsCount) {
+	slices.SortFunc(counts, func(a, b StatsCount) int {
+		if order := cmp.Compare(b.Count, a.Count); order != 0 {
+			return order
+		}
+
+		return cmp.Compare(a.Key, b.Key)
+	})
+}
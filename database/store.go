@@ -0,0 +1,278 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"iter"
+	"strings"
+	"time"
+)
+
+// DefaultLeaseTTL is the lease given to devices that become in-use without
+// a check-out (e.g. by an update), so they are released eventually as well
+const DefaultLeaseTTL time.Duration = time.Hour
+
+// DeviceStore is the set of operations the API needs from a storage backend.
+// DuckDatabase, SqliteDatabase, PostgresDatabase and MemoryDatabase are the
+// current implementations.
+type DeviceStore interface {
+	// CreateDevice inserts 'device', filling in its ID and CreatedOn
+	CreateDevice(device *api_model.Device) error
+
+	// UpdateDevice changes the non-empty fields of the device with 'device.ID'.
+	// A non-zero 'device.Version' must match the current version of the device.
+	UpdateDevice(device api_model.Device) error
+
+	// DeleteDevice marks the device with 'device.ID' deleted: it is left out of every
+	// listing, unless asked for, until restored or purged.
+	// A non-zero 'device.Version' must match the current version of the device.
+	DeleteDevice(device api_model.Device) error
+
+	// RestoreDevice brings back the deleted device 'id', as it was when deleted
+	RestoreDevice(id int64) (api_model.Device, error)
+
+	// PurgeDevices removes for good the devices deleted by 'before', and returns how many there were
+	PurgeDevices(before time.Time) (int64, error)
+
+	// ApplyBulk runs 'operations' in order, in a single transaction. With 'options.Atomic'
+	// the first that fails is returned as the error and none is applied. Otherwise
+	// the failed ones are skipped, reported in their BulkResult, and the others applied.
+	ApplyBulk(operations []BulkOperation, options BulkOptions) ([]BulkResult, error)
+
+	// Fetch returns the device with the given id
+	Fetch(id int) (api_model.Devices, error)
+
+	// CheckoutDevice moves the available device 'id' to in-use, leased to 'holder' for 'ttl'
+	CheckoutDevice(id int64, holder string, ttl time.Duration) (api_model.Device, error)
+
+	// CheckinDevice moves the device 'id', held by 'holder', back to available
+	CheckinDevice(id int64, holder string) (api_model.Device, error)
+
+	// RenewLease extends the lease 'holder' has on device 'id' to 'ttl' from now
+	RenewLease(id int64, holder string, ttl time.Duration) (api_model.Device, error)
+
+	// ExpireLeases moves the devices whose lease ended by 'now' back to available
+	// and returns how many there were
+	ExpireLeases(now time.Time) (int64, error)
+
+	// FetchLeasesExpiringBefore returns the in-use devices whose lease ends by 'before',
+	// the soonest first
+	FetchLeasesExpiringBefore(before time.Time) (api_model.Devices, error)
+
+	// FetchAll returns every device, ordered by creation time
+	FetchAll() (api_model.Devices, error)
+
+	// FetchPage returns the page of devices selected by 'query'
+	FetchPage(query PageQuery) (DevicePage, error)
+
+	// IterateDevices yields every device selected by 'query', from 'query.After' on
+	// and whatever 'query.Limit', without holding them all at once. An invalid query
+	// is yielded as the error of the first and only iteration.
+	IterateDevices(query PageQuery) iter.Seq2[api_model.Device, error]
+
+	// SearchDevices returns at most 'limit' devices whose name or brand resemble 'text',
+	// the best match first
+	SearchDevices(text string, limit int) ([]SearchResult, error)
+
+	// FetchByBrand returns the devices matching any of 'brands'
+	FetchByBrand(brands []string) (api_model.Devices, error)
+
+	// FetchByState returns the devices matching any of 'states'
+	FetchByState(states []string) (api_model.Devices, error)
+
+	// SetUniquePolicy makes the devices unique according to 'policy', UniqueNone by default.
+	// It fails if some devices already are duplicates under the new policy.
+	SetUniquePolicy(policy UniquePolicy) error
+
+	// ReserveIdempotencyKey saves 'key' as used by the request 'fingerprint', in progress
+	// for IdempotencyPendingTTL. If the key is already in use, the response saved with it
+	// is returned instead and nothing is reserved.
+	ReserveIdempotencyKey(key string, fingerprint string) (*IdempotentResponse, error)
+
+	// CompleteIdempotencyKey saves 'response' with the reserved 'key', kept until 'expiresOn'
+	CompleteIdempotencyKey(key string, response IdempotentResponse, expiresOn time.Time) error
+
+	// ReleaseIdempotencyKey forgets the reserved 'key', so the request can be retried
+	ReleaseIdempotencyKey(key string) error
+
+	// PurgeIdempotencyKeys forgets the keys that expired by 'now' and returns how many there were
+	PurgeIdempotencyKeys(now time.Time) (int64, error)
+
+	// FetchHistory returns the page of the changes made to the device 'id' selected by
+	// 'query', newest first. Every change is recorded along with the change itself.
+	FetchHistory(id int64, query HistoryQuery) (EventPage, error)
+
+	// FetchStats counts the devices by brand, by state, and by the month they were
+	// created or deleted in, with the total at the end of each month
+	FetchStats() (DeviceStats, error)
+
+	// CreateApiKey creates a key named 'name' granting 'scopes', and returns it along with
+	// its secret. Only a hash of the secret is kept, it cannot be shown again.
+	CreateApiKey(name string, scopes []string) (ApiKey, string, error)
+
+	// BootstrapApiKey creates the API key 'secret', named 'name' and granting 'scopes', if
+	// there are no API keys at all yet. It returns nil, and creates nothing, otherwise.
+	BootstrapApiKey(name string, scopes []string, secret string) (*ApiKey, error)
+
+	// ListApiKeys returns every API key, revoked ones included, oldest first
+	ListApiKeys() ([]ApiKey, error)
+
+	// RevokeApiKey makes the API key 'id' unusable from now on, and returns it
+	RevokeApiKey(id int64) (ApiKey, error)
+
+	// FindApiKey returns the API key whose secret is 'secret', nil if there is none or it was revoked
+	FindApiKey(secret string) (*ApiKey, error)
+
+	// WithActor returns the store recording 'actor' as the author of the changes it makes
+	WithActor(actor string) DeviceStore
+
+	// Release frees any resource held by the store
+	Release() error
+}
+
+// Make sure our implementations stay in sync with DeviceStore
+var (
+	_ DeviceStore = (*DuckDatabase)(nil)
+	_ DeviceStore = (*SqliteDatabase)(nil)
+	_ DeviceStore = (*PostgresDatabase)(nil)
+	_ DeviceStore = (*MemoryDatabase)(nil)
+)
+
+// Iterate yields 'devices' one by one, the way DeviceStore.IterateDevices does
+func Iterate(devices api_model.Devices) iter.Seq2[api_model.Device, error] {
+	return func(yield func(api_model.Device, error) bool) {
+		for _, device := range devices {
+			if !yield(device, nil) {
+				return
+			}
+		}
+	}
+}
+
+// The helpers below hold the device rules shared by every store
+
+// validateState makes sure 'state' is a known DeviceState
+func validateState(state api_model.DeviceState) error {
+	if _, err := api_model.ParseDeviceState(state.ToString()); err != nil {
+		return invalidInputError(ErrCodeInvalidState, "%s", err.Error())
+	}
+
+	return nil
+}
+
+// validateTransition makes sure a device may move from state 'from' to state 'to'
+func validateTransition(from api_model.DeviceState, to api_model.DeviceState) error {
+	if !from.CanTransitionTo(to) {
+		return conflictError(ErrCodeInvalidTransition, "cannot change device state from '%s' to '%s'", from, to)
+	}
+
+	return nil
+}
+
+// parseStates converts the states of a filter into DeviceStates
+func parseStates(states []string) (parsed []api_model.DeviceState, err error) {
+	for _, state := range states {
+		s, err := api_model.ParseDeviceState(state)
+		if err != nil {
+			return nil, invalidInputError(ErrCodeInvalidState, "%s", err.Error())
+		}
+
+		parsed = append(parsed, s)
+	}
+
+	return parsed, nil
+}
+
+// validateCheckout checks the arguments of a check-out or check-in
+func validateCheckout(id int64, holder string) error {
+	if id <= 0 {
+		return invalidInputError(ErrCodeInvalidDeviceID, "invalid device id %d", id)
+	}
+
+	if len(strings.TrimSpace(holder)) == 0 {
+		return invalidInputError(ErrCodeInvalidHolder, "the holder of the device must be given")
+	}
+
+	return nil
+}
+
+// checkVersion makes sure 'current' is at 'version', if one is expected
+func checkVersion(current api_model.Device, version int64) error {
+	if version > 0 && current.Version != version {
+		return preconditionError(ErrCodeVersionMismatch, "device %d is at version %d, not %d",
+			current.ID, current.Version, version)
+	}
+
+	return nil
+}
+
+// validateLease checks the duration of a lease
+func validateLease(ttl time.Duration) error {
+	if ttl <= 0 {
+		return invalidInputError(ErrCodeInvalidLeaseTTL, "invalid lease duration '%s'", ttl)
+	}
+
+	return nil
+}
+
+// leaseExpiry returns when the lease of a device entering 'state' at 'now' ends.
+// Only in-use devices have a lease.
+func leaseExpiry(state api_model.DeviceState, now time.Time) (expiry sql.NullTime) {
+	if state == api_model.DeviceStateInUse {
+		expiry = sql.NullTime{Time: now.Add(DefaultLeaseTTL), Valid: true}
+	}
+
+	return expiry
+}
+
+// leaseExpired tells whether the lease of 'device' ended by 'now'
+func leaseExpired(device api_model.Device, now time.Time) bool {
+	return device.State == api_model.DeviceStateInUse &&
+		device.LeaseExpiresOn != nil && !device.LeaseExpiresOn.After(now)
+}
+
+// checkoutConflict tells why 'holder' could not check out 'current'.
+// There is no conflict if 'holder' already has it.
+func checkoutConflict(current api_model.Device, holder string) error {
+	if current.State != api_model.DeviceStateInUse {
+		return validateTransition(current.State, api_model.DeviceStateInUse)
+	}
+
+	if current.Holder == holder {
+		return nil
+	}
+
+	if len(current.Holder) == 0 {
+		return conflictError(ErrCodeDeviceInUse, "device %d is already in use", current.ID)
+	}
+
+	return conflictError(ErrCodeDeviceHeld, "device %d is checked out by '%s'", current.ID, current.Holder)
+}
+
+// checkinConflict tells why 'holder' could not check in 'current'
+func checkinConflict(current api_model.Device, holder string) error {
+	if current.State != api_model.DeviceStateInUse {
+		return conflictError(ErrCodeDeviceNotHeld, "device %d is not checked out", current.ID)
+	}
+
+	return conflictError(ErrCodeDeviceHeld, "device %d is checked out by '%s', not '%s'",
+		current.ID, current.Holder, holder)
+}
+
+// renewConflict tells why 'holder' could not renew the lease of 'current'
+func renewConflict(current api_model.Device, holder string, now time.Time) error {
+	switch {
+	case current.State != api_model.DeviceStateInUse:
+		return conflictError(ErrCodeDeviceNotHeld, "device %d is not checked out", current.ID)
+	case len(current.Holder) == 0:
+		return conflictError(ErrCodeDeviceInUse, "device %d is in use without a check-out", current.ID)
+	case current.Holder != holder:
+		return conflictError(ErrCodeDeviceHeld, "device %d is checked out by '%s', not '%s'",
+			current.ID, current.Holder, holder)
+	case leaseExpired(current, now):
+		return conflictError(ErrCodeLeaseExpired, "the lease of device %d expired on %s",
+			current.ID, current.LeaseExpiresOn.Format(time.RFC3339))
+	}
+
+	return nil
+}
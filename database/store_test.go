@@ -0,0 +1,1404 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	api_model "github.com/lapuglisi/dvapi/model"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores returns one fresh instance of every DeviceStore implementation
+func testStores(t *testing.T) map[string]DeviceStore {
+	t.Helper()
+
+	duck := NewDatabase()
+	if err := duck.Setup(filepath.Join(t.TempDir(), "store.duckdb")); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlite := NewSqliteDatabase()
+	if err := sqlite.Setup(filepath.Join(t.TempDir(), "store.sqlite")); err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]DeviceStore{
+		"duckdb": duck,
+		"sqlite": sqlite,
+		"memory": NewMemoryDatabase(),
+	}
+
+	// PostgreSQL only joins in when a test server is available
+	if len(os.Getenv(postgresTestDSNEnv)) > 0 {
+		stores["postgres"] = newPostgresTestStore(t)
+	}
+
+	t.Cleanup(func() {
+		for _, store := range stores {
+			store.Release()
+		}
+	})
+
+	return stores
+}
+
+// TestStoreInUseRules makes sure every backend applies the same in-use protection
+func TestStoreInUseRules(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			free := api_model.Device{Name: "free", Brand: "b1", State: api_model.DeviceStateAvailable}
+			busy := api_model.Device{Name: "busy", Brand: "b2", State: api_model.DeviceStateInUse}
+
+			for _, device := range []*api_model.Device{&free, &busy} {
+				if err := store.CreateDevice(device); err != nil {
+					t.Fatal(err)
+				}
+
+				if device.ID <= 0 || device.CreatedOn.IsZero() {
+					t.Fatalf("created device was not filled in: %+v", device)
+				}
+			}
+
+			if err := store.UpdateDevice(api_model.Device{ID: free.ID, Name: "renamed"}); err != nil {
+				t.Errorf("update of available device failed: %s", err)
+			}
+
+			if err := store.UpdateDevice(api_model.Device{ID: busy.ID, Name: "renamed"}); !errors.Is(err, ErrConflict) {
+				t.Errorf("update of in-use device: got %v want a conflict", err)
+			}
+
+			if err := store.DeleteDevice(busy); !errors.Is(err, ErrConflict) {
+				t.Errorf("delete of in-use device: got %v want a conflict", err)
+			}
+
+			if err := store.UpdateDevice(api_model.Device{ID: 999, Name: "x"}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("update of missing device: got %v want not found", err)
+			}
+
+			if err := store.DeleteDevice(api_model.Device{}); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("delete without id: got %v want invalid input", err)
+			}
+
+			devices, err := store.Fetch(int(free.ID))
+			if err != nil || len(devices) != 1 {
+				t.Fatalf("fetch failed: %v %v", devices, err)
+			}
+
+			// Only the name was given, the other fields must be kept
+			if devices[0].Name != "renamed" || devices[0].Brand != "b1" || devices[0].State != api_model.DeviceStateAvailable {
+				t.Errorf("unexpected device after partial update: %+v", devices[0])
+			}
+
+			if devices, _ = store.FetchByBrand([]string{"b2"}); len(devices) != 1 || devices[0].ID != busy.ID {
+				t.Errorf("unexpected fetch by brand result: %+v", devices)
+			}
+
+			if devices, _ = store.FetchByState([]string{api_model.DeviceStateInUse.ToString()}); len(devices) != 1 {
+				t.Errorf("unexpected fetch by state result: %+v", devices)
+			}
+
+			// 'free' is still at the version it was created with
+			if err = store.DeleteDevice(free); !errors.Is(err, ErrPreconditionFailed) {
+				t.Errorf("delete of a stale device: got %v want precondition failed", err)
+			}
+
+			if err = store.DeleteDevice(api_model.Device{ID: free.ID, Version: free.Version + 1}); err != nil {
+				t.Errorf("delete of available device failed: %s", err)
+			}
+
+			if _, err = store.Fetch(int(free.ID)); !errors.Is(err, ErrNotFound) {
+				t.Errorf("fetch of deleted device: got %v want not found", err)
+			}
+
+			if devices, _ = store.FetchAll(); len(devices) != 1 {
+				t.Errorf("unexpected devices left: %+v", devices)
+			}
+		})
+	}
+}
+
+// TestStoreStateRules makes sure every backend validates states and their transitions
+func TestStoreStateRules(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.CreateDevice(&api_model.Device{Name: "broken", State: "broken"}); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("create with unknown state: got %v want invalid input", err)
+			}
+
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			if err := store.CreateDevice(&device); err != nil {
+				t.Fatal(err)
+			}
+
+			if device.State != api_model.DeviceStateAvailable {
+				t.Errorf("unexpected default state: got '%s' want '%s'", device.State, api_model.DeviceStateAvailable)
+			}
+
+			steps := []struct {
+				state api_model.DeviceState
+				kind  error
+			}{
+				{"broken", ErrInvalidInput},
+				{api_model.DeviceStateInactive, nil},
+				{api_model.DeviceStateInUse, ErrConflict},
+				{api_model.DeviceStateAvailable, nil},
+				{api_model.DeviceStateInUse, nil},
+			}
+
+			for _, step := range steps {
+				err := store.UpdateDevice(api_model.Device{ID: device.ID, State: step.state})
+				if (step.kind == nil && err != nil) || (step.kind != nil && !errors.Is(err, step.kind)) {
+					t.Errorf("update to '%s': got %v want %v", step.state, err, step.kind)
+				}
+			}
+
+			if _, err := store.FetchByState([]string{"available", "broken"}); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("fetch by unknown state: got %v want invalid input", err)
+			}
+		})
+	}
+}
+
+// TestStoreCheckout goes through the check-out / check-in rules on every backend
+// TestStoreVersions makes sure every change moves the device to a new version,
+// and that changes expecting another version are refused
+func TestStoreVersions(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			if err := store.CreateDevice(&device); err != nil {
+				t.Fatal(err)
+			}
+
+			if device.Version != 1 {
+				t.Errorf("unexpected version of a new device: got %d want 1", device.Version)
+			}
+
+			if err := store.UpdateDevice(api_model.Device{ID: device.ID, Name: "v2", Version: 1}); err != nil {
+				t.Errorf("update at the current version failed: %s", err)
+			}
+
+			if err := store.UpdateDevice(api_model.Device{ID: device.ID, Name: "v3", Version: 1}); !errors.Is(err, ErrPreconditionFailed) {
+				t.Errorf("update at a stale version: got %v want precondition failed", err)
+			}
+
+			held, err := store.CheckoutDevice(device.ID, "alice", DefaultLeaseTTL)
+			if err != nil || held.Version != 3 {
+				t.Errorf("unexpected version after check-out: got %d, %v want 3", held.Version, err)
+			}
+
+			released, err := store.CheckinDevice(device.ID, "alice")
+			if err != nil || released.Version != 4 {
+				t.Errorf("unexpected version after check-in: got %d, %v want 4", released.Version, err)
+			}
+
+			if err = store.DeleteDevice(api_model.Device{ID: device.ID, Version: 3}); !errors.Is(err, ErrPreconditionFailed) {
+				t.Errorf("delete at a stale version: got %v want precondition failed", err)
+			}
+
+			if err = store.DeleteDevice(api_model.Device{ID: device.ID, Version: 4}); err != nil {
+				t.Errorf("delete at the current version failed: %s", err)
+			}
+		})
+	}
+}
+
+// TestStorePages walks through the pages of every sort order
+func TestStorePages(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, device := range []string{"d", "b", "a", "c", "b"} {
+				store.CreateDevice(&api_model.Device{Name: device, Brand: "b1"})
+			}
+
+			tests := []struct {
+				sort string
+				desc bool
+				ids  []int64
+			}{
+				{"", false, []int64{1, 2, 3, 4, 5}},
+				{SortByCreatedOn, true, []int64{5, 4, 3, 2, 1}},
+				{SortByName, false, []int64{3, 2, 5, 4, 1}},
+				{SortByName, true, []int64{1, 4, 5, 2, 3}},
+				{SortByBrand, false, []int64{1, 2, 3, 4, 5}},
+			}
+
+			for _, tt := range tests {
+				var ids []int64
+				query := PageQuery{Sort: tt.sort, Desc: tt.desc, Limit: 2}
+
+				for pages := 0; pages < 5; pages++ {
+					page, err := store.FetchPage(query)
+					if err != nil {
+						t.Fatalf("sort '%s' desc=%t: %s", tt.sort, tt.desc, err)
+					}
+
+					for _, device := range page.Devices {
+						ids = append(ids, device.ID)
+					}
+
+					if query.After = page.Next; len(page.Next) == 0 {
+						break
+					}
+				}
+
+				if fmt.Sprint(ids) != fmt.Sprint(tt.ids) {
+					t.Errorf("sort '%s' desc=%t: got %v want %v", tt.sort, tt.desc, ids, tt.ids)
+				}
+			}
+
+			first, _ := store.FetchPage(PageQuery{Sort: SortByName, Limit: 2})
+
+			invalid := []struct {
+				query PageQuery
+				code  string
+			}{
+				{PageQuery{Sort: "id"}, ErrCodeInvalidSort},
+				{PageQuery{Limit: MaxPageLimit + 1}, ErrCodeInvalidPageLimit},
+				{PageQuery{After: "not-a-cursor"}, ErrCodeInvalidCursor},
+				{PageQuery{Sort: SortByBrand, After: first.Next}, ErrCodeInvalidCursor},
+				{PageQuery{Sort: SortByName, Desc: true, After: first.Next}, ErrCodeInvalidCursor},
+			}
+
+			for _, tt := range invalid {
+				var storeErr *Error
+				if _, err := store.FetchPage(tt.query); !errors.As(err, &storeErr) || storeErr.Code != tt.code {
+					t.Errorf("%+v: got %v want code %s", tt.query, err, tt.code)
+				}
+			}
+		})
+	}
+}
+
+// TestStoreIterate walks listings one device at a time, beyond the page limits
+func TestStoreIterate(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, device := range []string{"d", "b", "a", "c", "b"} {
+				store.CreateDevice(&api_model.Device{Name: device, Brand: "b1"})
+			}
+
+			ids := func(query PageQuery, max int) (ids []int64, err error) {
+				for device, err := range store.IterateDevices(query) {
+					if err != nil {
+						return ids, err
+					}
+
+					if ids = append(ids, device.ID); len(ids) == max {
+						break
+					}
+				}
+
+				return ids, nil
+			}
+
+			// The limit is ignored, the cursor is not
+			first, _ := store.FetchPage(PageQuery{Sort: SortByName, Limit: 2})
+			got, err := ids(PageQuery{Sort: SortByName, Limit: 2, After: first.Next}, 0)
+			if err != nil || fmt.Sprint(got) != "[5 4 1]" {
+				t.Errorf("got %v, %v want [5 4 1]", got, err)
+			}
+
+			got, err = ids(PageQuery{Filter: DeviceFilter{NamePattern: "b*"}, Desc: true, Limit: MaxPageLimit + 1}, 0)
+			if err != nil || fmt.Sprint(got) != "[5 2]" {
+				t.Errorf("got %v, %v want [5 2]", got, err)
+			}
+
+			// Stopping early leaves the store usable
+			if got, err = ids(PageQuery{}, 2); err != nil || fmt.Sprint(got) != "[1 2]" {
+				t.Errorf("got %v, %v want [1 2]", got, err)
+			}
+
+			if err = store.CreateDevice(&api_model.Device{Name: "e", Brand: "b1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = ids(PageQuery{Sort: "serial"}, 0); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("got %v want invalid input", err)
+			}
+		})
+	}
+}
+
+// TestStoreFilters combines the filters of a listing
+func TestStoreFilters(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			devices := []api_model.Device{
+				{Name: "lab-1", Brand: "apple"},
+				{Name: "lab-2", Brand: "apple", State: api_model.DeviceStateInactive},
+				{Name: "LAB-3", Brand: "samsung"},
+				{Name: "office_1", Brand: "apple"},
+				{Name: "50% off", Brand: "nokia", State: api_model.DeviceStateInUse},
+			}
+
+			for i := range devices {
+				if err := store.CreateDevice(&devices[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tests := []struct {
+				filter DeviceFilter
+				names  string
+			}{
+				{DeviceFilter{}, "[lab-1 lab-2 LAB-3 office_1 50% off]"},
+				{DeviceFilter{Brands: []string{"apple"}}, "[lab-1 lab-2 office_1]"},
+				{DeviceFilter{Brands: []string{"apple"}, States: []string{"available"}, NamePattern: "lab-*"}, "[lab-1]"},
+				{DeviceFilter{Brands: []string{"apple", "samsung"}, States: []string{"available", "inactive"}}, "[lab-1 lab-2 LAB-3 office_1]"},
+				{DeviceFilter{NamePattern: "lab-?"}, "[lab-1 lab-2 LAB-3]"},
+				{DeviceFilter{NamePattern: "*_*"}, "[office_1]"},
+				{DeviceFilter{NamePattern: "50%*"}, "[50% off]"},
+				{DeviceFilter{NamePattern: "lab%"}, "[]"},
+				{DeviceFilter{CreatedAfter: devices[1].CreatedOn}, "[LAB-3 office_1 50% off]"},
+				{DeviceFilter{CreatedAfter: devices[1].CreatedOn, CreatedBefore: devices[4].CreatedOn}, "[LAB-3 office_1]"},
+				{DeviceFilter{LeaseExpiresBefore: time.Now().Add(2 * DefaultLeaseTTL)}, "[50% off]"},
+			}
+
+			for _, tt := range tests {
+				page, err := store.FetchPage(PageQuery{Filter: tt.filter})
+				if err != nil {
+					t.Errorf("%+v: %s", tt.filter, err)
+					continue
+				}
+
+				var names []string
+				for _, device := range page.Devices {
+					names = append(names, device.Name)
+				}
+
+				if got := fmt.Sprint(names); got != tt.names {
+					t.Errorf("%+v: got %s want %s", tt.filter, got, tt.names)
+				}
+			}
+
+			invalid := []DeviceFilter{
+				{Brands: []string{"apple", ""}},
+				{States: []string{"broken"}},
+				{CreatedAfter: devices[1].CreatedOn, CreatedBefore: devices[0].CreatedOn},
+			}
+
+			for _, filter := range invalid {
+				if _, err := store.FetchPage(PageQuery{Filter: filter}); !errors.Is(err, ErrInvalidInput) {
+					t.Errorf("%+v: got %v want invalid input", filter, err)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreSearch(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			devices := []api_model.Device{
+				{Name: "iPhone 15", Brand: "Apple"},
+				{Name: "Galaxy S24", Brand: "Samsung"},
+				{Name: "Pixel 8", Brand: "Google"},
+				{Name: "iPad Air", Brand: "Apple"},
+			}
+
+			for i := range devices {
+				if err := store.CreateDevice(&devices[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			search := func(text string) (names []string) {
+				results, err := store.SearchDevices(text, 0)
+				if err != nil {
+					t.Fatalf("%s: %s", text, err)
+				}
+
+				for i, result := range results {
+					if i > 0 && result.Score > results[i-1].Score {
+						t.Errorf("%s: results not ranked by score", text)
+					}
+
+					names = append(names, result.Device.Name)
+				}
+
+				return names
+			}
+
+			tests := []struct {
+				text  string
+				names string
+			}{
+				{"iphone 15", "[iPhone 15]"},
+				{"iphon", "[iPhone 15]"},
+				{"apple", "[iPhone 15 iPad Air]"},
+				{"galaxy samsung", "[Galaxy S24]"},
+				{"motorola", "[]"},
+			}
+
+			for _, tt := range tests {
+				if got := fmt.Sprint(search(tt.text)); got != tt.names {
+					t.Errorf("%s: got %s want %s", tt.text, got, tt.names)
+				}
+			}
+
+			results, _ := store.SearchDevices("Pixel 8", 0)
+			if len(results) != 1 || results[0].Score != 1 {
+				t.Errorf("an exact match must score 1, got %+v", results)
+			}
+
+			// The index follows updates and deletes
+			if err := store.UpdateDevice(api_model.Device{ID: devices[2].ID, Name: "Pixel Fold"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(search("fold")); got != "[Pixel Fold]" {
+				t.Errorf("fold: got %s want [Pixel Fold]", got)
+			}
+
+			if err := store.DeleteDevice(api_model.Device{ID: devices[0].ID}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(search("apple")); got != "[iPad Air]" {
+				t.Errorf("apple: got %s want [iPad Air]", got)
+			}
+
+			if results, _ := store.SearchDevices("apple", 1); len(results) != 1 {
+				t.Errorf("got %d results with limit 1", len(results))
+			}
+
+			for _, text := range []string{"", " !? "} {
+				if _, err := store.SearchDevices(text, 0); !errors.Is(err, ErrInvalidInput) {
+					t.Errorf("'%s': got %v want invalid input", text, err)
+				}
+			}
+
+			if _, err := store.SearchDevices("apple", MaxSearchLimit+1); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("got %v want invalid input for a limit over %d", err, MaxSearchLimit)
+			}
+		})
+	}
+}
+
+func TestStoreUniquePolicy(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			devices := []api_model.Device{
+				{Name: "lab-1", Brand: "apple"},
+				{Name: "LAB-1", Brand: "samsung"},
+				{Name: "lab-2", Brand: "apple"},
+			}
+
+			for i := range devices {
+				if err := store.CreateDevice(&devices[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 'lab-1' and 'LAB-1' are already duplicate names
+			var storeErr *Error
+			if err := store.SetUniquePolicy(UniqueName); !errors.As(err, &storeErr) || storeErr.ExistingID != devices[0].ID {
+				t.Fatalf("got %v want a duplicate of device %d", err, devices[0].ID)
+			}
+
+			if err := store.SetUniquePolicy(UniqueNameBrand); err != nil {
+				t.Fatal(err)
+			}
+
+			duplicate := api_model.Device{Name: "Lab-1", Brand: "Apple"}
+			err := store.CreateDevice(&duplicate)
+			if !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDuplicateDevice || storeErr.ExistingID != devices[0].ID {
+				t.Fatalf("got %v want a duplicate of device %d", err, devices[0].ID)
+			}
+
+			if err = store.CreateDevice(&api_model.Device{Name: "lab-1", Brand: "nokia"}); err != nil {
+				t.Errorf("another brand is no duplicate: %s", err)
+			}
+
+			err = store.UpdateDevice(api_model.Device{ID: devices[2].ID, Name: "LAB-1"})
+			if !errors.As(err, &storeErr) || storeErr.ExistingID != devices[0].ID {
+				t.Errorf("got %v want a duplicate of device %d", err, devices[0].ID)
+			}
+
+			// A device keeps its own name
+			if err = store.UpdateDevice(api_model.Device{ID: devices[0].ID, Name: "LAB-1"}); err != nil {
+				t.Error(err)
+			}
+
+			// The name of a deleted device is free again
+			if err = store.DeleteDevice(api_model.Device{ID: devices[1].ID}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = store.CreateDevice(&api_model.Device{Name: "lab-1", Brand: "samsung"}); err != nil {
+				t.Error(err)
+			}
+
+			if err = store.SetUniquePolicy(UniqueNone); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = store.CreateDevice(&api_model.Device{Name: "lab-1", Brand: "apple"}); err != nil {
+				t.Errorf("duplicates are allowed without a policy: %s", err)
+			}
+
+			if err = store.SetUniquePolicy("serial"); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("got %v want invalid input", err)
+			}
+		})
+	}
+}
+
+func TestStoreIdempotencyKeys(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			saved, err := store.ReserveIdempotencyKey("key-1", "request-1")
+			if err != nil || saved != nil {
+				t.Fatalf("got %+v, %v want the key reserved", saved, err)
+			}
+
+			// Retried while in progress
+			if saved, err = store.ReserveIdempotencyKey("key-1", "request-1"); err != nil || saved == nil || !saved.InProgress() {
+				t.Fatalf("got %+v, %v want the key in progress", saved, err)
+			}
+
+			response := IdempotentResponse{Status: 201, Header: map[string]string{"Location": "/devices/1"}, Body: []byte(`{"id":1}`)}
+			if err = store.CompleteIdempotencyKey("key-1", response, time.Now().Add(time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			saved, err = store.ReserveIdempotencyKey("key-1", "request-2")
+			if err != nil || saved == nil {
+				t.Fatalf("got %+v, %v want the saved response", saved, err)
+			}
+
+			if saved.Fingerprint != "request-1" || saved.Status != 201 || saved.Header["Location"] != "/devices/1" ||
+				string(saved.Body) != `{"id":1}` {
+				t.Errorf("unexpected saved response %+v", saved)
+			}
+
+			// A released key can be used again
+			store.ReserveIdempotencyKey("key-2", "request-1")
+			if err = store.ReleaseIdempotencyKey("key-2"); err != nil {
+				t.Fatal(err)
+			}
+
+			if saved, _ = store.ReserveIdempotencyKey("key-2", "request-2"); saved != nil {
+				t.Errorf("got %+v want the released key reserved again", saved)
+			}
+
+			// Completed keys are not released, only purged once expired
+			store.ReleaseIdempotencyKey("key-1")
+
+			purged, err := store.PurgeIdempotencyKeys(time.Now())
+			if err != nil || purged != 0 {
+				t.Errorf("got %d, %v want no key purged", purged, err)
+			}
+
+			if purged, _ = store.PurgeIdempotencyKeys(time.Now().Add(2 * time.Hour)); purged != 2 {
+				t.Errorf("got %d keys purged want 2", purged)
+			}
+
+			if saved, _ = store.ReserveIdempotencyKey("key-1", "request-3"); saved != nil {
+				t.Errorf("got %+v want the purged key reserved again", saved)
+			}
+		})
+	}
+}
+
+func TestStoreBulk(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			inUse := api_model.Device{Name: "busy", Brand: "apple", State: api_model.DeviceStateInUse}
+			spare := api_model.Device{Name: "spare", Brand: "apple"}
+			for _, device := range []*api_model.Device{&inUse, &spare} {
+				if err := store.CreateDevice(device); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			operations := []BulkOperation{
+				{Op: BulkCreate, Device: api_model.Device{Name: "new-1", Brand: "samsung"}},
+				{Op: BulkUpdate, Device: api_model.Device{ID: spare.ID, Name: "renamed"}},
+				{Op: BulkDelete, Device: api_model.Device{ID: inUse.ID}},
+				{Op: BulkCreate, Device: api_model.Device{Name: "new-2", Brand: "samsung"}},
+			}
+
+			// All or nothing: deleting the in-use device fails the whole bulk
+			_, err := store.ApplyBulk(operations, BulkOptions{Atomic: true})
+			if !errors.Is(err, ErrConflict) {
+				t.Fatalf("got %v want a conflict", err)
+			}
+
+			if devices, _ := store.FetchAll(); len(devices) != 2 || devices[1].Name != "spare" {
+				t.Fatalf("a failed atomic bulk changed the devices: %+v", devices)
+			}
+
+			// A dry run reports the same results, and changes nothing
+			results, err := store.ApplyBulk(operations, BulkOptions{DryRun: true})
+			if err != nil || len(results) != len(operations) || results[2].Err == nil {
+				t.Fatalf("got %+v, %v want the results of every operation", results, err)
+			}
+
+			if devices, _ := store.FetchAll(); len(devices) != 2 || devices[1].Name != "spare" {
+				t.Fatalf("a dry run changed the devices: %+v", devices)
+			}
+
+			// One result per operation, only the in-use delete fails
+			results, err = store.ApplyBulk(operations, BulkOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != len(operations) {
+				t.Fatalf("got %d results want %d", len(results), len(operations))
+			}
+
+			for i, result := range results {
+				if failed := result.Err != nil; failed != (i == 2) {
+					t.Errorf("operation %d: unexpected result %+v", i, result)
+				}
+			}
+
+			if results[0].Device.ID == 0 || results[1].Device.Name != "renamed" || results[1].Device.Version != 2 {
+				t.Errorf("unexpected results %+v", results)
+			}
+
+			if devices, _ := store.FetchAll(); len(devices) != 4 {
+				t.Errorf("got %d devices want 4", len(devices))
+			}
+
+			if _, err = store.ApplyBulk([]BulkOperation{{Op: "upsert"}}, BulkOptions{}); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("got %v want invalid input", err)
+			}
+
+			if _, err = store.ApplyBulk(nil, BulkOptions{Atomic: true}); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("got %v want invalid input", err)
+			}
+		})
+	}
+}
+
+// TestStoreImport reads CSV and Parquet inventories, rejecting the invalid rows
+func TestStoreImport(t *testing.T) {
+	dir := t.TempDir()
+
+	inventory := filepath.Join(dir, "inventory.csv")
+	os.WriteFile(inventory, []byte(`Device Name,Maker,State
+"Pixel 8, spare",google,Available
+iPhone,,available
+Galaxy,samsung,broken
+existing,apple,
+Watch,apple,inactive
+`), 0o644)
+
+	// The Parquet file is written by DuckDB, from the same kind of data
+	parquet := filepath.Join(dir, "inventory.parquet")
+	writer, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	_, err = writer.Exec(fmt.Sprintf(`COPY (SELECT * FROM (VALUES ('Tab', 'lenovo', 'in-use'), ('Kindle', 'amazon', NULL))
+		AS devices(name, brand, state)) TO '%s' (FORMAT parquet)`, parquet))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns, err := ParseColumnMapping("name=Device Name, brand=maker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SetUniquePolicy(UniqueName); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.CreateDevice(&api_model.Device{Name: "Existing", Brand: "apple"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// A dry run reports what would happen, and creates nothing
+			report, err := ImportDevices(store, inventory, ImportOptions{Format: ImportCSV, Columns: columns, DryRun: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if report.Rows != 5 || len(report.Imported) != 2 || report.Imported[0].ID != 0 {
+				t.Fatalf("unexpected dry run report: %+v", report)
+			}
+
+			if devices, _ := store.FetchAll(); len(devices) != 1 {
+				t.Fatalf("a dry run created devices: %+v", devices)
+			}
+
+			report, err = ImportDevices(store, inventory, ImportOptions{Format: ImportCSV, Columns: columns})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(report.Imported) != 2 || report.Imported[0].Name != "Pixel 8, spare" ||
+				report.Imported[0].State != api_model.DeviceStateAvailable || report.Imported[1].ID == 0 {
+				t.Fatalf("unexpected imported devices: %+v", report.Imported)
+			}
+
+			want := []ImportRejection{
+				{Row: 2, Code: ErrCodeMissingField},
+				{Row: 3, Code: ErrCodeInvalidState},
+				{Row: 4, Code: ErrCodeDuplicateDevice},
+			}
+			if len(report.Rejected) != len(want) {
+				t.Fatalf("got rejections %+v want %+v", report.Rejected, want)
+			}
+
+			for i, rejection := range report.Rejected {
+				if rejection.Row != want[i].Row || rejection.Code != want[i].Code || len(rejection.Reason) == 0 {
+					t.Errorf("got rejection %+v want %+v", rejection, want[i])
+				}
+			}
+
+			report, err = ImportDevices(store, parquet, ImportOptions{Format: ImportFormatFor(parquet)})
+			if err != nil || len(report.Imported) != 2 || report.Imported[0].State != api_model.DeviceStateInUse {
+				t.Fatalf("got %+v, %v want both Parquet devices imported", report, err)
+			}
+
+			// Missing columns and unreadable files fail the whole import
+			for _, options := range []ImportOptions{
+				{Format: ImportCSV},
+				{Format: ImportCSV, Columns: ColumnMapping{"name": "Device Name", "brand": "Manufacturer"}},
+				{Format: ImportParquet, Columns: columns},
+				{Format: "xlsx", Columns: columns},
+			} {
+				if _, err = ImportDevices(store, inventory, options); !errors.Is(err, ErrInvalidInput) {
+					t.Errorf("import with %+v: got %v want invalid input", options, err)
+				}
+			}
+		})
+	}
+
+	for _, text := range []string{"name", "name=", "serial=SN"} {
+		if _, err := ParseColumnMapping(text); !errors.Is(err, ErrInvalidInput) {
+			t.Errorf("mapping '%s': got %v want invalid input", text, err)
+		}
+	}
+}
+
+func TestStoreCheckout(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			inactive := api_model.Device{Name: "inactive", Brand: "b1", State: api_model.DeviceStateInactive}
+			store.CreateDevice(&device)
+			store.CreateDevice(&inactive)
+
+			held, err := store.CheckoutDevice(device.ID, "alice", DefaultLeaseTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if held.State != api_model.DeviceStateInUse || held.Holder != "alice" || held.HeldSince == nil {
+				t.Errorf("unexpected device after check-out: %+v", held)
+			}
+
+			steps := []struct {
+				checkout bool
+				id       int64
+				holder   string
+				code     string
+			}{
+				{true, device.ID, "alice", ""},
+				{true, device.ID, "bob", ErrCodeDeviceHeld},
+				{false, device.ID, "bob", ErrCodeDeviceHeld},
+				{true, device.ID, " ", ErrCodeInvalidHolder},
+				{true, inactive.ID, "bob", ErrCodeInvalidTransition},
+				{true, 999, "bob", ErrCodeDeviceNotFound},
+				{false, device.ID, "alice", ""},
+				{false, device.ID, "alice", ErrCodeDeviceNotHeld},
+				{true, device.ID, "bob", ""},
+			}
+
+			for _, step := range steps {
+				if step.checkout {
+					_, err = store.CheckoutDevice(step.id, step.holder, DefaultLeaseTTL)
+				} else {
+					_, err = store.CheckinDevice(step.id, step.holder)
+				}
+
+				var storeErr *Error
+				if len(step.code) == 0 && err != nil {
+					t.Errorf("checkout=%t %d '%s': unexpected error %v", step.checkout, step.id, step.holder, err)
+				} else if len(step.code) > 0 && (!errors.As(err, &storeErr) || storeErr.Code != step.code) {
+					t.Errorf("checkout=%t %d '%s': got %v want code %s", step.checkout, step.id, step.holder, err, step.code)
+				}
+			}
+
+			devices, _ := store.Fetch(int(device.ID))
+			if len(devices) != 1 || devices[0].Holder != "bob" {
+				t.Errorf("unexpected device after the last check-out: %+v", devices)
+			}
+		})
+	}
+}
+
+// TestStoreConcurrentCheckout makes sure only one of many clients gets the device
+func TestStoreConcurrentCheckout(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			store.CreateDevice(&device)
+
+			var wg sync.WaitGroup
+			results := make(chan error, 16)
+
+			for i := range 16 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					_, err := store.CheckoutDevice(device.ID, fmt.Sprintf("holder-%d", i), DefaultLeaseTTL)
+					results <- err
+				}()
+			}
+
+			wg.Wait()
+			close(results)
+
+			winners := 0
+			for err := range results {
+				if err == nil {
+					winners++
+				} else if !errors.Is(err, ErrConflict) {
+					t.Errorf("unexpected check-out error: %s", err)
+				}
+			}
+
+			if winners != 1 {
+				t.Errorf("unexpected number of successful check-outs: got %d want 1", winners)
+			}
+		})
+	}
+}
+
+// TestStoreConcurrentUpdateAndDelete races updates and deletes against a check-out
+// of the same device. Whatever the order, a checked out device must never be
+// changed nor deleted.
+func TestStoreConcurrentUpdateAndDelete(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for round := range 20 {
+				device := api_model.Device{Name: "device", Brand: "b1"}
+				if err := store.CreateDevice(&device); err != nil {
+					t.Fatal(err)
+				}
+
+				var wg sync.WaitGroup
+				var checkedOut, deleted bool
+				errs := make(chan error, 16)
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					_, err := store.CheckoutDevice(device.ID, "alice", DefaultLeaseTTL)
+					checkedOut = err == nil
+					errs <- err
+				}()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					err := store.DeleteDevice(api_model.Device{ID: device.ID})
+					deleted = err == nil
+					errs <- err
+				}()
+
+				for i := range 8 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						errs <- store.UpdateDevice(api_model.Device{ID: device.ID, Name: fmt.Sprintf("update-%d", i)})
+					}()
+				}
+
+				wg.Wait()
+				close(errs)
+
+				for err := range errs {
+					if err != nil && !errors.Is(err, ErrConflict) && !errors.Is(err, ErrNotFound) {
+						t.Errorf("round %d: unexpected error: %s", round, err)
+					}
+				}
+
+				if checkedOut && deleted {
+					t.Fatalf("round %d: the device was both checked out and deleted", round)
+				}
+
+				if !checkedOut {
+					continue
+				}
+
+				devices, err := store.Fetch(int(device.ID))
+				if err != nil {
+					t.Fatalf("round %d: checked out device is gone: %s", round, err)
+				}
+
+				// Updates may only happen before the check-out, which keeps the name
+				if current := devices[0]; current.State != api_model.DeviceStateInUse || current.Holder != "alice" {
+					t.Fatalf("round %d: checked out device was changed: %+v", round, current)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreLeases(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			short := api_model.Device{Name: "short", Brand: "b1"}
+			busy := api_model.Device{Name: "busy", Brand: "b1", State: api_model.DeviceStateInUse}
+			store.CreateDevice(&device)
+			store.CreateDevice(&short)
+			store.CreateDevice(&busy)
+
+			if busy.LeaseExpiresOn == nil {
+				t.Errorf("device created in use has no lease: %+v", busy)
+			}
+
+			if _, err := store.CheckoutDevice(device.ID, "alice", 0); !errors.Is(err, ErrInvalidInput) {
+				t.Errorf("check-out without a lease duration: got %v want invalid input", err)
+			}
+
+			held, err := store.CheckoutDevice(device.ID, "alice", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			renewed, err := store.RenewLease(device.ID, "alice", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if renewed.LeaseRenewals != 1 || !renewed.LeaseExpiresOn.After(*held.LeaseExpiresOn) {
+				t.Errorf("unexpected lease after renewal: %+v", renewed)
+			}
+
+			var storeErr *Error
+			if _, err = store.RenewLease(device.ID, "bob", time.Hour); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDeviceHeld {
+				t.Errorf("renewal by another holder: got %v want code %s", err, ErrCodeDeviceHeld)
+			}
+
+			// An expired lease cannot be renewed, but the device can be checked out by someone else
+			if _, err = store.CheckoutDevice(short.ID, "alice", time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			if _, err = store.RenewLease(short.ID, "alice", time.Hour); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeLeaseExpired {
+				t.Errorf("renewal of an expired lease: got %v want code %s", err, ErrCodeLeaseExpired)
+			}
+
+			if held, err = store.CheckoutDevice(short.ID, "bob", time.Millisecond); err != nil || held.Holder != "bob" {
+				t.Errorf("check-out of an expired lease: got %+v, %v", held, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			// 'busy' and 'device' expire within the next two hours, 'short' already did
+			expiring, err := store.FetchLeasesExpiringBefore(time.Now().Add(2 * time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(expiring) != 3 || expiring[0].ID != short.ID {
+				t.Errorf("unexpected expiring devices: %+v", expiring)
+			}
+
+			if expired, err := store.ExpireLeases(time.Now()); err != nil || expired != 1 {
+				t.Errorf("unexpected expired leases: got %d, %v want 1", expired, err)
+			}
+
+			devices, _ := store.Fetch(int(short.ID))
+			if len(devices) != 1 || devices[0].State != api_model.DeviceStateAvailable || devices[0].LeaseExpiresOn != nil {
+				t.Errorf("unexpected device after its lease expired: %+v", devices)
+			}
+		})
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			other := api_model.Device{Name: "other", Brand: "b1"}
+
+			alice := store.WithActor("alice")
+			if err := alice.CreateDevice(&device); err != nil {
+				t.Fatal(err)
+			}
+			store.CreateDevice(&other)
+
+			alice.UpdateDevice(api_model.Device{ID: device.ID, Name: "renamed"})
+			alice.CheckoutDevice(device.ID, "alice", time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+			store.ExpireLeases(time.Now())
+			store.WithActor("bob").DeleteDevice(api_model.Device{ID: device.ID})
+
+			// Failed changes leave no trace
+			if err := alice.UpdateDevice(api_model.Device{ID: other.ID, State: "broken"}); err == nil {
+				t.Fatal("update to an invalid state did not fail")
+			}
+
+			page, err := store.FetchHistory(device.ID, HistoryQuery{Limit: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(page.Events) != 3 || len(page.Next) == 0 {
+				t.Fatalf("unexpected first page of history: %+v", page)
+			}
+
+			rest, err := store.FetchHistory(device.ID, HistoryQuery{Limit: 3, After: page.Next})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rest.Events) != 2 || len(rest.Next) > 0 {
+				t.Fatalf("unexpected last page of history: %+v", rest)
+			}
+
+			events := append(page.Events, rest.Events...)
+			want := []struct{ operation, actor string }{
+				{EventDelete, "bob"}, {EventExpire, ""}, {EventCheckout, "alice"}, {EventUpdate, "alice"}, {EventCreate, "alice"},
+			}
+
+			for i, event := range events {
+				if event.DeviceID != device.ID || event.Operation != want[i].operation || event.Actor != want[i].actor {
+					t.Errorf("event %d: got %s by '%s' want %s by '%s'", i, event.Operation, event.Actor, want[i].operation, want[i].actor)
+				}
+			}
+
+			if created := events[4]; created.Before != nil || created.After == nil || created.After.Name != "device" {
+				t.Errorf("unexpected creation event: %+v", created)
+			}
+
+			if updated := events[3]; updated.Before.Name != "device" || updated.After.Name != "renamed" ||
+				updated.After.Version != updated.Before.Version+1 {
+				t.Errorf("unexpected update event: before %+v after %+v", updated.Before, updated.After)
+			}
+
+			if expired := events[1]; expired.Before.Holder != "alice" || expired.After.State != api_model.DeviceStateAvailable {
+				t.Errorf("unexpected expiry event: before %+v after %+v", expired.Before, expired.After)
+			}
+
+			if deleted := events[0]; deleted.Before == nil || deleted.After != nil {
+				t.Errorf("unexpected deletion event: %+v", deleted)
+			}
+
+			if page, err = store.FetchHistory(other.ID, HistoryQuery{}); err != nil || len(page.Events) != 1 {
+				t.Errorf("unexpected history of the other device: got %+v, %v", page, err)
+			}
+
+			var storeErr *Error
+			if _, err = store.FetchHistory(999, HistoryQuery{}); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDeviceNotFound {
+				t.Errorf("history of an unknown device: got %v want code %s", err, ErrCodeDeviceNotFound)
+			}
+
+			if _, err = store.FetchHistory(device.ID, HistoryQuery{After: "nope"}); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeInvalidCursor {
+				t.Errorf("history after an invalid cursor: got %v want code %s", err, ErrCodeInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestStoreAsOf(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			before := time.Now()
+			time.Sleep(5 * time.Millisecond)
+
+			kept := api_model.Device{Name: "kept", Brand: "b1"}
+			deleted := api_model.Device{Name: "deleted", Brand: "b2"}
+			store.CreateDevice(&kept)
+			store.CreateDevice(&deleted)
+
+			time.Sleep(5 * time.Millisecond)
+			then := time.Now()
+			time.Sleep(5 * time.Millisecond)
+
+			store.UpdateDevice(api_model.Device{ID: kept.ID, Name: "renamed"})
+			store.DeleteDevice(api_model.Device{ID: deleted.ID})
+			added := api_model.Device{Name: "added", Brand: "b1"}
+			store.CreateDevice(&added)
+
+			names := func(query PageQuery) (names []string) {
+				t.Helper()
+
+				page, err := store.FetchPage(query)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, device := range page.Devices {
+					names = append(names, device.Name)
+				}
+
+				return names
+			}
+
+			if got := names(PageQuery{AsOf: then, Sort: SortByName}); fmt.Sprint(got) != "[deleted kept]" {
+				t.Errorf("unexpected devices as of before the changes: %v", got)
+			}
+
+			if got := names(PageQuery{AsOf: time.Now(), Sort: SortByName}); fmt.Sprint(got) != "[added renamed]" {
+				t.Errorf("unexpected devices as of now: %v", got)
+			}
+
+			if got := names(PageQuery{AsOf: before}); len(got) > 0 {
+				t.Errorf("unexpected devices as of before their creation: %v", got)
+			}
+
+			// Filters, order and cursors apply to the past as they do to the present
+			if got := names(PageQuery{AsOf: then, Filter: DeviceFilter{Brands: []string{"b2"}}}); fmt.Sprint(got) != "[deleted]" {
+				t.Errorf("unexpected devices of brand b2 as of before the changes: %v", got)
+			}
+
+			page, err := store.FetchPage(PageQuery{AsOf: then, Limit: 1})
+			if err != nil || len(page.Next) == 0 {
+				t.Fatalf("unexpected first page as of before the changes: %+v, %v", page, err)
+			}
+
+			if got := names(PageQuery{AsOf: then, Limit: 1, After: page.Next}); fmt.Sprint(got) != "[deleted]" {
+				t.Errorf("unexpected second page as of before the changes: %v", got)
+			}
+		})
+	}
+}
+
+func TestStoreSoftDelete(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.SetUniquePolicy(UniqueName); err != nil {
+				t.Fatal(err)
+			}
+
+			device := api_model.Device{Name: "device", Brand: "b1"}
+			other := api_model.Device{Name: "other", Brand: "b1"}
+			store.CreateDevice(&device)
+			store.CreateDevice(&other)
+
+			if err := store.DeleteDevice(api_model.Device{ID: device.ID}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Deleted devices are left out of every read, and of every change
+			var storeErr *Error
+			if _, err := store.Fetch(int(device.ID)); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDeviceNotFound {
+				t.Errorf("fetch of a deleted device: got %v want code %s", err, ErrCodeDeviceNotFound)
+			}
+
+			if err := store.UpdateDevice(api_model.Device{ID: device.ID, Name: "x"}); !errors.Is(err, ErrNotFound) {
+				t.Errorf("update of a deleted device: got %v want not found", err)
+			}
+
+			if devices, _ := store.FetchAll(); len(devices) != 1 || devices[0].ID != other.ID {
+				t.Errorf("unexpected devices after a deletion: %+v", devices)
+			}
+
+			if results, _ := store.SearchDevices("device", 0); len(results) != 0 {
+				t.Errorf("unexpected search results after a deletion: %+v", results)
+			}
+
+			page, err := store.FetchPage(PageQuery{IncludeDeleted: true})
+			if err != nil || len(page.Devices) != 2 || page.Devices[0].DeletedOn == nil || page.Devices[1].DeletedOn != nil {
+				t.Errorf("unexpected devices, deleted included: got %+v, %v", page.Devices, err)
+			}
+
+			// Its name is free, until it is restored
+			taken := api_model.Device{Name: "device", Brand: "b2"}
+			if err = store.CreateDevice(&taken); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = store.RestoreDevice(device.ID); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDuplicateDevice {
+				t.Errorf("restore of a device whose name was taken: got %v want code %s", err, ErrCodeDuplicateDevice)
+			}
+
+			store.DeleteDevice(api_model.Device{ID: taken.ID})
+
+			restored, err := store.RestoreDevice(device.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if restored.DeletedOn != nil || restored.Name != "device" || restored.Version != device.Version+2 {
+				t.Errorf("unexpected restored device: %+v", restored)
+			}
+
+			if _, err = store.RestoreDevice(device.ID); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDeviceNotDeleted {
+				t.Errorf("restore of a device not deleted: got %v want code %s", err, ErrCodeDeviceNotDeleted)
+			}
+
+			if _, err = store.PurgeDevices(time.Time{}); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeInvalidPurge {
+				t.Errorf("purge without a cutoff: got %v want code %s", err, ErrCodeInvalidPurge)
+			}
+
+			if purged, err := store.PurgeDevices(time.Now()); err != nil || purged != 1 {
+				t.Errorf("unexpected purge: got %d, %v want 1", purged, err)
+			}
+
+			if _, err = store.RestoreDevice(taken.ID); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeDeviceNotFound {
+				t.Errorf("restore of a purged device: got %v want code %s", err, ErrCodeDeviceNotFound)
+			}
+
+			// The history of a purged device is kept
+			if history, err := store.FetchHistory(taken.ID, HistoryQuery{}); err != nil || history.Events[0].Operation != EventPurge {
+				t.Errorf("unexpected history of a purged device: got %+v, %v", history, err)
+			}
+		})
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			stats, err := store.FetchStats()
+			if err != nil || stats.Total != 0 || len(stats.ByBrand) != 0 || len(stats.ByState) != 0 || len(stats.ByMonth) != 0 {
+				t.Fatalf("unexpected stats of an empty store: got %+v, %v", stats, err)
+			}
+
+			devices := []api_model.Device{
+				{Name: "d1", Brand: "b1"},
+				{Name: "d2", Brand: "b1", State: api_model.DeviceStateInactive},
+				{Name: "d3", Brand: "b2"},
+				{Name: "d4", Brand: "b2"},
+			}
+
+			for i := range devices {
+				if err = store.CreateDevice(&devices[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			store.DeleteDevice(api_model.Device{ID: devices[3].ID})
+
+			if stats, err = store.FetchStats(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Deleted devices are left out of the counts, not out of the months
+			if stats.Total != 3 {
+				t.Errorf("unexpected total: got %d want 3", stats.Total)
+			}
+
+			if want := []StatsCount{{"b1", 2}, {"b2", 1}}; fmt.Sprint(stats.ByBrand) != fmt.Sprint(want) {
+				t.Errorf("unexpected brand counts: got %v want %v", stats.ByBrand, want)
+			}
+
+			if want := []StatsCount{{"available", 2}, {"inactive", 1}}; fmt.Sprint(stats.ByState) != fmt.Sprint(want) {
+				t.Errorf("unexpected state counts: got %v want %v", stats.ByState, want)
+			}
+
+			month := MonthStats{Month: devices[0].CreatedOn.UTC().Format("2006-01"), Created: 4, Deleted: 1, Total: 3}
+			if len(stats.ByMonth) != 1 || stats.ByMonth[0] != month {
+				t.Errorf("unexpected month stats: got %+v want %+v", stats.ByMonth, month)
+			}
+		})
+	}
+}
+
+func TestStoreApiKeys(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var storeErr *Error
+			if _, _, err := store.CreateApiKey(" ", []string{ScopeDevicesRead}); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeInvalidApiKey {
+				t.Errorf("key without a name: got %v want code %s", err, ErrCodeInvalidApiKey)
+			}
+
+			if _, _, err := store.CreateApiKey("ci", []string{"devices:delete"}); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeInvalidScope {
+				t.Errorf("key with an unknown scope: got %v want code %s", err, ErrCodeInvalidScope)
+			}
+
+			key, secret, err := store.CreateApiKey("ci", []string{ScopeDevicesWrite, ScopeDevicesRead, ScopeDevicesWrite})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if key.ID == 0 || key.Prefix != secret[:len(key.Prefix)] || fmt.Sprint(key.Scopes) != "[devices:read devices:write]" {
+				t.Errorf("unexpected key: %+v (%s)", key, secret)
+			}
+
+			// Scopes grant the lower ones
+			if !key.Allows(ScopeDevicesRead) || !key.Allows(ScopeDevicesWrite) || key.Allows(ScopeDevicesAdmin) {
+				t.Errorf("unexpected scopes granted by %v", key.Scopes)
+			}
+
+			found, err := store.FindApiKey(secret)
+			if err != nil || found == nil || found.ID != key.ID || found.Name != "ci" {
+				t.Errorf("unexpected key found: got %+v, %v want %d", found, err, key.ID)
+			}
+
+			if found, err = store.FindApiKey(secret + "x"); err != nil || found != nil {
+				t.Errorf("unexpected key found for a wrong secret: got %+v, %v", found, err)
+			}
+
+			revoked, err := store.RevokeApiKey(key.ID)
+			if err != nil || revoked.RevokedOn == nil {
+				t.Fatalf("unexpected revoked key: got %+v, %v", revoked, err)
+			}
+
+			if found, err = store.FindApiKey(secret); err != nil || found != nil {
+				t.Errorf("unexpected key found once revoked: got %+v, %v", found, err)
+			}
+
+			if _, err = store.RevokeApiKey(99); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeApiKeyNotFound {
+				t.Errorf("revoke of an unknown key: got %v want code %s", err, ErrCodeApiKeyNotFound)
+			}
+
+			if keys, err := store.ListApiKeys(); err != nil || len(keys) != 1 || keys[0].RevokedOn == nil {
+				t.Errorf("unexpected keys: got %+v, %v", keys, err)
+			}
+		})
+	}
+}
+
+// TestStoreBootstrapApiKey makes sure the first key is only created on a store without keys
+func TestStoreBootstrapApiKey(t *testing.T) {
+	secret := ApiKeyPrefix + strings.Repeat("s", 40)
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var storeErr *Error
+			if _, err := store.BootstrapApiKey("admin", []string{ScopeDevicesAdmin}, "short"); !errors.As(err, &storeErr) || storeErr.Code != ErrCodeInvalidApiKey {
+				t.Errorf("bootstrap with a short secret: got %v want code %s", err, ErrCodeInvalidApiKey)
+			}
+
+			key, err := store.BootstrapApiKey("admin", []string{ScopeDevicesAdmin}, secret)
+			if err != nil || key == nil || key.ID == 0 || !key.Allows(ScopeDevicesAdmin) {
+				t.Fatalf("unexpected bootstrap key: got %+v, %v", key, err)
+			}
+
+			if found, err := store.FindApiKey(secret); err != nil || found == nil || found.ID != key.ID {
+				t.Errorf("unexpected key found: got %+v, %v want %d", found, err, key.ID)
+			}
+
+			// Once revoked, the key is not bootstrapped again
+			if _, err = store.RevokeApiKey(key.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if again, err := store.BootstrapApiKey("admin", []string{ScopeDevicesAdmin}, secret); err != nil || again != nil {
+				t.Errorf("unexpected second bootstrap: got %+v, %v", again, err)
+			}
+
+			if found, err := store.FindApiKey(secret); err != nil || found != nil {
+				t.Errorf("unexpected key found once revoked: got %+v, %v", found, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package dvapi_db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// UniquePolicy tells which devices are duplicates of each other.
+// The stores enforce it with the 'unique_key' column, which has a UNIQUE index.
+type UniquePolicy string
+
+const (
+	UniqueNone      UniquePolicy = "none"       // Devices may be duplicated, the default
+	UniqueName      UniquePolicy = "name"       // No two devices have the same name, regardless of case
+	UniqueNameBrand UniquePolicy = "name-brand" // No two devices of the same brand have the same name, regardless of case
+)
+
+// ParseUniquePolicy returns the UniquePolicy named 'policy', UniqueNone if empty
+func ParseUniquePolicy(policy string) (UniquePolicy, error) {
+	switch UniquePolicy(policy) {
+	case "", UniqueNone:
+		return UniqueNone, nil
+	case UniqueName, UniqueNameBrand:
+		return UniquePolicy(policy), nil
+	}
+
+	return UniqueNone, invalidInputError(ErrCodeInvalidUniquePolicy,
+		"unknown uniqueness policy '%s' (use '%s', '%s' or '%s')", policy, UniqueNone, UniqueName, UniqueNameBrand)
+}
+
+// key returns the value of 'unique_key' for a device named 'name' of brand 'brand',
+// NULL when devices may be duplicated. Devices with the same key are duplicates.
+func (p UniquePolicy) key(name string, brand string) sql.NullString {
+	switch p {
+	case UniqueName:
+		return sql.NullString{String: strings.ToLower(name), Valid: true}
+	case UniqueNameBrand:
+		// The unit separator cannot be typed in, 'a/b'+'c' and 'a'+'b/c' stay apart
+		return sql.NullString{String: strings.ToLower(name) + "\x1f" + strings.ToLower(brand), Valid: true}
+	}
+
+	return sql.NullString{}
+}
+
+// duplicateError reports that the device 'existing' already is named 'name' (of brand 'brand')
+func (p UniquePolicy) duplicateError(existing int64, name string, brand string) error {
+	message := fmt.Sprintf("device %d already is named '%s'", existing, name)
+	if p == UniqueNameBrand {
+		message = fmt.Sprintf("device %d already is a '%s' named '%s'", existing, brand, name)
+	}
+
+	return &Error{Kind: ErrConflict, Code: ErrCodeDuplicateDevice, Message: message, ExistingID: existing}
+}
@@ -0,0 +1,72 @@
+package dvapi_http
+
+import (
+	"context"
+	"fmt"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	"net/http"
+	"strings"
+)
+
+// Error codes of the 'Authorization' header
+const (
+	ApiErrCodeUnauthorized      string = "unauthorized"
+	ApiErrCodeInsufficientScope string = "insufficient_scope"
+)
+
+// apiKeyContext is the request context key of the dvapi_db.ApiKey the request was made with
+type apiKeyContext struct{}
+
+// SetAuthentication sets whether requests must present an API key, as in
+// 'Authorization: Bearer <key>'. It is required unless disabled here.
+func (s *ApiHttpServer) SetAuthentication(enabled bool) {
+	s.noAuth = !enabled
+}
+
+// authorize lets the requests presenting an API key that grants 'scope' through
+// to 'handler'. Others get '401 Unauthorized' without a valid key, '403 Forbidden'
+// with a key lacking the scope, along with a 'WWW-Authenticate' header (RFC 6750).
+func (s *ApiHttpServer) authorize(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.noAuth {
+			handler(w, r)
+			return
+		}
+
+		scheme, secret, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if secret = strings.TrimSpace(secret); !strings.EqualFold(scheme, "Bearer") || len(secret) == 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dvapi"`)
+			s.writeProblem(w, r, "authenticate", unauthorized(ApiErrCodeUnauthorized,
+				"an API key is required, as in 'Authorization: Bearer <key>'"))
+			return
+		}
+
+		key, err := s.db.FindApiKey(secret)
+		if err != nil {
+			s.writeProblem(w, r, "authenticate", err)
+			return
+		}
+
+		if key == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dvapi", error="invalid_token"`)
+			s.writeProblem(w, r, "authenticate", unauthorized(ApiErrCodeUnauthorized, "invalid or revoked API key"))
+			return
+		}
+
+		if !key.Allows(scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="dvapi", error="insufficient_scope", scope="%s"`, scope))
+			s.writeProblem(w, r, "authorize", forbidden(ApiErrCodeInsufficientScope,
+				"the API key '%s' does not grant '%s'", key.Prefix, scope))
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	}
+}
+
+// requestApiKey returns the API key 'r' was made with, nil if the server does not require one
+func requestApiKey(r *http.Request) *dvapi_db.ApiKey {
+	key, _ := r.Context().Value(apiKeyContext{}).(*dvapi_db.ApiKey)
+
+	return key
+}
@@ -0,0 +1,176 @@
+package dvapi_http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	dvapi_model "github.com/lapuglisi/dvapi/model"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// The modes of 'POST /devices/bulk', given as '?mode='
+const (
+	ApiBulkModeAtomic  string = "atomic"  // All the operations are applied, or none. The default
+	ApiBulkModePartial string = "partial" // The operations that fail are skipped
+)
+
+// ApiBulkMaxOperations is the most operations a single bulk request can hold
+const ApiBulkMaxOperations int = 1000
+
+// ApiBulkMaxBytes is the largest bulk body accepted, 1 KiB for each operation
+const ApiBulkMaxBytes int64 = int64(ApiBulkMaxOperations) << 10
+
+// HttpBulkOperation is one entry of the 'POST /devices/bulk' body. Updates and
+// deletes select the device by 'device.id', and require 'device.version' if set.
+type HttpBulkOperation struct {
+	Op     string             `json:"op"`
+	Device dvapi_model.Device `json:"device"`
+}
+
+// HttpBulkResult is the outcome of the operation at 'Index': the device as
+// created or updated (nothing for deletes), or the problem that prevented it
+type HttpBulkResult struct {
+	Index   int                 `json:"index"`
+	Status  int                 `json:"status"`
+	Device  *dvapi_model.Device `json:"device,omitempty"`
+	Problem *HttpProblem        `json:"problem,omitempty"`
+}
+
+// HttpBulkResults is the body sent by 'POST /devices/bulk', one result per operation
+type HttpBulkResults struct {
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Results   []HttpBulkResult `json:"results"`
+}
+
+// readBulkOperations reads the operations of a bulk request: a JSON array,
+// or one JSON object per line when the body is 'application/x-ndjson'.
+// The body cannot exceed ApiBulkMaxBytes.
+func readBulkOperations(w http.ResponseWriter, r *http.Request) (operations []dvapi_db.BulkOperation, err error) {
+	var entries []HttpBulkOperation
+
+	r.Body = http.MaxBytesReader(w, r.Body, ApiBulkMaxBytes)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType == "application/x-ndjson" || mediaType == "application/jsonl" {
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 1<<20)
+
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+
+			if len(entries) == ApiBulkMaxOperations {
+				return nil, badRequest(dvapi_db.ErrCodeInvalidBulk,
+					"a bulk request holds at most %d operations", ApiBulkMaxOperations)
+			}
+
+			var entry HttpBulkOperation
+			if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				return nil, badRequest(ApiErrCodeInvalidRequest, "invalid operation JSON on line %d: %s", line, err)
+			}
+
+			entries = append(entries, entry)
+		}
+
+		if err = scanner.Err(); err != nil {
+			return nil, bulkReadError(err)
+		}
+	} else {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, bulkReadError(err)
+		}
+
+		if err = json.Unmarshal(body, &entries); err != nil {
+			return nil, badRequest(ApiErrCodeInvalidRequest, "invalid bulk JSON, expected an array of operations: %s", err)
+		}
+
+		if len(entries) > ApiBulkMaxOperations {
+			return nil, badRequest(dvapi_db.ErrCodeInvalidBulk,
+				"%d operations, a bulk request holds at most %d", len(entries), ApiBulkMaxOperations)
+		}
+	}
+
+	operations = make([]dvapi_db.BulkOperation, len(entries))
+	for i, entry := range entries {
+		operations[i] = dvapi_db.BulkOperation{Op: entry.Op, Device: entry.Device}
+	}
+
+	return operations, nil
+}
+
+// bulkReadError returns the problem with reading a bulk body that failed with 'err'
+func bulkReadError(err error) error {
+	if maxBytes := new(http.MaxBytesError); errors.As(err, &maxBytes) {
+		return tooLarge(dvapi_db.ErrCodeInvalidBulk, "a bulk request is at most %d bytes", ApiBulkMaxBytes)
+	}
+
+	return badRequest(ApiErrCodeInvalidRequest, "could not read request body: %s", err)
+}
+
+// HandleDevicesBulk is triggered when the API receives a 'POST /devices/bulk' request.
+// The operations are applied in order, in a single transaction. With '?mode=partial'
+// those that fail are skipped and reported in their result, otherwise the first
+// that fails is sent as the problem and none is applied.
+func (s *ApiHttpServer) HandleDevicesBulk(w http.ResponseWriter, r *http.Request) {
+	var operations []dvapi_db.BulkOperation
+	var results []dvapi_db.BulkResult
+	var err error
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "", ApiBulkModeAtomic, ApiBulkModePartial:
+		operations, err = readBulkOperations(w, r)
+	default:
+		err = badRequest(dvapi_db.ErrCodeInvalidBulk, "unknown bulk mode '%s' (use '%s' or '%s')",
+			mode, ApiBulkModeAtomic, ApiBulkModePartial)
+	}
+
+	if err == nil {
+		results, err = s.store(r).ApplyBulk(operations, dvapi_db.BulkOptions{Atomic: mode != ApiBulkModePartial})
+	}
+
+	if err != nil {
+		s.writeProblem(w, r, "bulk", err)
+
+		return
+	}
+
+	body := HttpBulkResults{Results: make([]HttpBulkResult, len(results))}
+	for i, result := range results {
+		body.Results[i] = HttpBulkResult{Index: i, Status: http.StatusOK}
+
+		if result.Err != nil {
+			problem := newProblem(r, operations[i].Op, result.Err)
+			body.Results[i].Status, body.Results[i].Problem = problem.Status, &problem
+			body.Failed++
+
+			continue
+		}
+
+		// Deleted devices are gone, there is nothing to send back
+		switch operations[i].Op {
+		case dvapi_db.BulkCreate:
+			body.Results[i].Status, body.Results[i].Device = http.StatusCreated, &result.Device
+		case dvapi_db.BulkUpdate:
+			body.Results[i].Device = &result.Device
+		}
+
+		body.Succeeded++
+	}
+
+	jsonBytes, err := json.Marshal(body)
+	if err != nil {
+		s.writeProblem(w, r, "bulk", err)
+		return
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
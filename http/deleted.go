@@ -0,0 +1,64 @@
+package dvapi_http
+
+import (
+	"encoding/json"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	"net/http"
+	"strconv"
+)
+
+// HttpPurgeResult is the body sent by 'POST /devices/purge'
+type HttpPurgeResult struct {
+	Purged int64 `json:"purged"`
+}
+
+// HandleDevicesRestore is triggered when the API receives a 'POST /devices/{id}/restore' request.
+// The deleted device comes back as it was when deleted.
+func (s *ApiHttpServer) HandleDevicesRestore(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		s.writeProblem(w, r, "restore device",
+			badRequest(dvapi_db.ErrCodeInvalidDeviceID, "invalid device id '%s'", r.PathValue("id")))
+		return
+	}
+
+	device, err := s.store(r).RestoreDevice(id)
+	if err != nil {
+		s.writeProblem(w, r, "restore device", err)
+
+		return
+	}
+
+	s.writeDevice(w, r, "restore device", device)
+}
+
+// HandleDevicesPurge is triggered when the API receives a 'POST /devices/purge?before=' request.
+// The devices deleted before that time, as readDeviceFilter takes them, are removed for good.
+func (s *ApiHttpServer) HandleDevicesPurge(w http.ResponseWriter, r *http.Request) {
+	before := r.URL.Query().Get("before")
+	if len(before) == 0 {
+		s.writeProblem(w, r, "purge devices",
+			badRequest(dvapi_db.ErrCodeInvalidPurge, "the devices to purge are those deleted 'before' a given time"))
+		return
+	}
+
+	at, err := parseTime(before)
+	if err != nil {
+		s.writeProblem(w, r, "purge devices", badRequest(dvapi_db.ErrCodeInvalidPurge, "invalid time '%s' for before", before))
+		return
+	}
+
+	purged, err := s.store(r).PurgeDevices(at)
+	if err != nil {
+		s.writeProblem(w, r, "purge devices", err)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(HttpPurgeResult{Purged: purged})
+	if err != nil {
+		s.writeProblem(w, r, "purge devices", err)
+		return
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
@@ -0,0 +1,160 @@
+package dvapi_http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	"log"
+	"net/http"
+)
+
+// Error codes for failures detected by the HTTP layer itself.
+// The ones coming from the store are the dvapi_db.ErrCode* constants.
+const (
+	ApiErrCodeInvalidRequest       string = "invalid_request"
+	ApiErrCodePreconditionRequired string = "precondition_required"
+	ApiErrCodeInternal             string = "internal_error"
+)
+
+// HttpProblem is the RFC 7807 'application/problem+json' body sent on errors.
+// 'Code' is an extension member with a stable value clients can switch on.
+type HttpProblem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+
+	// The device a 'duplicate_device' conflict is with
+	ExistingID int64 `json:"existing_id,omitempty"`
+}
+
+// requestError is a problem with the request itself, found before reaching the store
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// badRequest returns a requestError with code 'code'
+func badRequest(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusBadRequest, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// unauthorized returns a requestError for a request made without valid credentials
+func unauthorized(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusUnauthorized, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// forbidden returns a requestError for a request its credentials do not allow
+func forbidden(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusForbidden, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// preconditionFailed returns a requestError for a precondition that cannot hold
+func preconditionFailed(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusPreconditionFailed, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// preconditionRequired returns a requestError for a request that must be made conditional
+func preconditionRequired(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusPreconditionRequired, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// conflict returns a requestError for a request that clashes with another one
+func conflict(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusConflict, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// unprocessable returns a requestError for a well-formed request that cannot be handled
+func unprocessable(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusUnprocessableEntity, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// notAcceptable returns a requestError for a response that cannot be sent as the client asks
+func notAcceptable(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusNotAcceptable, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// tooLarge returns a requestError for a body over the size accepted
+func tooLarge(code string, format string, args ...any) error {
+	return &requestError{status: http.StatusRequestEntityTooLarge, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// problemFor maps 'err' to its HTTP status and error code
+func problemFor(err error) (status int, code string) {
+	var reqErr *requestError
+	var storeErr *dvapi_db.Error
+
+	if errors.As(err, &reqErr) {
+		return reqErr.status, reqErr.code
+	}
+
+	if !errors.As(err, &storeErr) {
+		return http.StatusInternalServerError, ApiErrCodeInternal
+	}
+
+	switch {
+	case errors.Is(err, dvapi_db.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, dvapi_db.ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, dvapi_db.ErrInvalidInput):
+		status = http.StatusBadRequest
+	case errors.Is(err, dvapi_db.ErrPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	default:
+		status = http.StatusInternalServerError
+	}
+
+	return status, storeErr.Code
+}
+
+// newProblem describes 'err', which happened while doing 'op', as a HttpProblem.
+// Internal errors are logged and not detailed to the client.
+func newProblem(r *http.Request, op string, err error) HttpProblem {
+	status, code := problemFor(err)
+
+	problem := HttpProblem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   fmt.Sprintf("%s: %s", op, err.Error()),
+		Instance: r.URL.Path,
+		Code:     code,
+	}
+
+	var storeErr *dvapi_db.Error
+	if errors.As(err, &storeErr) {
+		problem.ExistingID = storeErr.ExistingID
+	}
+
+	if status == http.StatusInternalServerError {
+		log.Printf("%s %s: %s: %s", r.Method, r.URL.Path, op, err.Error())
+		problem.Detail = fmt.Sprintf("%s: internal error", op)
+	}
+
+	return problem
+}
+
+// writeProblem sends 'err', which happened while doing 'op', as a HttpProblem
+func (s *ApiHttpServer) writeProblem(w http.ResponseWriter, r *http.Request, op string, err error) error {
+	problem := newProblem(r, op, err)
+
+	jsonBytes, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	_, err = w.Write(jsonBytes)
+
+	return err
+}
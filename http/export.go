@@ -0,0 +1,177 @@
+package dvapi_http
+
+import (
+	"encoding/json"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	dvapi_model "github.com/lapuglisi/dvapi/model"
+	"iter"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The media types the device listings can be sent as, chosen with the 'Accept' header
+const (
+	ApiMediaTypeJSON    string = "application/json"
+	ApiMediaTypeCSV     string = "text/csv"
+	ApiMediaTypeNDJSON  string = "application/x-ndjson"
+	ApiMediaTypeParquet string = "application/vnd.apache.parquet"
+	ApiMediaTypeArrow   string = "application/vnd.apache.arrow.stream"
+)
+
+// ApiErrCodeNotAcceptable is sent when no media type of the 'Accept' header can be sent
+const ApiErrCodeNotAcceptable string = "not_acceptable"
+
+// listingMediaTypes are the media types of the listings, JSON first as the default,
+// with the dvapi_db.Export* format of the others
+var listingMediaTypes = []struct{ mediaType, format string }{
+	{ApiMediaTypeJSON, ""},
+	{ApiMediaTypeCSV, dvapi_db.ExportCSV},
+	{ApiMediaTypeNDJSON, dvapi_db.ExportNDJSON},
+	{ApiMediaTypeParquet, dvapi_db.ExportParquet},
+	{ApiMediaTypeArrow, dvapi_db.ExportArrow},
+}
+
+// negotiate returns the listing media type the client prefers, according to the
+// 'Accept' header: the one with the highest 'q', the first of listingMediaTypes
+// on a tie. JSON is sent when there is no header.
+func negotiate(r *http.Request) (mediaType string, err error) {
+	accept := r.Header.Get("Accept")
+	if len(strings.TrimSpace(accept)) == 0 {
+		return ApiMediaTypeJSON, nil
+	}
+
+	best := 0.0
+	for _, listing := range listingMediaTypes {
+		for _, accepted := range strings.Split(accept, ",") {
+			accepted, params, err := mime.ParseMediaType(accepted)
+			if err != nil || !mediaTypeMatches(accepted, listing.mediaType) {
+				continue
+			}
+
+			q := 1.0
+			if value, set := params["q"]; set {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					continue
+				}
+			}
+
+			if q > best {
+				mediaType, best = listing.mediaType, q
+			}
+		}
+	}
+
+	if len(mediaType) == 0 {
+		return "", notAcceptable(ApiErrCodeNotAcceptable, "cannot send the devices as '%s' (use %s, %s, %s, %s or %s)", accept,
+			ApiMediaTypeJSON, ApiMediaTypeCSV, ApiMediaTypeNDJSON, ApiMediaTypeParquet, ApiMediaTypeArrow)
+	}
+
+	return mediaType, nil
+}
+
+// mediaTypeMatches tells whether the 'accepted' range, such as 'text/*', holds 'mediaType'
+func mediaTypeMatches(accepted string, mediaType string) bool {
+	if accepted == "*/*" || accepted == mediaType {
+		return true
+	}
+
+	prefix, found := strings.CutSuffix(accepted, "/*")
+
+	return found && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// streamDevices sends the devices yielded by 'devices' as they come, in 'mediaType':
+// JSON arrays and NDJSON are flushed every dvapi_db.ExportFlushEvery devices. A failure
+// before anything is sent, such as an invalid query, is sent as a problem. Past that
+// point the response is aborted, and the client sees it cut short.
+func (s *ApiHttpServer) streamDevices(w http.ResponseWriter, r *http.Request, mediaType string, devices iter.Seq2[dvapi_model.Device, error]) {
+	var err error
+
+	stream := &streamWriter{ResponseWriter: w}
+	w.Header().Set("Content-Type", mediaType)
+
+	if mediaType == ApiMediaTypeJSON {
+		err = writeJSONArray(stream, devices)
+	} else {
+		for _, listing := range listingMediaTypes {
+			if listing.mediaType == mediaType {
+				err = dvapi_db.ExportDevices(stream, listing.format, devices)
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+		stream.start()
+	case !stream.started:
+		s.writeProblem(w, r, "fetch devices", err)
+	default:
+		log.Printf("%s %s: fetch devices: aborted after the response started: %s", r.Method, r.URL.Path, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeJSONArray writes the devices to 'w' as a JSON array, starting with the first one
+func writeJSONArray(w *streamWriter, devices iter.Seq2[dvapi_model.Device, error]) (err error) {
+	var separator string = "["
+	var written int
+
+	for device, err := range devices {
+		if err != nil {
+			return err
+		}
+
+		jsonBytes, err := json.Marshal(device)
+		if err != nil {
+			return err
+		}
+
+		w.Write([]byte(separator))
+		if _, err = w.Write(jsonBytes); err != nil {
+			return err
+		}
+		separator = ","
+
+		if written++; written%dvapi_db.ExportFlushEvery == 0 {
+			w.Flush()
+		}
+	}
+
+	if written == 0 {
+		w.Write([]byte(separator))
+	}
+
+	_, err = w.Write([]byte("]"))
+
+	return err
+}
+
+// streamWriter sends the status of a streamed response with its first bytes.
+// Until then, the response can still be a problem.
+type streamWriter struct {
+	http.ResponseWriter
+
+	started bool
+}
+
+// start sends the successful status, if not already sent
+func (sw *streamWriter) start() {
+	if !sw.started {
+		sw.started = true
+		sw.ResponseWriter.WriteHeader(http.StatusOK)
+	}
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.start()
+
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush sends what was written so far right away
+func (sw *streamWriter) Flush() {
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
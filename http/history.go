@@ -0,0 +1,101 @@
+package dvapi_http
+
+import (
+	"encoding/json"
+	"fmt"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	dvapi_model "github.com/lapuglisi/dvapi/model"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApiActorHeader names who makes a change, as recorded in the history of the device,
+// when the server does not require API keys. Otherwise the key name is recorded.
+const ApiActorHeader string = "X-Actor"
+
+// HttpDeviceEvent is a change of a device, as sent by 'GET /devices/{id}/history'.
+// 'Before' is missing for a creation, 'After' for a deletion.
+type HttpDeviceEvent struct {
+	ID         int64               `json:"id"`
+	Operation  string              `json:"operation"`
+	Actor      string              `json:"actor,omitempty"`
+	OccurredOn time.Time           `json:"occurred_on"`
+	Before     *dvapi_model.Device `json:"before,omitempty"`
+	After      *dvapi_model.Device `json:"after,omitempty"`
+}
+
+// HttpDeviceHistory is the body sent by 'GET /devices/{id}/history', newest event first.
+// 'Next' is the cursor of the next page, to be sent back as '?after='.
+type HttpDeviceHistory struct {
+	Events []HttpDeviceEvent `json:"events"`
+	Next   string            `json:"next,omitempty"`
+}
+
+// store returns the store making the changes requested by 'r', on behalf of the
+// API key it was made with. Without keys, the ApiActorHeader says who makes them.
+func (s *ApiHttpServer) store(r *http.Request) dvapi_db.DeviceStore {
+	if key := requestApiKey(r); key != nil {
+		return s.db.WithActor(key.Name)
+	}
+
+	return s.db.WithActor(strings.TrimSpace(r.Header.Get(ApiActorHeader)))
+}
+
+// HandleDevicesHistory is triggered when the API receives a 'GET /devices/{id}/history' request.
+// The changes made to the device are returned a page at a time, newest first, with the
+// 'limit' and 'after' parameters of 'GET /devices'. Deleted devices keep their history.
+func (s *ApiHttpServer) HandleDevicesHistory(w http.ResponseWriter, r *http.Request) {
+	var historyQuery dvapi_db.HistoryQuery
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		s.writeProblem(w, r, "fetch device history",
+			badRequest(dvapi_db.ErrCodeInvalidDeviceID, "invalid device id '%s'", r.PathValue("id")))
+		return
+	}
+
+	query := r.URL.Query()
+	if limit := query.Get("limit"); len(limit) > 0 {
+		if historyQuery.Limit, err = strconv.Atoi(limit); err != nil || historyQuery.Limit <= 0 {
+			s.writeProblem(w, r, "fetch device history",
+				badRequest(dvapi_db.ErrCodeInvalidPageLimit, "invalid page limit '%s'", limit))
+			return
+		}
+	}
+
+	historyQuery.After = query.Get("after")
+
+	page, err := s.db.FetchHistory(id, historyQuery)
+	if err != nil {
+		s.writeProblem(w, r, "fetch device history", err)
+		return
+	}
+
+	history := HttpDeviceHistory{Events: make([]HttpDeviceEvent, len(page.Events)), Next: page.Next}
+	for i, event := range page.Events {
+		history.Events[i] = HttpDeviceEvent{
+			ID:         event.ID,
+			Operation:  event.Operation,
+			Actor:      event.Actor,
+			OccurredOn: event.OccurredOn,
+			Before:     event.Before,
+			After:      event.After,
+		}
+	}
+
+	jsonBytes, err := json.Marshal(history)
+	if err != nil {
+		s.writeProblem(w, r, "fetch device history", err)
+		return
+	}
+
+	// The next page is the same request, starting after this one
+	if len(page.Next) > 0 {
+		query.Set("after", page.Next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, query.Encode()))
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
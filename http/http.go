@@ -2,14 +2,19 @@ package dvapi_http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	dvapi_db "github.com/lapuglisi/dvapi/database"
 	dvapi_model "github.com/lapuglisi/dvapi/model"
 	"io"
+	"iter"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Constants
@@ -18,41 +23,79 @@ const (
 	ApiServerDefaultHost string = "0.0.0.0"
 )
 
+// ApiDeviceMaxBytes is the largest device body accepted, well above any real device
+const ApiDeviceMaxBytes int64 = 64 << 10
+
+// ApiLegacyRoutesDeprecation is sent in the 'Deprecation' header (RFC 9745)
+// of the legacy routes: the date, as an unix timestamp, they were deprecated on
+const ApiLegacyRoutesDeprecation string = "@1792195200" // 2026-10-17
+
 // The structure that holds the ApiHttpServer implementation
 type ApiHttpServer struct {
 	listenUri string
-	db        *dvapi_db.DuckDatabase
+	db        dvapi_db.DeviceStore
+	mux       *http.ServeMux
+
+	// How long responses are replayed to requests with the same 'Idempotency-Key'
+	idempotencyWindow time.Duration
+
+	// Serve requests without an API key, see SetAuthentication
+	noAuth bool
+
+	// Refuse changes made without an 'If-Match' header, see SetRequireIfMatch
+	requireIfMatch bool
 }
 
-// HttpErrorResponse is used to send errors to a http.Request
+// HttpApiResponse is the body sent when an operation succeeds.
+// Failures are sent as a HttpProblem instead.
 type HttpApiResponse struct {
 	Status string `json:"status"`
 	Reason string `json:"reason"`
 }
 
-func init() {
+// HttpDevicesPage is the body sent by 'GET /devices'. 'Next' is the cursor of the
+// next page, to be sent back as '?after=', and is empty on the last page.
+type HttpDevicesPage struct {
+	Devices dvapi_model.Devices `json:"devices"`
+	Next    string              `json:"next,omitempty"`
 }
 
-func (s *ApiHttpServer) writeApiReponse(w http.ResponseWriter, e HttpApiResponse) error {
-	var err error
+// HttpSearchResult is a device found by 'GET /devices/search' and how well it
+// matches the search, from 0.2 to 1 for an exact match
+type HttpSearchResult struct {
+	Score  float64            `json:"score"`
+	Device dvapi_model.Device `json:"device"`
+}
+
+// HttpSearchResults is the body sent by 'GET /devices/search', best match first
+type HttpSearchResults struct {
+	Results []HttpSearchResult `json:"results"`
+}
 
-	if jsonBytes, err := json.Marshal(e); err == nil {
-		return s.writeResponseJson(w, jsonBytes)
+func init() {
+}
+
+func (s *ApiHttpServer) writeApiReponse(w http.ResponseWriter, status int, e HttpApiResponse) error {
+	jsonBytes, err := json.Marshal(e)
+	if err != nil {
+		return err
 	}
 
-	return err
+	return s.writeResponseJson(w, status, jsonBytes)
 }
 
-func (s *ApiHttpServer) writeResponseJson(w http.ResponseWriter, bytes []byte) (err error) {
-	w.WriteHeader(http.StatusOK)
+// writeResponseJson sends 'bytes' with HTTP status 'status'.
+// Headers must be set before WriteHeader, or they are lost.
+func (s *ApiHttpServer) writeResponseJson(w http.ResponseWriter, status int, bytes []byte) (err error) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	_, err = w.Write(bytes)
 
 	return err
 }
 
 // Setup sets up our ApiHttpServer instance
-func (s *ApiHttpServer) Setup(host string, port int, db *dvapi_db.DuckDatabase) {
+func (s *ApiHttpServer) Setup(host string, port int, db dvapi_db.DeviceStore) {
 	if len(host) == 0 {
 		host = ApiServerDefaultHost
 	}
@@ -69,227 +112,640 @@ func (s *ApiHttpServer) Setup(host string, port int, db *dvapi_db.DuckDatabase)
 	}
 
 	// Setup the endpoints here
-	http.HandleFunc("/devices", s.handleDevices)
-	http.HandleFunc("GET /fetch", s.HandleDevicesFetchAll)
-	http.HandleFunc("GET /fetch/id/{id}", s.HandleDevicesFetch)
-	http.HandleFunc("GET /fetch/brand/{brands}", s.HandleDevicesFetchByBrand)
-	http.HandleFunc("GET /fetch/state/{states}", s.HandleDevicesFetchByState)
+	s.mux = http.NewServeMux()
+
+	// Every route requires an API key granting its scope, see SetAuthentication
+	read, write, admin := dvapi_db.ScopeDevicesRead, dvapi_db.ScopeDevicesWrite, dvapi_db.ScopeDevicesAdmin
+
+	s.mux.HandleFunc("POST /devices", s.authorize(write, s.idempotent(ApiDeviceMaxBytes, s.HandleDevicesCreate)))
+	s.mux.HandleFunc("POST /devices/bulk", s.authorize(write, s.HandleDevicesBulk))
+	s.mux.HandleFunc("POST /devices/import", s.authorize(write, s.HandleDevicesImport))
+	s.mux.HandleFunc("GET /devices", s.authorize(read, s.HandleDevicesFetchAll))
+	s.mux.HandleFunc("GET /devices/search", s.authorize(read, s.HandleDevicesSearch))
+	s.mux.HandleFunc("GET /devices/{id}", s.authorize(read, s.HandleDevicesFetch))
+	s.mux.HandleFunc("PUT /devices/{id}", s.authorize(write, s.conditional(s.HandleDevicesReplace)))
+	s.mux.HandleFunc("PATCH /devices/{id}", s.authorize(write, s.conditional(s.HandleDevicesUpdate)))
+	s.mux.HandleFunc("DELETE /devices/{id}", s.authorize(write, s.conditional(s.HandleDevicesDelete)))
+	s.mux.HandleFunc("POST /devices/{id}/checkout", s.authorize(write, s.HandleDevicesCheckout))
+	s.mux.HandleFunc("POST /devices/{id}/checkin", s.authorize(write, s.HandleDevicesCheckin))
+	s.mux.HandleFunc("POST /devices/{id}/renew", s.authorize(write, s.HandleDevicesRenew))
+	s.mux.HandleFunc("GET /devices/{id}/history", s.authorize(read, s.HandleDevicesHistory))
+	s.mux.HandleFunc("POST /devices/{id}/restore", s.authorize(write, s.HandleDevicesRestore))
+	s.mux.HandleFunc("POST /devices/purge", s.authorize(admin, s.HandleDevicesPurge))
+	s.mux.HandleFunc("GET /stats", s.authorize(read, s.HandleStats))
+
+	// Legacy routes, kept for older clients
+	s.mux.HandleFunc("PATCH /devices", s.authorize(write, deprecated("/devices/{id}", s.conditional(s.HandleDevicesUpdate))))
+	s.mux.HandleFunc("DELETE /devices", s.authorize(write, deprecated("/devices/{id}", s.conditional(s.HandleDevicesDelete))))
+	s.mux.HandleFunc("GET /fetch", s.authorize(read, deprecated("/devices", s.HandleDevicesFetchLegacy)))
+	s.mux.HandleFunc("GET /fetch/id/{id}", s.authorize(read, deprecated("/devices/{id}", s.HandleDevicesFetchById)))
+	s.mux.HandleFunc("GET /fetch/brand/{brands}", s.authorize(read, deprecated("/devices?brand={brands}", s.HandleDevicesFetchByBrand)))
+	s.mux.HandleFunc("GET /fetch/state/{states}", s.authorize(read, deprecated("/devices?state={states}", s.HandleDevicesFetchByState)))
 }
 
 func (s *ApiHttpServer) Run() error {
 	fmt.Println("\033[32minfo\033[0m: dvapi listening on", s.listenUri)
-	return http.ListenAndServe(s.listenUri, nil)
+	return http.ListenAndServe(s.listenUri, s)
 }
 
-// HandleDevicesCreate is triggered when handleDevices receives a POST request
-func (s *ApiHttpServer) HandleDevicesCreate(w http.ResponseWriter, r *http.Request) {
-	var device dvapi_model.Device
-	var jsonBytes []byte = make([]byte, 0)
-	var err error
+// ServeHTTP dispatches the request to the handler of the matching route
+func (s *ApiHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
 
-	jsonBytes, err = io.ReadAll(r.Body)
-	if err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("create device: %s", err.Error()),
-		})
+// deprecated flags the responses of 'handler' as coming from a deprecated
+// route and points clients to the 'successor' route
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", ApiLegacyRoutesDeprecation)
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
 
-		return
+		handler(w, r)
+	}
+}
+
+// etag returns the ETag header value of a device at 'version'
+func etag(version int64) string {
+	return fmt.Sprintf("\"%d\"", version)
+}
+
+// readIfMatch returns the device version required by the 'If-Match' header,
+// 0 if there is no such header or it is '*'. ETags are compared the strong way
+// (RFC 9110), so weak ones never match.
+func readIfMatch(r *http.Request) (version int64, err error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(ifMatch) == 0 || ifMatch == "*" {
+		return 0, nil
 	}
-	defer r.Body.Close()
 
-	if err = device.FromJsonBytes(jsonBytes); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("create device: %s", err.Error()),
-		})
+	if strings.Contains(ifMatch, ",") {
+		return 0, badRequest(ApiErrCodeInvalidRequest, "If-Match with several ETags is not supported")
+	}
+
+	unquoted, found := strings.CutPrefix(ifMatch, "\"")
+	if unquoted, cut := strings.CutSuffix(unquoted, "\""); found && cut {
+		if version, err = strconv.ParseInt(unquoted, 10, 64); err == nil && version > 0 {
+			return version, nil
+		}
+	}
+
+	return 0, preconditionFailed(dvapi_db.ErrCodeVersionMismatch, "If-Match %s matches no device version", ifMatch)
+}
+
+// SetRequireIfMatch sets whether replacing, updating and deleting a device requires
+// an 'If-Match' header naming its version. Otherwise changes without one are blind.
+func (s *ApiHttpServer) SetRequireIfMatch(required bool) {
+	s.requireIfMatch = required
+}
+
+// conditional refuses, with '428 Precondition Required', the requests to 'handler'
+// without an 'If-Match' header naming a version, if the server requires one.
+// 'If-Match: *' names none, it would change the device whatever its version.
+func (s *ApiHttpServer) conditional(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+		if s.requireIfMatch && (len(ifMatch) == 0 || ifMatch == "*") {
+			s.writeProblem(w, r, "conditional request", preconditionRequired(ApiErrCodePreconditionRequired,
+				"an If-Match header with the ETag of the device is required"))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// readDevice decodes the request body into a Device. When the route has an
+// '{id}' segment the id comes from the path, otherwise it comes from the body.
+// A body is optional if 'bodyRequired' is false, and cannot exceed ApiDeviceMaxBytes.
+// The version of the device is only taken from the 'If-Match' header, never from the body.
+func readDevice(w http.ResponseWriter, r *http.Request, bodyRequired bool) (device dvapi_model.Device, err error) {
+	var jsonBytes []byte
+
+	if r.Body != nil {
+		jsonBytes, err = io.ReadAll(http.MaxBytesReader(w, r.Body, ApiDeviceMaxBytes))
+		if maxBytes := new(http.MaxBytesError); errors.As(err, &maxBytes) {
+			return device, tooLarge(ApiErrCodeInvalidRequest, "the device is larger than %d bytes", ApiDeviceMaxBytes)
+		} else if err != nil {
+			return device, badRequest(ApiErrCodeInvalidRequest, "could not read request body: %s", err.Error())
+		}
+		defer r.Body.Close()
+	}
+
+	if len(jsonBytes) > 0 {
+		if err = device.FromJsonBytes(jsonBytes); err != nil {
+			return device, badRequest(ApiErrCodeInvalidRequest, "invalid device JSON: %s", err.Error())
+		}
+	} else if bodyRequired {
+		return device, badRequest(ApiErrCodeInvalidRequest, "empty request body")
+	}
+
+	if pathID := r.PathValue("id"); len(pathID) > 0 {
+		id, err := strconv.ParseInt(pathID, 10, 64)
+		if err != nil {
+			return device, badRequest(dvapi_db.ErrCodeInvalidDeviceID, "invalid device id '%s'", pathID)
+		}
+
+		if device.ID != 0 && device.ID != id {
+			return device, badRequest(dvapi_db.ErrCodeInvalidDeviceID,
+				"device id %d in body does not match id %d in path", device.ID, id)
+		}
+
+		device.ID = id
+	}
+
+	if device.Version, err = readIfMatch(r); err != nil {
+		return device, err
+	}
+
+	return device, nil
+}
+
+// HandleDevicesCreate is triggered when the API receives a 'POST /devices' request
+func (s *ApiHttpServer) HandleDevicesCreate(w http.ResponseWriter, r *http.Request) {
+	var device dvapi_model.Device
+	var err error
+
+	if device, err = readDevice(w, r, true); err != nil {
+		s.writeProblem(w, r, "create device", err)
 
 		return
 	}
 
 	// Insert the new device into the database
-	if err = s.db.CreateDevice(&device); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("create device: %s", err.Error()),
-		})
+	if err = s.store(r).CreateDevice(&device); err != nil {
+		s.writeProblem(w, r, "create device", err)
 
 		return
 	}
 
 	// TODO: Apply the same approach to all device operations
 	retBytes, err := json.Marshal(device)
-	rs := HttpApiResponse{}
 	if err != nil {
-		rs.Status = "error"
-		rs.Reason = "could not prepare the device JSON"
-	} else {
-		rs.Status = "success"
-		rs.Reason = string(retBytes)
+		s.writeProblem(w, r, "create device", err)
+
+		return
 	}
 
-	s.writeApiReponse(w, rs)
+	w.Header().Set("Location", fmt.Sprintf("/devices/%d", device.ID))
+	w.Header().Set("ETag", etag(device.Version))
+	s.writeApiReponse(w, http.StatusCreated, HttpApiResponse{
+		Status: "success",
+		Reason: string(retBytes),
+	})
 }
 
-// HandleDevicesUpdate is triggered when handleDevices receives a PATCH request
+// HandleDevicesUpdate is triggered when the API receives a 'PATCH /devices/{id}' request.
+// Only the fields present in the body are changed.
 func (s *ApiHttpServer) HandleDevicesUpdate(w http.ResponseWriter, r *http.Request) {
 	var device dvapi_model.Device
-	var jsonBytes []byte = make([]byte, 0)
 	var err error
 
-	jsonBytes, err = io.ReadAll(r.Body)
-	if err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("update device: %s", err.Error()),
-		})
+	if device, err = readDevice(w, r, true); err != nil {
+		s.writeProblem(w, r, "update device", err)
 
 		return
 	}
-	defer r.Body.Close()
 
-	if err = device.FromJsonBytes(jsonBytes); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("update device: %s", err.Error()),
-		})
+	// Uupdate the in the database
+	if err = s.store(r).UpdateDevice(device); err != nil {
+		s.writeProblem(w, r, "update device", err)
 
 		return
 	}
 
-	// Uupdate the in the database
-	if err = s.db.UpdateDevice(device); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("update device: %s", err.Error()),
-		})
+	s.writeUpdatedDevice(w, r, "update device", device.ID)
+}
+
+// HandleDevicesReplace is triggered when the API receives a 'PUT /devices/{id}' request.
+// The body is the complete device, so every field must be given.
+func (s *ApiHttpServer) HandleDevicesReplace(w http.ResponseWriter, r *http.Request) {
+	var device dvapi_model.Device
+	var err error
+
+	if device, err = readDevice(w, r, true); err != nil {
+		s.writeProblem(w, r, "replace device", err)
 
 		return
 	}
 
-	s.writeApiReponse(w, HttpApiResponse{
-		Status: "success",
-		Reason: "device updated succesfully",
-	})
+	if len(device.Name) == 0 || len(device.Brand) == 0 || len(device.State) == 0 {
+		s.writeProblem(w, r, "replace device",
+			badRequest(ApiErrCodeInvalidRequest, "name, brand and state are required"))
+
+		return
+	}
+
+	if err = s.store(r).UpdateDevice(device); err != nil {
+		s.writeProblem(w, r, "replace device", err)
+
+		return
+	}
+
+	s.writeUpdatedDevice(w, r, "replace device", device.ID)
 }
 
-// HandleDevicesDelete is triggered when handleDevices receives a DELETE request
+// writeUpdatedDevice sends the device 'id' as it is once changed, with its new
+// version as the ETag, for the next conditional change to be made without a GET
+func (s *ApiHttpServer) writeUpdatedDevice(w http.ResponseWriter, r *http.Request, op string, id int64) {
+	devices, err := s.db.Fetch(int(id))
+	if err != nil {
+		s.writeProblem(w, r, op, err)
+
+		return
+	}
+
+	s.writeDevice(w, r, op, devices[0])
+}
+
+// HandleDevicesDelete is triggered when the API receives a 'DELETE /devices/{id}' request
 func (s *ApiHttpServer) HandleDevicesDelete(w http.ResponseWriter, r *http.Request) {
 	var device dvapi_model.Device
-	var jsonBytes []byte = make([]byte, 0)
 	var err error
 
-	jsonBytes, err = io.ReadAll(r.Body)
-	if err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("delete device: %s", err.Error()),
-		})
+	if device, err = readDevice(w, r, false); err != nil {
+		s.writeProblem(w, r, "delete device", err)
 
 		return
 	}
-	defer r.Body.Close()
 
-	if err = device.FromJsonBytes(jsonBytes); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("delete device: %s", err.Error()),
-		})
+	// Delte the device from the database
+	if err = s.store(r).DeleteDevice(device); err != nil {
+		s.writeProblem(w, r, "delete device", err)
 
 		return
 	}
 
-	// Delte the device from the database
-	if err = s.db.DeleteDevice(device); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("delete device: %s", err.Error()),
-		})
+	s.writeApiReponse(w, http.StatusOK, HttpApiResponse{
+		Status: "success",
+		Reason: "device deleted succesfully",
+	})
+
+}
+
+// checkoutRequest is the body of the check-out, check-in and renew requests.
+// 'TTL' is a duration such as "30m" or "2h", dvapi_db.DefaultLeaseTTL if not given.
+type checkoutRequest struct {
+	Holder string `json:"holder"`
+	TTL    string `json:"ttl,omitempty"`
+}
+
+// readCheckout returns the device id in the path, and the holder and lease duration in the body
+func readCheckout(r *http.Request) (id int64, holder string, ttl time.Duration, err error) {
+	var body checkoutRequest
+
+	if id, err = strconv.ParseInt(r.PathValue("id"), 10, 64); err != nil {
+		return id, holder, ttl, badRequest(dvapi_db.ErrCodeInvalidDeviceID, "invalid device id '%s'", r.PathValue("id"))
+	}
+
+	if r.Body == nil {
+		return id, holder, ttl, badRequest(ApiErrCodeInvalidRequest, "empty request body")
+	}
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return id, holder, ttl, badRequest(ApiErrCodeInvalidRequest, "invalid check-out JSON: %s", err.Error())
+	}
+
+	if ttl = dvapi_db.DefaultLeaseTTL; len(body.TTL) > 0 {
+		if ttl, err = time.ParseDuration(body.TTL); err != nil {
+			return id, holder, ttl, badRequest(dvapi_db.ErrCodeInvalidLeaseTTL, "invalid lease duration '%s'", body.TTL)
+		}
+	}
+
+	return id, body.Holder, ttl, nil
+}
+
+// writeDevice sends 'device' as the reason of a successful response
+func (s *ApiHttpServer) writeDevice(w http.ResponseWriter, r *http.Request, op string, device dvapi_model.Device) {
+	jsonBytes, err := json.Marshal(device)
+	if err != nil {
+		s.writeProblem(w, r, op, err)
 
 		return
 	}
 
-	s.writeApiReponse(w, HttpApiResponse{
+	w.Header().Set("ETag", etag(device.Version))
+	s.writeApiReponse(w, http.StatusOK, HttpApiResponse{
 		Status: "success",
-		Reason: "device deleted succesfully",
+		Reason: string(jsonBytes),
 	})
+}
+
+// HandleDevicesCheckout is triggered when the API receives a 'POST /devices/{id}/checkout' request.
+// The device moves from 'available' to 'in-use', leased to the holder in the body.
+func (s *ApiHttpServer) HandleDevicesCheckout(w http.ResponseWriter, r *http.Request) {
+	id, holder, ttl, err := readCheckout(r)
+	if err != nil {
+		s.writeProblem(w, r, "check out device", err)
+
+		return
+	}
 
+	device, err := s.store(r).CheckoutDevice(id, holder, ttl)
+	if err != nil {
+		s.writeProblem(w, r, "check out device", err)
+
+		return
+	}
+
+	s.writeDevice(w, r, "check out device", device)
 }
 
-// HandleDevicesFetch is triggered when the API receives a 'GET /fetch/id/{id}' request
-func (s *ApiHttpServer) HandleDevicesFetch(w http.ResponseWriter, r *http.Request) {
-	/* Leave it here just as a reminder
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// HandleDevicesCheckin is triggered when the API receives a 'POST /devices/{id}/checkin' request.
+// The device goes back to 'available' if the holder in the body is the one holding it.
+func (s *ApiHttpServer) HandleDevicesCheckin(w http.ResponseWriter, r *http.Request) {
+	id, holder, _, err := readCheckout(r)
+	if err != nil {
+		s.writeProblem(w, r, "check in device", err)
+
 		return
 	}
-	*/
 
-	var devices dvapi_model.Devices = nil
-	var err error = nil
-	var jsonBytes []byte = nil
+	device, err := s.store(r).CheckinDevice(id, holder)
+	if err != nil {
+		s.writeProblem(w, r, "check in device", err)
 
-	deviceID, err := strconv.Atoi(r.PathValue("id"))
+		return
+	}
+
+	s.writeDevice(w, r, "check in device", device)
+}
+
+// HandleDevicesRenew is triggered when the API receives a 'POST /devices/{id}/renew' request.
+// The lease of the holder in the body is extended to 'ttl' from now.
+func (s *ApiHttpServer) HandleDevicesRenew(w http.ResponseWriter, r *http.Request) {
+	id, holder, ttl, err := readCheckout(r)
+	if err != nil {
+		s.writeProblem(w, r, "renew lease", err)
 
-	if devices, err = s.db.Fetch(deviceID); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("could not fetch devices: %s", err.Error()),
-		})
 		return
 	}
 
-	// Check if len(devices) > 0 just in case
-	if len(devices) == 0 {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: "no devices found",
-		})
+	device, err := s.store(r).RenewLease(id, holder, ttl)
+	if err != nil {
+		s.writeProblem(w, r, "renew lease", err)
+
+		return
+	}
+
+	s.writeDevice(w, r, "renew lease", device)
+}
+
+// HandleDevicesFetch is triggered when the API receives a 'GET /devices/{id}' request.
+// The device is sent as a JSON object, with its version as the ETag.
+func (s *ApiHttpServer) HandleDevicesFetch(w http.ResponseWriter, r *http.Request) {
+	device, err := s.fetchDevice(r)
+	if err != nil {
+		s.writeProblem(w, r, "could not fetch devices", err)
+		return
+	}
+
+	jsonBytes, err := json.Marshal(device)
+	if err != nil {
+		s.writeProblem(w, r, "could not fetch devices", err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(device.Version))
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
+
+// HandleDevicesFetchById is triggered when the API receives a 'GET /fetch/id/{id}' request.
+// Unlike 'GET /devices/{id}', the device is sent in a one element array.
+func (s *ApiHttpServer) HandleDevicesFetchById(w http.ResponseWriter, r *http.Request) {
+	device, err := s.fetchDevice(r)
+	if err != nil {
+		s.writeProblem(w, r, "could not fetch devices", err)
 		return
 	}
 
-	if jsonBytes, err = devices.ToJsonBytes(); err != nil {
-		// same thing as above
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: fmt.Sprintf("could not fetch devices: %s", err.Error()),
-		})
+	devices := dvapi_model.Devices{device}
+	jsonBytes, err := devices.ToJsonBytes()
+	if err != nil {
+		s.writeProblem(w, r, "could not fetch devices", err)
 		return
 	}
 
-	s.writeResponseJson(w, jsonBytes)
+	w.Header().Set("ETag", etag(device.Version))
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
+
+// fetchDevice returns the device whose id is in the path of 'r'
+func (s *ApiHttpServer) fetchDevice(r *http.Request) (device dvapi_model.Device, err error) {
+	deviceID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return device, badRequest(dvapi_db.ErrCodeInvalidDeviceID, "invalid device id '%s'", r.PathValue("id"))
+	}
+
+	devices, err := s.db.Fetch(deviceID)
+	if err != nil {
+		return device, err
+	}
+
+	if len(devices) == 0 {
+		return device, fmt.Errorf("store returned no device for id %d", deviceID)
+	}
+
+	return devices[0], nil
+}
+
+// readDeviceFilter returns the filter given by the query parameters below. They can be combined,
+// eg: '?brand=apple&state=available&created_after=2026-10-01' for the available Apple devices
+// created this month.
+//   - brand: comma delimited brands
+//   - state: comma delimited states
+//   - name~: a name pattern, where '*' matches anything, eg: 'name~=lab-*'
+//   - created_after, created_before: RFC 3339 times or YYYY-mm-dd dates (UTC)
+//   - expiring_within: a duration, the devices whose lease ends within it
+func readDeviceFilter(query url.Values) (filter dvapi_db.DeviceFilter, err error) {
+	if brands := query.Get("brand"); len(brands) > 0 {
+		filter.Brands = strings.Split(brands, ",")
+	}
+
+	if states := query.Get("state"); len(states) > 0 {
+		filter.States = strings.Split(states, ",")
+	}
+
+	filter.NamePattern = query.Get("name~")
+
+	for param, at := range map[string]*time.Time{"created_after": &filter.CreatedAfter, "created_before": &filter.CreatedBefore} {
+		if value := query.Get(param); len(value) > 0 {
+			if *at, err = parseTime(value); err != nil {
+				return filter, badRequest(dvapi_db.ErrCodeInvalidFilter, "invalid time '%s' for %s", value, param)
+			}
+		}
+	}
+
+	if expiring := query.Get("expiring_within"); len(expiring) > 0 {
+		within, err := time.ParseDuration(expiring)
+		if err != nil || within < 0 {
+			return filter, badRequest(dvapi_db.ErrCodeInvalidFilter, "invalid duration '%s' for expiring_within", expiring)
+		}
+
+		filter.LeaseExpiresBefore = time.Now().Add(within)
+	}
+
+	return filter, nil
+}
+
+// parseTime parses either a RFC 3339 time or a YYYY-mm-dd date
+func parseTime(value string) (at time.Time, err error) {
+	if at, err = time.Parse(time.RFC3339, value); err != nil {
+		at, err = time.Parse(time.DateOnly, value)
+	}
+
+	return at, err
+}
+
+// readPageQuery returns the page selected by the 'limit', 'after', 'sort' and 'order' parameters,
+// of the devices selected by readDeviceFilter. With 'as_of', a time as readDeviceFilter takes them,
+// the devices are listed as they were at that time. 'include_deleted=true' lists the deleted ones too.
+func readPageQuery(query url.Values) (page dvapi_db.PageQuery, err error) {
+	if page.Filter, err = readDeviceFilter(query); err != nil {
+		return page, err
+	}
+
+	if asOf := query.Get("as_of"); len(asOf) > 0 {
+		if page.AsOf, err = parseTime(asOf); err != nil {
+			return page, badRequest(dvapi_db.ErrCodeInvalidFilter, "invalid time '%s' for as_of", asOf)
+		}
+	}
+
+	if includeDeleted := query.Get("include_deleted"); len(includeDeleted) > 0 {
+		if page.IncludeDeleted, err = strconv.ParseBool(includeDeleted); err != nil {
+			return page, badRequest(dvapi_db.ErrCodeInvalidFilter, "invalid include_deleted '%s'", includeDeleted)
+		}
+	}
+
+	if limit := query.Get("limit"); len(limit) > 0 {
+		if page.Limit, err = strconv.Atoi(limit); err != nil || page.Limit <= 0 {
+			return page, badRequest(dvapi_db.ErrCodeInvalidPageLimit, "invalid page limit '%s'", limit)
+		}
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		page.Desc = true
+	default:
+		return page, badRequest(dvapi_db.ErrCodeInvalidSort, "invalid sort order '%s', use 'asc' or 'desc'", order)
+	}
+
+	page.Sort = query.Get("sort")
+	page.After = query.Get("after")
+
+	return page, nil
 }
 
-// HandleDevicesFetchAll is triggered when the API receives a 'GET /fetch' request
+// HandleDevicesFetchAll is triggered when the API receives a 'GET /devices' request.
+// The devices selected by readDeviceFilter are returned a page at a time, see readPageQuery.
+// They can also be sent in any of the listingMediaTypes, see negotiate: these exports
+// stream every device selected at once, unless a 'limit' is given.
 func (s *ApiHttpServer) HandleDevicesFetchAll(w http.ResponseWriter, r *http.Request) {
-	/* Leave it here as a reminder
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	var pageQuery dvapi_db.PageQuery
+	var page dvapi_db.DevicePage
+
+	query := r.URL.Query()
+	w.Header().Set("Vary", "Accept")
+
+	mediaType, err := negotiate(r)
+	if err == nil {
+		pageQuery, err = readPageQuery(query)
+	}
+
+	if err == nil && mediaType != ApiMediaTypeJSON && len(query.Get("limit")) == 0 {
+		s.streamDevices(w, r, mediaType, s.db.IterateDevices(pageQuery))
 		return
 	}
-	*/
 
-	var devices dvapi_model.Devices
+	if err == nil {
+		page, err = s.db.FetchPage(pageQuery)
+	}
+
+	if err != nil {
+		s.writeProblem(w, r, "fetch devices", err)
+
+		return
+	}
+
+	// The next page is the same request, starting after this one
+	if len(page.Next) > 0 {
+		query.Set("after", page.Next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, query.Encode()))
+	}
+
+	if mediaType != ApiMediaTypeJSON {
+		s.streamDevices(w, r, mediaType, dvapi_db.Iterate(page.Devices))
+		return
+	}
+
+	jsonBytes, err := json.Marshal(HttpDevicesPage{Devices: page.Devices, Next: page.Next})
+	if err != nil {
+		s.writeProblem(w, r, "fetch devices", err)
+		return
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
+
+// HandleDevicesSearch is triggered when the API receives a 'GET /devices/search?q=' request.
+// The devices whose name or brand resemble 'q' are returned with their score, at most 'limit' of them.
+func (s *ApiHttpServer) HandleDevicesSearch(w http.ResponseWriter, r *http.Request) {
+	var results []dvapi_db.SearchResult
+	var limit int
 	var err error
-	if devices, err = s.db.FetchAll(); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: err.Error(),
-		})
+
+	query := r.URL.Query()
+
+	if value := query.Get("limit"); len(value) > 0 {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			err = badRequest(dvapi_db.ErrCodeInvalidPageLimit, "invalid search limit '%s'", value)
+		}
+	}
+
+	if err == nil {
+		results, err = s.db.SearchDevices(query.Get("q"), limit)
+	}
+
+	if err != nil {
+		s.writeProblem(w, r, "search devices", err)
 
 		return
 	}
 
-	jsonBytes, err := devices.ToJsonBytes()
+	body := HttpSearchResults{Results: make([]HttpSearchResult, len(results))}
+	for i, result := range results {
+		body.Results[i] = HttpSearchResult{Score: math.Round(result.Score*1000) / 1000, Device: result.Device}
+	}
+
+	jsonBytes, err := json.Marshal(body)
+	if err != nil {
+		s.writeProblem(w, r, "search devices", err)
+		return
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
+
+// HandleDevicesFetchLegacy is triggered when the API receives a 'GET /fetch' request.
+// Unlike 'GET /devices', every device is returned at once, in a bare array streamed
+// as the devices are read.
+func (s *ApiHttpServer) HandleDevicesFetchLegacy(w http.ResponseWriter, r *http.Request) {
+	s.writeDevices(w, r, s.db.IterateDevices(dvapi_db.PageQuery{}))
+}
+
+// writeDevices streams the devices in a bare JSON array, or as the media type
+// negotiated with the 'Accept' header
+func (s *ApiHttpServer) writeDevices(w http.ResponseWriter, r *http.Request, devices iter.Seq2[dvapi_model.Device, error]) {
+	w.Header().Set("Vary", "Accept")
+
+	mediaType, err := negotiate(r)
 	if err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: err.Error(),
-		})
+		s.writeProblem(w, r, "fetch devices", err)
 		return
 	}
 
-	s.writeResponseJson(w, jsonBytes)
+	s.streamDevices(w, r, mediaType, devices)
 }
 
 // HandleDevicesFetchByBrand is triggered when
@@ -310,25 +766,12 @@ func (s *ApiHttpServer) HandleDevicesFetchByBrand(w http.ResponseWriter, r *http
 	brands := strings.Split(args, ",")
 
 	if devices, err = s.db.FetchByBrand(brands); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: err.Error(),
-		})
+		s.writeProblem(w, r, "fetch devices", err)
 
 		return
 	}
 
-	jsonBytes, err := devices.ToJsonBytes()
-	if err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: err.Error(),
-		})
-		return
-	}
-
-	s.writeResponseJson(w, jsonBytes)
-
+	s.writeDevices(w, r, dvapi_db.Iterate(devices))
 }
 
 // HandleDevicesFetchByState is triggered when
@@ -349,54 +792,10 @@ func (s *ApiHttpServer) HandleDevicesFetchByState(w http.ResponseWriter, r *http
 	states := strings.Split(args, ",")
 
 	if devices, err = s.db.FetchByState(states); err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: err.Error(),
-		})
+		s.writeProblem(w, r, "fetch devices", err)
 
 		return
 	}
 
-	jsonBytes, err := devices.ToJsonBytes()
-	if err != nil {
-		s.writeApiReponse(w, HttpApiResponse{
-			Status: "error",
-			Reason: err.Error(),
-		})
-		return
-	}
-
-	s.writeResponseJson(w, jsonBytes)
-}
-
-// handleDevices is the catch-all handler for devices operations
-// It does not need to be exported
-func (s *ApiHttpServer) handleDevices(w http.ResponseWriter, r *http.Request) {
-
-	// Accepted methods are POST, PUT, DELETE
-	switch r.Method {
-	case http.MethodPost:
-		{
-			s.HandleDevicesCreate(w, r)
-			break
-		}
-
-	case http.MethodPatch:
-		{
-			s.HandleDevicesUpdate(w, r)
-			break
-		}
-
-	case http.MethodDelete:
-		{
-			s.HandleDevicesDelete(w, r)
-			break
-		}
-
-	default:
-		{
-			// Method not accepted. Return not supported
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}
+	s.writeDevices(w, r, dvapi_db.Iterate(devices))
 }
@@ -0,0 +1,1247 @@
+package dvapi_http
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	dvapi_model "github.com/lapuglisi/dvapi/model"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server backed by an empty MemoryDatabase
+func newTestServer() *ApiHttpServer {
+	s := &ApiHttpServer{}
+	s.Setup("", 0, dvapi_db.NewMemoryDatabase())
+	s.SetAuthentication(false)
+
+	return s
+}
+
+// serve runs 'handler' for a request with 'body'
+func serve(t *testing.T, handler http.HandlerFunc, method string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "/devices", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// decodeProblem decodes the HttpProblem in 'rr', failing the test if there is none
+func decodeProblem(t *testing.T, rr *httptest.ResponseRecorder) (problem HttpProblem) {
+	t.Helper()
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Fatalf("unexpected content type for error: '%s'\n", contentType)
+	}
+
+	if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("unexpected response from API: '%s'\n", rr.Body.String())
+	}
+
+	return problem
+}
+
+func TestHandleDevicesCreate(t *testing.T) {
+	s := newTestServer()
+
+	rr := serve(t, s.HandleDevicesCreate, "POST", `{"name": "one", "brand": "b1", "state": "available"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	if location := rr.Header().Get("Location"); location != "/devices/1" {
+		t.Errorf("unexpected Location header: '%s'\n", location)
+	}
+
+	ar := HttpApiResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &ar); err != nil {
+		t.Fatal(err)
+	}
+
+	var device dvapi_model.Device
+	if err := device.FromJsonBytes([]byte(ar.Reason)); err != nil {
+		t.Fatal(err)
+	}
+
+	if device.ID != 1 || device.Name != "one" || device.CreatedOn.IsZero() {
+		t.Errorf("unexpected device created: %+v\n", device)
+	}
+
+	rr = serve(t, s.HandleDevicesCreate, "POST", `not json`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unexpected http status for invalid JSON: got %d want %d\n", rr.Code, http.StatusBadRequest)
+	}
+
+	if problem := decodeProblem(t, rr); problem.Code != ApiErrCodeInvalidRequest {
+		t.Errorf("unexpected error code for invalid JSON: got '%s' want '%s'\n", problem.Code, ApiErrCodeInvalidRequest)
+	}
+}
+
+func TestHandleDevicesCreateDuplicate(t *testing.T) {
+	s := newTestServer()
+	if err := s.db.SetUniquePolicy(dvapi_db.UniqueNameBrand); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := serve(t, s.HandleDevicesCreate, "POST", `{"name": "one", "brand": "b1"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	rr := serve(t, s.HandleDevicesCreate, "POST", `{"name": "ONE", "brand": "B1"}`)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("unexpected http status for a duplicate: got %d want %d\n", rr.Code, http.StatusConflict)
+	}
+
+	if problem := decodeProblem(t, rr); problem.Code != dvapi_db.ErrCodeDuplicateDevice || problem.ExistingID != 1 {
+		t.Errorf("unexpected problem for a duplicate: %+v\n", problem)
+	}
+
+	if rr = serve(t, s.HandleDevicesCreate, "POST", `{"name": "one", "brand": "b2"}`); rr.Code != http.StatusCreated {
+		t.Errorf("unexpected http status for another brand: got %d want %d\n", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestHandleDevicesUpdateAndDeleteInUse(t *testing.T) {
+	s := newTestServer()
+
+	free := dvapi_model.Device{Name: "free", Brand: "b1", State: dvapi_model.DeviceStateAvailable}
+	busy := dvapi_model.Device{Name: "busy", Brand: "b1", State: dvapi_model.DeviceStateInUse}
+	s.db.CreateDevice(&free)
+	s.db.CreateDevice(&busy)
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		body    string
+		status  int
+		code    string
+	}{
+		{s.HandleDevicesUpdate, "PATCH", `{"id": 1, "name": "renamed"}`, http.StatusOK, ""},
+		{s.HandleDevicesUpdate, "PATCH", `{"id": 2, "name": "renamed"}`, http.StatusConflict, dvapi_db.ErrCodeDeviceInUse},
+		{s.HandleDevicesUpdate, "PATCH", `{"id": 3, "name": "renamed"}`, http.StatusNotFound, dvapi_db.ErrCodeDeviceNotFound},
+		{s.HandleDevicesUpdate, "PATCH", `{"name": "renamed"}`, http.StatusBadRequest, dvapi_db.ErrCodeInvalidDeviceID},
+		{s.HandleDevicesDelete, "DELETE", `{"id": 2}`, http.StatusConflict, dvapi_db.ErrCodeDeviceInUse},
+		{s.HandleDevicesDelete, "DELETE", `{"id": 1}`, http.StatusOK, ""},
+		{s.HandleDevicesDelete, "DELETE", `{"id": 1}`, http.StatusNotFound, dvapi_db.ErrCodeDeviceNotFound},
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, tt.handler, tt.method, tt.body)
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: got %d want %d (%s)\n", tt.method, tt.body, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+
+		if len(tt.code) == 0 {
+			continue
+		}
+
+		if problem := decodeProblem(t, rr); problem.Code != tt.code || problem.Status != tt.status {
+			t.Errorf("%s %s: unexpected problem %+v\n", tt.method, tt.body, problem)
+		}
+	}
+}
+
+func TestHandleDevicesFetchByBrand(t *testing.T) {
+	s := newTestServer()
+
+	for _, brand := range []string{"b1", "b2", "b1"} {
+		s.db.CreateDevice(&dvapi_model.Device{Name: "device", Brand: brand, State: "available"})
+	}
+
+	req, _ := http.NewRequest("GET", "/fetch/brand", nil)
+	req.SetPathValue("brands", "b1")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.HandleDevicesFetchByBrand).ServeHTTP(rr, req)
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("unexpected content type: '%s'\n", contentType)
+	}
+
+	ds := dvapi_model.Devices{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &ds); err != nil {
+		t.Fatalf("unexpected response from API: '%s'\n", rr.Body.String())
+	}
+
+	if len(ds) != 2 {
+		t.Errorf("wrong devices count: got %d want 2\n", len(ds))
+	}
+}
+
+func TestResourceRoutes(t *testing.T) {
+	s := newTestServer()
+	s.db.CreateDevice(&dvapi_model.Device{Name: "one", Brand: "b1", State: "available"})
+
+	tests := []struct {
+		method     string
+		target     string
+		body       string
+		status     int
+		deprecated bool
+	}{
+		{"PUT", "/devices/1", `{"name": "two", "brand": "b2", "state": "inactive"}`, http.StatusOK, false},
+		{"PUT", "/devices/1", `{"name": "two"}`, http.StatusBadRequest, false},
+		{"PATCH", "/devices/1", `{"name": "three"}`, http.StatusOK, false},
+		{"PATCH", "/devices/1", `{"id": 2, "name": "three"}`, http.StatusBadRequest, false},
+		{"PATCH", "/devices/x", `{"name": "three"}`, http.StatusBadRequest, false},
+		{"PATCH", "/devices", `{"id": 1, "brand": "b3"}`, http.StatusOK, true},
+		{"GET", "/devices/1", ``, http.StatusOK, false},
+		{"GET", "/devices/x", ``, http.StatusBadRequest, false},
+		{"DELETE", "/devices/1", ``, http.StatusOK, false},
+		{"DELETE", "/devices", `{"id": 1}`, http.StatusNotFound, true},
+		{"GET", "/fetch/id/1", ``, http.StatusNotFound, true},
+		{"GET", "/devices?brand=b3&state=available", ``, http.StatusOK, false},
+		{"GET", "/devices?expiring_within=1h&brand=b3", ``, http.StatusOK, false},
+		{"GET", "/devices?expiring_within=soon", ``, http.StatusBadRequest, false},
+		{"POST", "/devices/1", ``, http.StatusMethodNotAllowed, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, bytes.NewBufferString(tt.body))
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: unexpected http status: got %d want %d\n", tt.method, tt.target, rr.Code, tt.status)
+			continue
+		}
+
+		if deprecation := rr.Header().Get("Deprecation"); (len(deprecation) > 0) != tt.deprecated {
+			t.Errorf("%s %s: unexpected Deprecation header '%s'\n", tt.method, tt.target, deprecation)
+		}
+	}
+
+	// The device was deleted through the new route
+	req := httptest.NewRequest("GET", "/devices", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	if body := rr.Body.String(); body != `{"devices":[]}` {
+		t.Errorf("unexpected devices left: %s\n", body)
+	}
+}
+
+func TestFetchDeviceRoutes(t *testing.T) {
+	s := newTestServer()
+	s.db.CreateDevice(&dvapi_model.Device{Name: "one", Brand: "b1", State: "available"})
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+
+		if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"1"` {
+			t.Fatalf("GET %s: got %d ETag %s want %d \"1\" (%s)\n", target, rr.Code, rr.Header().Get("ETag"),
+				http.StatusOK, rr.Body.String())
+		}
+
+		return rr
+	}
+
+	var device dvapi_model.Device
+	if err := json.Unmarshal(get("/devices/1").Body.Bytes(), &device); err != nil || device.Name != "one" {
+		t.Errorf("GET /devices/1: unexpected device %+v, %v\n", device, err)
+	}
+
+	// The deprecated route keeps sending an array
+	var devices dvapi_model.Devices
+	if err := json.Unmarshal(get("/fetch/id/1").Body.Bytes(), &devices); err != nil || len(devices) != 1 || devices[0].Name != "one" {
+		t.Errorf("GET /fetch/id/1: unexpected devices %+v, %v\n", devices, err)
+	}
+}
+
+func TestCheckoutRoutes(t *testing.T) {
+	s := newTestServer()
+	s.db.CreateDevice(&dvapi_model.Device{Name: "one", Brand: "b1", State: "available"})
+
+	tests := []struct {
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"/devices/1/checkout", `{"holder": "alice", "ttl": "soon"}`, http.StatusBadRequest, dvapi_db.ErrCodeInvalidLeaseTTL},
+		{"/devices/1/checkout", `{"holder": "alice", "ttl": "-1m"}`, http.StatusBadRequest, dvapi_db.ErrCodeInvalidLeaseTTL},
+		{"/devices/1/checkout", `{"holder": "alice", "ttl": "30m"}`, http.StatusOK, ""},
+		{"/devices/1/checkout", `{"holder": "alice"}`, http.StatusOK, ""},
+		{"/devices/1/checkout", `{"holder": "bob"}`, http.StatusConflict, dvapi_db.ErrCodeDeviceHeld},
+		{"/devices/1/renew", `{"holder": "alice", "ttl": "2h"}`, http.StatusOK, ""},
+		{"/devices/1/renew", `{"holder": "bob"}`, http.StatusConflict, dvapi_db.ErrCodeDeviceHeld},
+		{"/devices/1/checkin", `{"holder": "bob"}`, http.StatusConflict, dvapi_db.ErrCodeDeviceHeld},
+		{"/devices/1/checkout", `{}`, http.StatusBadRequest, dvapi_db.ErrCodeInvalidHolder},
+		{"/devices/1/checkout", ``, http.StatusBadRequest, ApiErrCodeInvalidRequest},
+		{"/devices/2/checkout", `{"holder": "alice"}`, http.StatusNotFound, dvapi_db.ErrCodeDeviceNotFound},
+		{"/devices/x/checkout", `{"holder": "alice"}`, http.StatusBadRequest, dvapi_db.ErrCodeInvalidDeviceID},
+		{"/devices/1/checkin", `{"holder": "alice"}`, http.StatusOK, ""},
+		{"/devices/1/checkin", `{"holder": "alice"}`, http.StatusConflict, dvapi_db.ErrCodeDeviceNotHeld},
+		{"/devices/1/renew", `{"holder": "alice"}`, http.StatusConflict, dvapi_db.ErrCodeDeviceNotHeld},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.target, bytes.NewBufferString(tt.body))
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("POST %s %s: got %d want %d (%s)\n", tt.target, tt.body, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+
+		if len(tt.code) == 0 {
+			continue
+		}
+
+		if problem := decodeProblem(t, rr); problem.Code != tt.code {
+			t.Errorf("POST %s %s: unexpected problem %+v\n", tt.target, tt.body, problem)
+		}
+	}
+	s.db.CheckoutDevice(1, "alice", 10*time.Minute)
+
+	for within, count := range map[string]int{"5m": 0, "15m": 1} {
+		req := httptest.NewRequest("GET", "/devices?expiring_within="+within, nil)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		page := HttpDevicesPage{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatalf("unexpected response from API: '%s'\n", rr.Body.String())
+		}
+
+		if ds := page.Devices; len(ds) != count {
+			t.Errorf("wrong count of devices expiring within %s: got %d want %d\n", within, len(page.Devices), count)
+		}
+	}
+}
+
+func TestETagRoutes(t *testing.T) {
+	s := newTestServer()
+	s.db.CreateDevice(&dvapi_model.Device{Name: "one", Brand: "b1", State: "available"})
+
+	tests := []struct {
+		method  string
+		ifMatch string
+		body    string
+		status  int
+		etag    string
+	}{
+		{"GET", "", ``, http.StatusOK, `"1"`},
+		{"PATCH", `"1"`, `{"name": "two"}`, http.StatusOK, ""},
+		{"PATCH", `"1"`, `{"name": "three"}`, http.StatusPreconditionFailed, ""},
+		{"GET", "", ``, http.StatusOK, `"2"`},
+		{"PUT", `W/"2"`, `{"name": "three", "brand": "b1", "state": "available"}`, http.StatusPreconditionFailed, ""},
+		{"PUT", `"2", "3"`, `{"name": "three", "brand": "b1", "state": "available"}`, http.StatusBadRequest, ""},
+		{"PUT", `*`, `{"name": "three", "brand": "b1", "state": "available"}`, http.StatusOK, ""},
+		{"DELETE", `"2"`, ``, http.StatusPreconditionFailed, ""},
+		{"DELETE", `"3"`, ``, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/devices/1", bytes.NewBufferString(tt.body))
+		if len(tt.ifMatch) > 0 {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s If-Match %s: got %d want %d (%s)\n", tt.method, tt.ifMatch, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+
+		if etag := rr.Header().Get("ETag"); len(tt.etag) > 0 && etag != tt.etag {
+			t.Errorf("%s: unexpected ETag: got %s want %s\n", tt.method, etag, tt.etag)
+		}
+
+		if tt.status == http.StatusPreconditionFailed {
+			if problem := decodeProblem(t, rr); problem.Code != dvapi_db.ErrCodeVersionMismatch {
+				t.Errorf("%s If-Match %s: unexpected problem %+v\n", tt.method, tt.ifMatch, problem)
+			}
+		}
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	s := newTestServer()
+	s.SetRequireIfMatch(true)
+	s.db.CreateDevice(&dvapi_model.Device{Name: "one", Brand: "b1", State: "available"})
+
+	tests := []struct {
+		method  string
+		target  string
+		ifMatch string
+		body    string
+		status  int
+	}{
+		{"GET", "/devices/1", "", ``, http.StatusOK},
+		{"PATCH", "/devices/1", "", `{"name": "two"}`, http.StatusPreconditionRequired},
+		{"PATCH", "/devices?id=1", "", `{"name": "two"}`, http.StatusPreconditionRequired},
+		{"PUT", "/devices/1", `*`, `{"name": "two", "brand": "b1", "state": "available"}`, http.StatusPreconditionRequired},
+		{"DELETE", "/devices/1", "", ``, http.StatusPreconditionRequired},
+		{"DELETE", "/devices?id=1", "", ``, http.StatusPreconditionRequired},
+		{"PATCH", "/devices/1", `"1"`, `{"name": "two"}`, http.StatusOK},
+		{"DELETE", "/devices/1", `"1"`, ``, http.StatusPreconditionFailed},
+		{"DELETE", "/devices/1", `"2"`, ``, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, bytes.NewBufferString(tt.body))
+		if len(tt.ifMatch) > 0 {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s %s If-Match %s: got %d want %d (%s)\n", tt.method, tt.target, tt.ifMatch, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+
+		if tt.status == http.StatusPreconditionRequired {
+			if problem := decodeProblem(t, rr); problem.Code != ApiErrCodePreconditionRequired {
+				t.Errorf("%s %s: unexpected problem %+v\n", tt.method, tt.target, problem)
+			}
+		}
+	}
+}
+
+func TestChainedConditionalUpdates(t *testing.T) {
+	s := newTestServer()
+	s.SetRequireIfMatch(true)
+	s.db.CreateDevice(&dvapi_model.Device{Name: "one", Brand: "b1", State: "available"})
+
+	// Each change is made with the ETag sent back by the previous one
+	etag := `"1"`
+	for _, tt := range []struct{ method, body, name string }{
+		{"PATCH", `{"name": "two"}`, "two"},
+		{"PATCH", `{"name": "three"}`, "three"},
+		{"PUT", `{"name": "four", "brand": "b1", "state": "available"}`, "four"},
+	} {
+		req := httptest.NewRequest(tt.method, "/devices/1", bytes.NewBufferString(tt.body))
+		req.Header.Set("If-Match", etag)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s If-Match %s: got %d want %d (%s)\n", tt.method, etag, rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		var response HttpApiResponse
+		var device dvapi_model.Device
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := json.Unmarshal([]byte(response.Reason), &device); err != nil || device.Name != tt.name {
+			t.Fatalf("%s: unexpected device %+v (%s)\n", tt.method, device, response.Reason)
+		}
+
+		next := rr.Header().Get("ETag")
+		if next == etag || next != fmt.Sprintf(`"%d"`, device.Version) {
+			t.Fatalf("%s: unexpected ETag %s after %s for version %d\n", tt.method, next, etag, device.Version)
+		}
+
+		etag = next
+	}
+}
+
+func TestDevicesPagination(t *testing.T) {
+	s := newTestServer()
+	for _, name := range []string{"a", "c", "b"} {
+		s.db.CreateDevice(&dvapi_model.Device{Name: name, Brand: "b1", State: "available"})
+	}
+
+	// Follow the 'next' links until the last page
+	var names []string
+	target := "/devices?limit=2&sort=name&order=desc"
+
+	for pages := 0; len(target) > 0 && pages < 3; pages++ {
+		req := httptest.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		page := HttpDevicesPage{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatalf("unexpected response from API: '%s'\n", rr.Body.String())
+		}
+
+		for _, device := range page.Devices {
+			names = append(names, device.Name)
+		}
+
+		link := rr.Header().Get("Link")
+		if (len(link) > 0) != (len(page.Next) > 0) {
+			t.Errorf("Link header '%s' does not match the next cursor '%s'\n", link, page.Next)
+		}
+
+		target = ""
+		if next, found := strings.CutPrefix(link, "<"); found {
+			target, _, _ = strings.Cut(next, ">")
+		}
+	}
+
+	if fmt.Sprint(names) != "[c b a]" {
+		t.Errorf("unexpected devices over the pages: %v\n", names)
+	}
+
+	for _, query := range []string{"limit=0", "limit=x", "order=up", "sort=id", "after=x", "state=broken"} {
+		req := httptest.NewRequest("GET", "/devices?"+query, nil)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("GET /devices?%s: got %d want %d\n", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDevicesFilters(t *testing.T) {
+	s := newTestServer()
+	s.db.CreateDevice(&dvapi_model.Device{Name: "lab-1", Brand: "apple", State: "available"})
+	s.db.CreateDevice(&dvapi_model.Device{Name: "lab-2", Brand: "apple", State: "inactive"})
+	s.db.CreateDevice(&dvapi_model.Device{Name: "desk-1", Brand: "apple", State: "available"})
+	s.db.CreateDevice(&dvapi_model.Device{Name: "lab-3", Brand: "samsung", State: "available"})
+
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+
+	tests := []struct {
+		query  string
+		status int
+		count  int
+	}{
+		{"brand=apple&state=available&name~=lab-*", http.StatusOK, 1},
+		{"brand=apple,samsung&state=available", http.StatusOK, 3},
+		{"name~=LAB-*&sort=name&order=desc&limit=2", http.StatusOK, 2},
+		{"brand=apple&created_after=2000-01-01", http.StatusOK, 3},
+		{"created_before=2000-01-01T00:00:00Z", http.StatusOK, 0},
+		{"created_after=" + tomorrow, http.StatusOK, 0},
+		{"created_after=yesterday", http.StatusBadRequest, 0},
+		{"created_after=" + tomorrow + "&created_before=2000-01-01", http.StatusBadRequest, 0},
+		{"brand=apple,", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/devices?"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("GET /devices?%s: got %d want %d (%s)\n", tt.query, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		page := HttpDevicesPage{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+			t.Fatalf("unexpected response from API: '%s'\n", rr.Body.String())
+		}
+
+		if len(page.Devices) != tt.count {
+			t.Errorf("GET /devices?%s: got %d devices want %d\n", tt.query, len(page.Devices), tt.count)
+		}
+	}
+}
+
+func TestDevicesSearch(t *testing.T) {
+	s := newTestServer()
+	s.db.CreateDevice(&dvapi_model.Device{Name: "iPhone 15", Brand: "Apple"})
+	s.db.CreateDevice(&dvapi_model.Device{Name: "Galaxy S24", Brand: "Samsung"})
+	s.db.CreateDevice(&dvapi_model.Device{Name: "iPad Air", Brand: "Apple"})
+
+	tests := []struct {
+		query  string
+		status int
+		first  string
+		count  int
+	}{
+		{"q=iphone", http.StatusOK, "iPhone 15", 1},
+		{"q=apple", http.StatusOK, "iPhone 15", 2},
+		{"q=apple&limit=1", http.StatusOK, "iPhone 15", 1},
+		{"q=nokia", http.StatusOK, "", 0},
+		{"q=", http.StatusBadRequest, "", 0},
+		{"q=apple&limit=0", http.StatusBadRequest, "", 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/devices/search?"+tt.query, nil)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("GET /devices/search?%s: got %d want %d (%s)\n", tt.query, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		body := HttpSearchResults{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Results == nil {
+			t.Fatalf("unexpected response from API: '%s'\n", rr.Body.String())
+		}
+
+		if len(body.Results) != tt.count {
+			t.Errorf("GET /devices/search?%s: got %d results want %d\n", tt.query, len(body.Results), tt.count)
+			continue
+		}
+
+		if tt.count > 0 && (body.Results[0].Device.Name != tt.first || body.Results[0].Score <= 0) {
+			t.Errorf("GET /devices/search?%s: unexpected first result %+v\n", tt.query, body.Results[0])
+		}
+	}
+}
+
+func TestIdempotentCreate(t *testing.T) {
+	s := newTestServer()
+
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/devices", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	first := post("create-one", `{"name": "one", "brand": "b1"}`)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", first.Code, http.StatusCreated, first.Body.String())
+	}
+
+	retry := post("create-one", `{"name": "one", "brand": "b1"}`)
+	if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+		t.Errorf("unexpected replay: got %d '%s' want %d '%s'\n", retry.Code, retry.Body.String(), first.Code, first.Body.String())
+	}
+
+	if retry.Header().Get("Location") != "/devices/1" || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("unexpected replayed headers: %v\n", retry.Header())
+	}
+
+	if devices, _ := s.db.FetchAll(); len(devices) != 1 {
+		t.Errorf("got %d devices after a retry want 1\n", len(devices))
+	}
+
+	rr := post("create-one", `{"name": "two", "brand": "b1"}`)
+	if problem := decodeProblem(t, rr); rr.Code != http.StatusUnprocessableEntity || problem.Code != ApiErrCodeIdempotencyKeyReused {
+		t.Errorf("unexpected response to a reused key: %d %+v\n", rr.Code, problem)
+	}
+
+	// Failures are replayed too, except server errors
+	if rr = post("create-bad", `{"name": "bad", "brand": "b1", "state": "broken"}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected http status: got %d want %d\n", rr.Code, http.StatusBadRequest)
+	}
+
+	if rr = post("create-bad", `{"name": "bad", "brand": "b1", "state": "broken"}`); rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("the failure was not replayed\n")
+	}
+
+	if rr = post(strings.Repeat("k", ApiIdempotencyMaxKeyLength+1), `{"name": "three"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unexpected http status for a long key: got %d want %d\n", rr.Code, http.StatusBadRequest)
+	}
+
+	// Oversized devices are refused, with or without a key
+	huge := fmt.Sprintf(`{"name": "%s", "brand": "b1"}`, strings.Repeat("n", int(ApiDeviceMaxBytes)))
+	for _, key := range []string{"create-huge", ""} {
+		if rr = post(key, huge); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("unexpected http status for a huge device with key '%s': got %d want %d\n", key, rr.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	if rr = post("create-huge", `{"name": "four", "brand": "b1"}`); rr.Code != http.StatusCreated {
+		t.Errorf("the key of a refused huge device was kept: got %d want %d\n", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestIdempotencyKeysPerCaller(t *testing.T) {
+	s := newTestServer()
+	s.SetAuthentication(true)
+
+	_, alice, _ := s.db.CreateApiKey("alice", []string{dvapi_db.ScopeDevicesWrite})
+	_, bob, _ := s.db.CreateApiKey("bob", []string{dvapi_db.ScopeDevicesWrite})
+
+	post := func(secret string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/devices", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		req.Header.Set("Idempotency-Key", "retry-1")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	if rr := post(alice, `{"name": "one", "brand": "b1"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+
+	// The same key with another body is bob's own, not a reuse of alice's
+	rr := post(bob, `{"name": "two", "brand": "b1"}`)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") == "true" {
+		t.Fatalf("unexpected response to another caller: got %d (%s)\n", rr.Code, rr.Body.String())
+	}
+
+	// From then on bob's key is bound to his own request
+	if rr = post(bob, `{"name": "one", "brand": "b1"}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected response to a reused key: got %d want %d\n", rr.Code, http.StatusUnprocessableEntity)
+	}
+
+	if rr = post(alice, `{"name": "one", "brand": "b1"}`); rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("the response to alice was not replayed: %d %v\n", rr.Code, rr.Header())
+	}
+
+	if devices, _ := s.db.FetchAll(); len(devices) != 2 {
+		t.Errorf("got %d devices want 2\n", len(devices))
+	}
+}
+
+func TestDevicesBulk(t *testing.T) {
+	s := newTestServer()
+
+	busy := dvapi_model.Device{Name: "busy", Brand: "b1", State: "in-use"}
+	s.db.CreateDevice(&busy)
+
+	bulk := func(query string, contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/devices/bulk"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	operations := fmt.Sprintf(`{"op": "create", "device": {"name": "one", "brand": "b1"}}
+{"op": "delete", "device": {"id": %d}}
+
+{"op": "create", "device": {"name": "two", "brand": "b1"}}
+`, busy.ID)
+
+	rr := bulk("", "application/x-ndjson", operations)
+	if problem := decodeProblem(t, rr); rr.Code != http.StatusConflict || problem.Code != dvapi_db.ErrCodeDeviceInUse {
+		t.Fatalf("unexpected response to a failed atomic bulk: %d %+v\n", rr.Code, problem)
+	}
+
+	if devices, _ := s.db.FetchAll(); len(devices) != 1 {
+		t.Errorf("got %d devices after a failed atomic bulk want 1\n", len(devices))
+	}
+
+	rr = bulk("?mode=partial", "application/x-ndjson", operations)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	results := HttpBulkResults{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.Succeeded != 2 || results.Failed != 1 || len(results.Results) != 3 {
+		t.Fatalf("unexpected bulk results: %+v\n", results)
+	}
+
+	if r := results.Results[0]; r.Status != http.StatusCreated || r.Device == nil || r.Device.Name != "one" {
+		t.Errorf("unexpected result for a create: %+v\n", r)
+	}
+
+	if r := results.Results[1]; r.Status != http.StatusConflict || r.Problem == nil || r.Problem.Code != dvapi_db.ErrCodeDeviceInUse {
+		t.Errorf("unexpected result for a failed delete: %+v\n", r)
+	}
+
+	rr = bulk("", "application/json", `[{"op": "update", "device": {"id": 2, "name": "uno"}}, {"op": "delete", "device": {"id": 3}}]`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	for _, tt := range []struct{ query, contentType, body string }{
+		{"", "application/json", `{"op": "create"}`},
+		{"", "application/json", `[{"op": "upsert", "device": {"name": "x"}}]`},
+		{"", "application/x-ndjson", `not json`},
+		{"?mode=best-effort", "application/json", `[]`},
+		{"", "application/json", `[]`},
+	} {
+		if rr = bulk(tt.query, tt.contentType, tt.body); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST /devices/bulk%s '%s': got %d want %d\n", tt.query, tt.body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	padding := strings.Repeat(" \n", int(ApiBulkMaxBytes))
+	for _, tt := range []struct{ contentType, body string }{
+		{"application/json", "[" + padding + "]"},
+		{"application/x-ndjson", padding + `{"op": "create", "device": {"name": "x"}}`},
+	} {
+		if rr = bulk("", tt.contentType, tt.body); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("POST /devices/bulk %s over %d bytes: got %d want %d\n", tt.contentType, ApiBulkMaxBytes, rr.Code, http.StatusRequestEntityTooLarge)
+		} else if problem := decodeProblem(t, rr); problem.Code != dvapi_db.ErrCodeInvalidBulk {
+			t.Errorf("POST /devices/bulk %s: unexpected problem %+v\n", tt.contentType, problem)
+		}
+	}
+}
+
+func TestDevicesImport(t *testing.T) {
+	s := newTestServer()
+
+	importFile := func(query string, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/devices/import"+query, body)
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	inventory := "Device,Maker,State\nPixel,google,in-use\nGalaxy,,available\nWatch,apple,lost\n"
+
+	for _, dryRun := range []bool{true, false} {
+		rr := importFile(fmt.Sprintf("?columns=name=Device,brand=Maker&dry_run=%t", dryRun), "text/csv", strings.NewReader(inventory))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		report := HttpImportReport{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatal(err)
+		}
+
+		if report.DryRun != dryRun || report.Rows != 3 || report.Imported != 1 || len(report.Rejected) != 2 {
+			t.Fatalf("unexpected import report: %+v\n", report)
+		}
+
+		if r := report.Rejected[1]; r.Row != 3 || r.Code != dvapi_db.ErrCodeInvalidState {
+			t.Errorf("unexpected rejection for an unknown state: %+v\n", r)
+		}
+
+		if devices, _ := s.db.FetchAll(); dryRun != (len(devices) == 0) {
+			t.Errorf("got %d devices after an import with dry_run=%t\n", len(devices), dryRun)
+		}
+	}
+
+	// The same file, as the 'file' part of a form
+	form := &bytes.Buffer{}
+	writer := multipart.NewWriter(form)
+	part, _ := writer.CreateFormFile("file", "inventory.csv")
+	part.Write([]byte("name,brand\nTab,lenovo\n"))
+	writer.Close()
+
+	if rr := importFile("", writer.FormDataContentType(), form); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"imported":1`) {
+		t.Errorf("unexpected response to a multipart import: %d %s\n", rr.Code, rr.Body.String())
+	}
+
+	for _, tt := range []struct{ query, contentType, body string }{
+		{"", "application/octet-stream", inventory},
+		{"?format=xlsx", "application/octet-stream", inventory},
+		{"", "text/csv", inventory},
+		{"?columns=serial=SN", "text/csv", inventory},
+		{"?dry_run=maybe", "text/csv", inventory},
+		{"", "application/vnd.apache.parquet", inventory},
+	} {
+		rr := importFile(tt.query, tt.contentType, strings.NewReader(tt.body))
+		if problem := decodeProblem(t, rr); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST /devices/import%s as '%s': got %d %+v want %d\n", tt.query, tt.contentType, rr.Code, problem, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDevicesExport(t *testing.T) {
+	s := newTestServer()
+
+	for _, name := range []string{"lab-1", "lab-2", "lab-3"} {
+		s.db.CreateDevice(&dvapi_model.Device{Name: name, Brand: "b1"})
+	}
+	s.db.CheckoutDevice(2, "tester", time.Hour)
+
+	export := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		if rr.Code == http.StatusOK && rr.Header().Get("Vary") != "Accept" {
+			t.Errorf("GET %s as '%s': no 'Vary: Accept' header\n", path, accept)
+		}
+
+		return rr
+	}
+
+	// Exports hold every device, not a page, unless a limit is given
+	rr := export("/devices?sort=name", "text/csv")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != ApiMediaTypeCSV {
+		t.Fatalf("unexpected response to a CSV export: %d %s\n", rr.Code, rr.Body.String())
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 4 || records[0][1] != "name" || records[2][1] != "lab-2" || records[2][5] != "tester" {
+		t.Errorf("unexpected CSV export: %v\n", records)
+	}
+
+	rr = export("/devices?limit=2", "application/x-ndjson")
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 2 || len(rr.Header().Get("Link")) == 0 {
+		t.Errorf("unexpected NDJSON page: %q\n", lines)
+	}
+
+	rr = export("/devices", "application/vnd.apache.parquet")
+	if body := rr.Body.Bytes(); rr.Code != http.StatusOK || !bytes.HasPrefix(body, []byte("PAR1")) || !bytes.HasSuffix(body, []byte("PAR1")) {
+		t.Errorf("unexpected Parquet export: %d %q\n", rr.Code, rr.Body.String())
+	}
+
+	rr = export("/fetch/state/in-use,available", "application/json;q=0.5, application/vnd.apache.arrow.stream")
+	if rr.Header().Get("Content-Type") != ApiMediaTypeArrow {
+		t.Fatalf("unexpected response to an Arrow export: %d %s\n", rr.Code, rr.Body.String())
+	}
+
+	reader, err := ipc.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Release()
+
+	rows := 0
+	for reader.Next() {
+		record := reader.Record()
+		rows += int(record.NumRows())
+
+		if holders := record.Column(5); holders.NullN() != 2 {
+			t.Errorf("unexpected Arrow holders: %v\n", holders)
+		}
+	}
+
+	if rows != 3 || reader.Schema().Field(0).Name != "id" {
+		t.Errorf("got %d Arrow rows want 3\n", rows)
+	}
+
+	// JSON remains the default
+	for _, accept := range []string{"", "*/*", "application/*", "text/html, application/json"} {
+		if rr = export("/devices", accept); rr.Header().Get("Content-Type") != ApiMediaTypeJSON {
+			t.Errorf("Accept '%s': got '%s' want JSON\n", accept, rr.Header().Get("Content-Type"))
+		}
+	}
+
+	for _, accept := range []string{"text/html", "application/xml, text/csv;q=0"} {
+		rr = export("/devices", accept)
+		if problem := decodeProblem(t, rr); rr.Code != http.StatusNotAcceptable || problem.Code != ApiErrCodeNotAcceptable {
+			t.Errorf("Accept '%s': got %d %+v want %d\n", accept, rr.Code, problem, http.StatusNotAcceptable)
+		}
+	}
+}
+
+func TestDevicesStreaming(t *testing.T) {
+	s := newTestServer()
+
+	for i := range 250 {
+		s.db.CreateDevice(&dvapi_model.Device{Name: fmt.Sprintf("lab-%d", i), Brand: "b1"})
+	}
+
+	stream := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	rr := stream("/fetch", "")
+	devices := dvapi_model.Devices{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &devices); err != nil || len(devices) != 250 {
+		t.Fatalf("got %d devices, %v want 250\n", len(devices), err)
+	}
+
+	if !rr.Flushed || devices[0].Name != "lab-0" {
+		t.Errorf("unexpected streamed array: flushed=%t first=%+v\n", rr.Flushed, devices[0])
+	}
+
+	rr = stream("/devices?sort=name&order=desc", "application/x-ndjson")
+	if lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n"); len(lines) != 250 || !rr.Flushed {
+		t.Errorf("got %d NDJSON lines want 250, flushed=%t\n", len(lines), rr.Flushed)
+	}
+
+	// Empty listings are still arrays, and invalid queries still problems
+	if rr = stream("/fetch/brand/none", ""); strings.TrimSpace(rr.Body.String()) != "[]" {
+		t.Errorf("got '%s' for an empty listing want '[]'\n", rr.Body.String())
+	}
+
+	rr = stream("/devices?after=bogus", "application/x-ndjson")
+	if problem := decodeProblem(t, rr); rr.Code != http.StatusBadRequest || problem.Code != dvapi_db.ErrCodeInvalidCursor {
+		t.Errorf("unexpected response to an invalid cursor: %d %+v\n", rr.Code, problem)
+	}
+}
+
+func TestDevicesHistory(t *testing.T) {
+	s := newTestServer()
+
+	request := func(method string, target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(ApiActorHeader, "alice")
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	if rr := request("POST", "/devices", `{"name": "phone", "brand": "b1"}`); rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected http status: got %d want %d\n", rr.Code, http.StatusCreated)
+	}
+
+	request("PATCH", "/devices/1", `{"name": "tablet"}`)
+	request("POST", "/devices/1/checkout", `{"holder": "alice"}`)
+
+	rr := request("GET", "/devices/1/history?limit=2", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d want %d (%s)\n", rr.Code, http.StatusOK, rr.Body.String())
+	}
+
+	history := HttpDeviceHistory{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history.Events) != 2 || history.Events[0].Operation != dvapi_db.EventCheckout || history.Events[0].Actor != "alice" {
+		t.Fatalf("unexpected first page of history: %+v\n", history)
+	}
+
+	if updated := history.Events[1]; updated.Before == nil || updated.Before.Name != "phone" || updated.After.Name != "tablet" {
+		t.Errorf("unexpected update event: %+v\n", updated)
+	}
+
+	link := rr.Header().Get("Link")
+	if !strings.Contains(link, "after="+history.Next) || !strings.Contains(link, `rel="next"`) {
+		t.Errorf("unexpected Link header: '%s'\n", link)
+	}
+
+	rr = request("GET", "/devices/1/history?limit=2&after="+history.Next, "")
+	history = HttpDeviceHistory{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history.Events) != 1 || history.Events[0].Operation != dvapi_db.EventCreate || len(history.Next) > 0 {
+		t.Fatalf("unexpected last page of history: %+v\n", history)
+	}
+
+	if created := history.Events[0]; created.Before != nil || created.After == nil {
+		t.Errorf("unexpected creation event: %+v\n", created)
+	}
+
+	for target, status := range map[string]int{
+		"/devices/99/history":          http.StatusNotFound,
+		"/devices/x/history":           http.StatusBadRequest,
+		"/devices/1/history?limit=0":   http.StatusBadRequest,
+		"/devices/1/history?after=bad": http.StatusBadRequest,
+	} {
+		if rr = request("GET", target, ""); rr.Code != status {
+			t.Errorf("GET %s: got %d want %d\n", target, rr.Code, status)
+		}
+	}
+}
+
+func TestDevicesAsOf(t *testing.T) {
+	s := newTestServer()
+
+	phone := dvapi_model.Device{Name: "phone", Brand: "b1"}
+	s.db.CreateDevice(&phone)
+
+	time.Sleep(5 * time.Millisecond)
+	then := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(5 * time.Millisecond)
+
+	s.db.DeleteDevice(dvapi_model.Device{ID: phone.ID})
+
+	fetch := func(query string) (rr *httptest.ResponseRecorder, page HttpDevicesPage) {
+		req := httptest.NewRequest("GET", "/devices?"+query, nil)
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		json.Unmarshal(rr.Body.Bytes(), &page)
+
+		return rr, page
+	}
+
+	if _, page := fetch("as_of=" + then); len(page.Devices) != 1 || page.Devices[0].Name != "phone" {
+		t.Errorf("unexpected devices as of before the deletion: %+v\n", page)
+	}
+
+	if _, page := fetch(""); len(page.Devices) != 0 {
+		t.Errorf("unexpected devices after the deletion: %+v\n", page)
+	}
+
+	if rr, _ := fetch("as_of=yesterday"); rr.Code != http.StatusBadRequest {
+		t.Errorf("GET /devices?as_of=yesterday: got %d want %d\n", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDevicesRestoreAndPurge(t *testing.T) {
+	s := newTestServer()
+
+	phone := dvapi_model.Device{Name: "phone", Brand: "b1"}
+	s.db.CreateDevice(&phone)
+
+	request := func(method string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	if rr := request("DELETE", "/devices/1"); rr.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d want %d\n", rr.Code, http.StatusOK)
+	}
+
+	for target, count := range map[string]int{"/devices": 0, "/devices?include_deleted=true": 1} {
+		page := HttpDevicesPage{}
+		if err := json.Unmarshal(request("GET", target).Body.Bytes(), &page); err != nil || len(page.Devices) != count {
+			t.Errorf("GET %s: got %+v want %d device(s)\n", target, page, count)
+		}
+	}
+
+	rr := request("POST", "/devices/1/restore")
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != `"3"` {
+		t.Fatalf("unexpected response to a restore: %d %s (%s)\n", rr.Code, rr.Header().Get("ETag"), rr.Body.String())
+	}
+
+	if problem := decodeProblem(t, request("POST", "/devices/1/restore")); problem.Code != dvapi_db.ErrCodeDeviceNotDeleted {
+		t.Errorf("unexpected problem for a restore of a device not deleted: %+v\n", problem)
+	}
+
+	request("DELETE", "/devices/1")
+
+	for target, status := range map[string]int{
+		"/devices/purge":                http.StatusBadRequest,
+		"/devices/purge?before=someday": http.StatusBadRequest,
+		"/devices/x/restore":            http.StatusBadRequest,
+		"/devices/99/restore":           http.StatusNotFound,
+	} {
+		if rr = request("POST", target); rr.Code != status {
+			t.Errorf("POST %s: got %d want %d\n", target, rr.Code, status)
+		}
+	}
+
+	if rr = request("GET", "/devices?include_deleted=yes"); rr.Code != http.StatusBadRequest {
+		t.Errorf("GET /devices?include_deleted=yes: got %d want %d\n", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = request("POST", "/devices/purge?before="+time.Now().Add(time.Minute).UTC().Format(time.RFC3339))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"purged":1}` {
+		t.Errorf("unexpected response to a purge: %d %s\n", rr.Code, rr.Body.String())
+	}
+
+	if rr = request("POST", "/devices/1/restore"); rr.Code != http.StatusNotFound {
+		t.Errorf("restore of a purged device: got %d want %d\n", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestDevicesStats(t *testing.T) {
+	s := newTestServer()
+
+	for _, device := range []dvapi_model.Device{
+		{Name: "phone", Brand: "b1"},
+		{Name: "tablet", Brand: "b1", State: dvapi_model.DeviceStateInactive},
+		{Name: "laptop", Brand: "b2"},
+	} {
+		s.db.CreateDevice(&device)
+	}
+
+	s.db.DeleteDevice(dvapi_model.Device{ID: 3})
+
+	req := httptest.NewRequest("GET", "/stats", nil)
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("unexpected http status: got %d want %d\n", rr.Code, http.StatusOK)
+	}
+
+	var stats HttpDeviceStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	month := HttpMonthStats{Month: time.Now().UTC().Format("2006-01"), Created: 3, Deleted: 1, Total: 2}
+	if stats.Total != 2 || len(stats.ByBrand) != 1 || stats.ByBrand[0] != (HttpStatsCount{"b1", 2}) ||
+		len(stats.ByState) != 2 || len(stats.ByMonth) != 1 || stats.ByMonth[0] != month {
+		t.Errorf("unexpected stats: %s\n", rr.Body.String())
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestServer()
+	s.SetAuthentication(true)
+
+	_, reader, _ := s.db.CreateApiKey("reader", []string{dvapi_db.ScopeDevicesRead})
+	_, writer, _ := s.db.CreateApiKey("writer", []string{dvapi_db.ScopeDevicesWrite})
+	admin, adminSecret, _ := s.db.CreateApiKey("admin", []string{dvapi_db.ScopeDevicesAdmin})
+
+	request := func(method string, target string, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(`{"name":"phone","brand":"b1"}`))
+		if len(authorization) > 0 {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, req)
+
+		return rr
+	}
+
+	for _, test := range []struct {
+		method        string
+		target        string
+		authorization string
+		status        int
+	}{
+		{"GET", "/devices", "", http.StatusUnauthorized},
+		{"GET", "/devices", "Basic " + reader, http.StatusUnauthorized},
+		{"GET", "/devices", "Bearer dvapi_nope", http.StatusUnauthorized},
+		{"GET", "/devices", "Bearer " + reader, http.StatusOK},
+		{"GET", "/fetch", "Bearer " + reader, http.StatusOK},
+		{"POST", "/devices", "Bearer " + reader, http.StatusForbidden},
+		{"POST", "/devices", "bearer " + writer, http.StatusCreated},
+		{"GET", "/stats", "Bearer " + writer, http.StatusOK},
+		{"POST", "/devices/purge?before=2026-01-01", "Bearer " + writer, http.StatusForbidden},
+		{"POST", "/devices/purge?before=2026-01-01", "Bearer " + adminSecret, http.StatusOK},
+		{"DELETE", "/devices/1", "Bearer " + adminSecret, http.StatusOK},
+	} {
+		if rr := request(test.method, test.target, test.authorization); rr.Code != test.status {
+			t.Errorf("%s %s with '%s': got %d want %d (%s)\n", test.method, test.target, test.authorization,
+				rr.Code, test.status, rr.Body.String())
+		}
+	}
+
+	rr := request("POST", "/devices", "Bearer "+reader)
+	if problem := decodeProblem(t, rr); problem.Code != ApiErrCodeInsufficientScope ||
+		!strings.Contains(rr.Header().Get("WWW-Authenticate"), `scope="devices:write"`) {
+		t.Errorf("unexpected problem for a missing scope: %+v (%s)\n", problem, rr.Header().Get("WWW-Authenticate"))
+	}
+
+	// The key name is the author of the changes
+	history, _ := s.db.FetchHistory(1, dvapi_db.HistoryQuery{})
+	if len(history.Events) != 2 || history.Events[0].Actor != "admin" || history.Events[1].Actor != "writer" {
+		t.Errorf("unexpected history: %+v\n", history.Events)
+	}
+
+	s.db.RevokeApiKey(admin.ID)
+	if rr = request("GET", "/devices", "Bearer "+adminSecret); rr.Code != http.StatusUnauthorized {
+		t.Errorf("request with a revoked key: got %d want %d\n", rr.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,186 @@
+package dvapi_http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ApiIdempotencyDefaultWindow is how long the response to a request made with
+// an 'Idempotency-Key' header is replayed, unless set with SetIdempotencyWindow
+const ApiIdempotencyDefaultWindow time.Duration = 24 * time.Hour
+
+// ApiIdempotencyMaxKeyLength is the longest 'Idempotency-Key' accepted
+const ApiIdempotencyMaxKeyLength int = 255
+
+// Error codes of the 'Idempotency-Key' header
+const (
+	ApiErrCodeInvalidIdempotencyKey string = "invalid_idempotency_key"
+	ApiErrCodeIdempotencyKeyInUse   string = "idempotency_key_in_use"
+	ApiErrCodeIdempotencyKeyReused  string = "idempotency_key_reused"
+)
+
+// idempotentHeaders are the response headers replayed along with the body
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// SetIdempotencyWindow sets how long responses are replayed to requests retried
+// with the same 'Idempotency-Key'
+func (s *ApiHttpServer) SetIdempotencyWindow(window time.Duration) {
+	s.idempotencyWindow = window
+}
+
+// idempotent makes 'handler' safe to retry with an 'Idempotency-Key' header.
+// The first response sent for a key is saved, then sent again as is, with an
+// 'Idempotent-Replayed' header, to the requests retried with that key. A key
+// cannot be used for another request, nor while its first request is running.
+// Keys belong to the caller, see idempotencyScope, others can pick the same ones.
+// The body, read to tell requests apart, cannot exceed 'maxBytes'.
+// Requests without the header are handled as usual.
+func (s *ApiHttpServer) idempotent(maxBytes int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if len(key) == 0 {
+			handler(w, r)
+			return
+		}
+
+		if len(key) > ApiIdempotencyMaxKeyLength {
+			s.writeProblem(w, r, "idempotent request", badRequest(ApiErrCodeInvalidIdempotencyKey,
+				"the Idempotency-Key cannot be longer than %d characters", ApiIdempotencyMaxKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+		if tooLong := new(http.MaxBytesError); errors.As(err, &tooLong) {
+			s.writeProblem(w, r, "idempotent request", tooLarge(ApiErrCodeInvalidRequest, "the body is larger than %d bytes", maxBytes))
+			return
+		} else if err != nil {
+			s.writeProblem(w, r, "idempotent request", badRequest(ApiErrCodeInvalidRequest, "could not read the body: %s", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(r, body)
+
+		saved, err := s.db.ReserveIdempotencyKey(idempotencyScope(r, key), fingerprint)
+		switch {
+		case err != nil:
+			s.writeProblem(w, r, "idempotent request", err)
+			return
+
+		case saved == nil:
+			s.recordIdempotent(w, r, handler, idempotencyScope(r, key))
+			return
+
+		case saved.Fingerprint != fingerprint:
+			s.writeProblem(w, r, "idempotent request", unprocessable(ApiErrCodeIdempotencyKeyReused,
+				"the Idempotency-Key '%s' was used for another request", key))
+			return
+
+		case saved.InProgress():
+			s.writeProblem(w, r, "idempotent request", conflict(ApiErrCodeIdempotencyKeyInUse,
+				"the request with Idempotency-Key '%s' is still in progress", key))
+			return
+		}
+
+		for name, value := range saved.Header {
+			w.Header().Set(name, value)
+		}
+
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(saved.Status)
+		w.Write(saved.Body)
+	}
+}
+
+// idempotencyScope returns the 'Idempotency-Key' of the request as it is saved, owned
+// by the API key making the request or, without API keys, by its 'X-Actor'. Clients
+// pick their keys without knowing about each other, theirs cannot clash.
+// Neither header can hold a line break, which keeps the owner apart from the key.
+func idempotencyScope(r *http.Request, key string) string {
+	if apiKey := requestApiKey(r); apiKey != nil {
+		return fmt.Sprintf("key %d\n%s", apiKey.ID, key)
+	}
+
+	return fmt.Sprintf("actor %s\n%s", strings.TrimSpace(r.Header.Get(ApiActorHeader)), key)
+}
+
+// recordIdempotent runs 'handler' and saves its response with the saved 'key'.
+// Server errors are not saved, the request can be retried with the same key.
+func (s *ApiHttpServer) recordIdempotent(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc, key string) {
+	recorder := &responseRecorder{ResponseWriter: w}
+
+	handler(recorder, r)
+
+	if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+		if err := s.db.ReleaseIdempotencyKey(key); err != nil {
+			log.Printf("could not release the Idempotency-Key %q: %s", key, err)
+		}
+
+		return
+	}
+
+	window := s.idempotencyWindow
+	if window <= 0 {
+		window = ApiIdempotencyDefaultWindow
+	}
+
+	response := recorder.response()
+	if err := s.db.CompleteIdempotencyKey(key, response, time.Now().Add(window)); err != nil {
+		log.Printf("could not save the response to Idempotency-Key %q: %s", key, err)
+	}
+}
+
+// requestFingerprint identifies the request: same method, path and body, same fingerprint
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder keeps a copy of the response written through it
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+
+	rr.body.Write(b)
+
+	return rr.ResponseWriter.Write(b)
+}
+
+// response returns what was written as a dvapi_db.IdempotentResponse
+func (rr *responseRecorder) response() (response dvapi_db.IdempotentResponse) {
+	response = dvapi_db.IdempotentResponse{Status: rr.status, Header: map[string]string{}, Body: rr.body.Bytes()}
+
+	for _, name := range idempotentHeaders {
+		if value := rr.Header().Get(name); len(value) > 0 {
+			response.Header[name] = value
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,160 @@
+package dvapi_http
+
+import (
+	"encoding/json"
+	"errors"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	dvapi_model "github.com/lapuglisi/dvapi/model"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// ApiImportMaxBytes is the largest file 'POST /devices/import' accepts
+const ApiImportMaxBytes int64 = 32 << 20
+
+// importMediaTypes gives the format of the files sent as the body, by their Content-Type
+var importMediaTypes = map[string]string{
+	"text/csv":                       dvapi_db.ImportCSV,
+	"application/vnd.apache.parquet": dvapi_db.ImportParquet,
+	"application/x-parquet":          dvapi_db.ImportParquet,
+}
+
+// HttpImportRejection is a row of the file that did not become a device.
+// Rows are counted from 1, the CSV header aside.
+type HttpImportRejection struct {
+	Row    int    `json:"row"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// HttpImportReport is the body sent by 'POST /devices/import'. On dry runs the
+// devices are those that would be created, without ids.
+type HttpImportReport struct {
+	DryRun   bool                  `json:"dry_run"`
+	Rows     int                   `json:"rows"`
+	Imported int                   `json:"imported"`
+	Devices  dvapi_model.Devices   `json:"devices"`
+	Rejected []HttpImportRejection `json:"rejected"`
+}
+
+// saveImportFile copies the file of an import request into a temporary file,
+// to be removed by the caller. The file is either the body itself, or the
+// 'file' part of a 'multipart/form-data' body. Its format comes from '?format=',
+// else from its Content-Type or file name.
+func saveImportFile(w http.ResponseWriter, r *http.Request) (path string, format string, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, ApiImportMaxBytes)
+
+	var file io.Reader = r.Body
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	format = importMediaTypes[mediaType]
+
+	if mediaType == "multipart/form-data" {
+		parts, err := r.MultipartReader()
+		if err != nil {
+			return "", "", badRequest(ApiErrCodeInvalidRequest, "invalid multipart body: %s", err)
+		}
+
+		for {
+			part, err := parts.NextPart()
+			if err != nil {
+				return "", "", badRequest(dvapi_db.ErrCodeInvalidImport, "no 'file' part in the multipart body")
+			}
+
+			if part.FormName() == "file" {
+				file, format = part, dvapi_db.ImportFormatFor(part.FileName())
+				break
+			}
+		}
+	}
+
+	if query := r.URL.Query().Get("format"); len(query) > 0 {
+		format = query
+	}
+
+	if len(format) == 0 {
+		return "", "", badRequest(dvapi_db.ErrCodeInvalidImport, "unknown file format, send it as 'text/csv' or "+
+			"'application/vnd.apache.parquet', or set '?format=' to '%s' or '%s'", dvapi_db.ImportCSV, dvapi_db.ImportParquet)
+	}
+
+	temp, err := os.CreateTemp("", "dvapi-import-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer temp.Close()
+
+	if _, err = io.Copy(temp, file); err != nil {
+		os.Remove(temp.Name())
+
+		if maxBytes := new(http.MaxBytesError); errors.As(err, &maxBytes) {
+			return "", "", tooLarge(dvapi_db.ErrCodeInvalidImport, "the file is larger than %d bytes", ApiImportMaxBytes)
+		}
+
+		return "", "", badRequest(ApiErrCodeInvalidRequest, "could not read the file: %s", err)
+	}
+
+	return temp.Name(), format, nil
+}
+
+// HandleDevicesImport is triggered when the API receives a 'POST /devices/import' request.
+// A device is created for each valid row of the CSV or Parquet file sent, and the
+// rows rejected are reported. '?columns=name=Device Name,brand=Maker' maps the
+// columns of the file to device fields, '?dry_run=true' only checks the rows.
+func (s *ApiHttpServer) HandleDevicesImport(w http.ResponseWriter, r *http.Request) {
+	var options dvapi_db.ImportOptions
+	var report dvapi_db.ImportReport
+	var path string
+	var err error
+
+	query := r.URL.Query()
+
+	if options.Columns, err = dvapi_db.ParseColumnMapping(query.Get("columns")); err != nil {
+		s.writeProblem(w, r, "import devices", err)
+		return
+	}
+
+	if dryRun := query.Get("dry_run"); len(dryRun) > 0 {
+		if options.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			s.writeProblem(w, r, "import devices", badRequest(ApiErrCodeInvalidRequest, "invalid dry_run '%s'", dryRun))
+			return
+		}
+	}
+
+	if path, options.Format, err = saveImportFile(w, r); err != nil {
+		s.writeProblem(w, r, "import devices", err)
+		return
+	}
+	defer os.Remove(path)
+
+	if report, err = dvapi_db.ImportDevices(s.store(r), path, options); err != nil {
+		s.writeProblem(w, r, "import devices", err)
+		return
+	}
+
+	body := HttpImportReport{
+		DryRun:   report.DryRun,
+		Rows:     report.Rows,
+		Imported: len(report.Imported),
+		Devices:  dvapi_model.Devices(report.Imported),
+		Rejected: make([]HttpImportRejection, len(report.Rejected)),
+	}
+
+	if body.Devices == nil {
+		body.Devices = dvapi_model.Devices{}
+	}
+
+	for i, rejection := range report.Rejected {
+		body.Rejected[i] = HttpImportRejection{Row: rejection.Row, Code: rejection.Code, Reason: rejection.Reason}
+	}
+
+	jsonBytes, err := json.Marshal(body)
+	if err != nil {
+		s.writeProblem(w, r, "import devices", err)
+		return
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
@@ -0,0 +1,66 @@
+package dvapi_http
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HttpStatsCount is how many devices share a brand or a state
+type HttpStatsCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// HttpMonthStats is how the inventory changed over a month, 'YYYY-MM' in UTC
+type HttpMonthStats struct {
+	Month   string `json:"month"`
+	Created int64  `json:"created"`
+	Deleted int64  `json:"deleted"`
+	Total   int64  `json:"total"`
+}
+
+// HttpDeviceStats is the body sent by 'GET /stats'
+type HttpDeviceStats struct {
+	Total   int64            `json:"total"`
+	ByBrand []HttpStatsCount `json:"by_brand"`
+	ByState []HttpStatsCount `json:"by_state"`
+	ByMonth []HttpMonthStats `json:"by_month"`
+}
+
+// HandleStats is triggered when the API receives a 'GET /stats' request.
+// The devices are counted by brand and by state, and the growth of the
+// inventory is given month by month, oldest first.
+func (s *ApiHttpServer) HandleStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.db.FetchStats()
+	if err != nil {
+		s.writeProblem(w, r, "fetch stats", err)
+		return
+	}
+
+	body := HttpDeviceStats{
+		Total:   stats.Total,
+		ByBrand: make([]HttpStatsCount, len(stats.ByBrand)),
+		ByState: make([]HttpStatsCount, len(stats.ByState)),
+		ByMonth: make([]HttpMonthStats, len(stats.ByMonth)),
+	}
+
+	for i, count := range stats.ByBrand {
+		body.ByBrand[i] = HttpStatsCount(count)
+	}
+
+	for i, count := range stats.ByState {
+		body.ByState[i] = HttpStatsCount(count)
+	}
+
+	for i, month := range stats.ByMonth {
+		body.ByMonth[i] = HttpMonthStats(month)
+	}
+
+	jsonBytes, err := json.Marshal(body)
+	if err != nil {
+		s.writeProblem(w, r, "fetch stats", err)
+		return
+	}
+
+	s.writeResponseJson(w, http.StatusOK, jsonBytes)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	"os"
+)
+
+// runImport is the 'dvapi import [flags] <file>' subcommand: it creates a device
+// for each valid row of a CSV or Parquet file, and reports the rows rejected
+func runImport(args []string) (err error) {
+	var config ApiAppConfig
+	var options dvapi_db.ImportOptions
+	var columns string
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] <file.csv|file.parquet>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&config.Store, "store", ApiAppStoreDuckDB, "The storage backend to use: duckdb, sqlite or postgres")
+	flags.StringVar(&config.DSN, "dsn", os.Getenv("DVAPI_DSN"), "The PostgreSQL connection string (default: $DVAPI_DSN)")
+	flags.StringVar(&config.Unique, "unique", "none", "Which devices are duplicates: none, name or name-brand (regardless of case)")
+	flags.StringVar(&options.Format, "format", "", "The format of the file, csv or parquet (default: from its extension)")
+	flags.StringVar(&columns, "columns", "", "The columns filling the device fields, as in 'name=Device Name,brand=Maker'")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "Only check the rows, without creating any device")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("import expects one file, got %d", flags.NArg())
+	}
+
+	path := flags.Arg(0)
+	if len(options.Format) == 0 {
+		options.Format = dvapi_db.ImportFormatFor(path)
+	}
+
+	if options.Columns, err = dvapi_db.ParseColumnMapping(columns); err != nil {
+		return err
+	}
+
+	db, err := openStore(config)
+	if err != nil {
+		return err
+	}
+	defer db.Release()
+
+	report, err := dvapi_db.ImportDevices(db, path, options)
+	if err != nil {
+		return err
+	}
+
+	for _, rejection := range report.Rejected {
+		fmt.Printf("row %d rejected (%s): %s\n", rejection.Row, rejection.Code, rejection.Reason)
+	}
+
+	if report.DryRun {
+		fmt.Printf("dry run: %d row(s) read, %d device(s) would be imported, %d rejected\n",
+			report.Rows, len(report.Imported), len(report.Rejected))
+	} else {
+		fmt.Printf("%d row(s) read, %d device(s) imported, %d rejected\n",
+			report.Rows, len(report.Imported), len(report.Rejected))
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	dvapi_db "github.com/lapuglisi/dvapi/database"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runKeys is the 'dvapi keys <create|list|revoke> [flags]' subcommand: it manages
+// the API keys the HTTP server accepts. New keys are shown once, only their hash is kept.
+// The store is opened as it is, the uniqueness policy of the devices is left alone.
+func runKeys(args []string) (err error) {
+	var config ApiAppConfig
+	var name, scopes string
+
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s keys create -name <name> -scopes <scopes> [flags]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s keys list [flags]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s keys revoke [flags] <id>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	flags.StringVar(&config.Store, "store", ApiAppStoreDuckDB, "The storage backend to use: duckdb, sqlite or postgres")
+	flags.StringVar(&config.DSN, "dsn", os.Getenv("DVAPI_DSN"), "The PostgreSQL connection string (default: $DVAPI_DSN)")
+	flags.StringVar(&name, "name", "", "Who the new key is for, recorded as the author of the changes made with it")
+	flags.StringVar(&scopes, "scopes", dvapi_db.ScopeDevicesRead,
+		"The scopes of the new key: devices:read, devices:write and/or devices:admin, comma delimited")
+
+	if len(args) == 0 {
+		flags.Usage()
+		return fmt.Errorf("keys expects a command: create, list or revoke")
+	}
+
+	command := args[0]
+	flags.Parse(args[1:])
+
+	switch command {
+	case "create":
+		return createKey(config, name, scopes)
+
+	case "list":
+		return listKeys(config)
+
+	case "revoke":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return fmt.Errorf("keys revoke expects one key id, got %d", flags.NArg())
+		}
+
+		id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid key id '%s'", flags.Arg(0))
+		}
+
+		return revokeKey(config, id)
+
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown keys command '%s' (use create, list or revoke)", command)
+	}
+}
+
+// createKey creates a key for 'name' granting 'scopes', and prints it
+func createKey(config ApiAppConfig, name string, scopes string) (err error) {
+	parsed, err := dvapi_db.ParseScopes(scopes)
+	if err != nil {
+		return err
+	}
+
+	db, err := openBackend(config)
+	if err != nil {
+		return err
+	}
+	defer db.Release()
+
+	key, secret, err := db.CreateApiKey(name, parsed)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("API key %d created for '%s' (%s):\n\n  %s\n\n", key.ID, key.Name, strings.Join(key.Scopes, ", "), secret)
+	fmt.Println("It cannot be shown again, keep it somewhere safe.")
+
+	return nil
+}
+
+// ApiAppBootstrapKeyName is the name of the key created by bootstrapKey
+const ApiAppBootstrapKeyName string = "bootstrap"
+
+// bootstrapKey creates the admin key 'secret' if the store has no keys at all, so
+// a new deployment (eg: a container) starts with a key to create the others with.
+// Once there are keys, revoked ones included, 'secret' is ignored.
+func bootstrapKey(db dvapi_db.DeviceStore, secret string) (err error) {
+	key, err := db.BootstrapApiKey(ApiAppBootstrapKeyName, []string{dvapi_db.ScopeDevicesAdmin}, secret)
+	if err != nil {
+		return fmt.Errorf("cannot create the bootstrap API key: %w", err)
+	}
+
+	if key != nil {
+		log.Printf("API key %d (%s...) created for '%s' with scope %s", key.ID, key.Prefix, key.Name, dvapi_db.ScopeDevicesAdmin)
+	} else {
+		log.Println("API keys exist already, the bootstrap key is ignored")
+	}
+
+	return nil
+}
+
+// listKeys prints every key, revoked ones included
+func listKeys(config ApiAppConfig) (err error) {
+	db, err := openBackend(config)
+	if err != nil {
+		return err
+	}
+	defer db.Release()
+
+	keys, err := db.ListApiKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		status := "active"
+		if key.RevokedOn != nil {
+			status = "revoked on " + key.RevokedOn.Format("2006-01-02 15:04:05")
+		}
+
+		fmt.Printf("%d\t%s...\t%s\t%s\tcreated on %s\t%s\n", key.ID, key.Prefix, key.Name,
+			strings.Join(key.Scopes, ","), key.CreatedOn.Format("2006-01-02 15:04:05"), status)
+	}
+
+	return nil
+}
+
+// revokeKey revokes the key 'id'
+func revokeKey(config ApiAppConfig, id int64) (err error) {
+	db, err := openBackend(config)
+	if err != nil {
+		return err
+	}
+	defer db.Release()
+
+	key, err := db.RevokeApiKey(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("API key %d (%s..., '%s') revoked\n", key.ID, key.Prefix, key.Name)
+
+	return nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	dvapi_http "github.com/lapuglisi/dvapi/http"
 	"log"
+	"os"
 )
 
 type Serominers struct {
@@ -24,18 +26,50 @@ type Serominers struct {
 */
 
 func main() {
-	var httpPort int
-	var httpHost string
+	var config ApiAppConfig
 	var err error
 
 	var app ApiApplication = ApiApplication{}
 
-	flag.IntVar(&httpPort, "port", 9098, "The port on which the API server listens")
-	flag.StringVar(&httpHost, "host", "0.0.0.0", "The host on which the API server listens")
+	// 'dvapi import <file>' imports an inventory instead of serving the API
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err = runImport(os.Args[2:]); err != nil {
+			log.Fatal("Error: ", err)
+		}
+
+		return
+	}
+
+	// 'dvapi keys <command>' manages the API keys instead of serving the API
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err = runKeys(os.Args[2:]); err != nil {
+			log.Fatal("Error: ", err)
+		}
+
+		return
+	}
+
+	flag.IntVar(&config.Port, "port", 9098, "The port on which the API server listens")
+	flag.StringVar(&config.Host, "host", "0.0.0.0", "The host on which the API server listens")
+	flag.StringVar(&config.Store, "store", ApiAppStoreDuckDB, "The storage backend to use: duckdb, sqlite or postgres")
+	flag.StringVar(&config.DSN, "dsn", os.Getenv("DVAPI_DSN"), "The PostgreSQL connection string (default: $DVAPI_DSN)")
+	flag.StringVar(&config.Unique, "unique", "none", "Which devices are duplicates: none, name or name-brand (regardless of case)")
+	flag.DurationVar(&config.IdempotencyWindow, "idempotency-window", dvapi_http.ApiIdempotencyDefaultWindow,
+		"How long responses are replayed to requests retried with the same Idempotency-Key")
+	flag.BoolVar(&config.RequireIfMatch, "require-if-match", false,
+		"Refuse to replace, update or delete a device without an 'If-Match' header naming its version")
+	flag.BoolVar(&config.NoAuth, "no-auth", false, "Serve the API without requiring API keys (see 'dvapi keys')")
+	flag.StringVar(&config.AdminKey, "admin-key", "",
+		"An admin API key ('dvapi_' and 32 characters or more) to create if there are no keys yet (default: $DVAPI_ADMIN_KEY)")
 	flag.Parse()
 
-	if err = app.Setup(httpHost, httpPort); err != nil {
-		log.Println("Error: ", err)
+	// Not the flag default, which -help would print
+	if len(config.AdminKey) == 0 {
+		config.AdminKey = os.Getenv("DVAPI_ADMIN_KEY")
+	}
+
+	if err = app.Setup(config); err != nil {
+		log.Fatal("Error: ", err)
 	}
 
 	log.Fatal(app.Run())
@@ -3,25 +3,96 @@ package dvapi_model
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 )
 
 // / DeviceState is a helper just to make the code more idiomatic
 // DeviceState.ToString allows DeviceState to be passed as a string as well
+type DeviceState string
 
 const (
-	DeviceStateAvailable string = "available"
-	DeviceStateInUse     string = "in-use"
-	DeviceStateInactive  string = "inactive"
+	DeviceStateAvailable DeviceState = "available"
+	DeviceStateInUse     DeviceState = "in-use"
+	DeviceStateInactive  DeviceState = "inactive"
 )
 
+// deviceStateTransitions lists, for each state, the states a device may move to.
+// An in-use device can only be released back to available: to make it inactive
+// it has to be released first.
+var deviceStateTransitions = map[DeviceState][]DeviceState{
+	DeviceStateAvailable: {DeviceStateInUse, DeviceStateInactive},
+	DeviceStateInUse:     {DeviceStateAvailable},
+	DeviceStateInactive:  {DeviceStateAvailable},
+}
+
+// DeviceStates returns every valid DeviceState
+func DeviceStates() []DeviceState {
+	return []DeviceState{DeviceStateAvailable, DeviceStateInUse, DeviceStateInactive}
+}
+
+// ParseDeviceState converts 'state' into a DeviceState, failing if it is not a valid one
+func ParseDeviceState(state string) (DeviceState, error) {
+	if s := DeviceState(state); s.IsValid() {
+		return s, nil
+	}
+
+	return "", fmt.Errorf("unknown device state '%s' (valid states are: %s)", state, joinStates(DeviceStates()))
+}
+
+// DeviceState.ToString returns the state as a plain string
+func (s DeviceState) ToString() string {
+	return string(s)
+}
+
+// DeviceState.IsValid tells whether 's' is one of the known states
+func (s DeviceState) IsValid() bool {
+	_, known := deviceStateTransitions[s]
+	return known
+}
+
+// DeviceState.CanTransitionTo tells whether a device in state 's' may move to state 'to'.
+// Staying in the same state is always allowed.
+func (s DeviceState) CanTransitionTo(to DeviceState) bool {
+	return s == to || slices.Contains(deviceStateTransitions[s], to)
+}
+
+// DeviceState.Transitions returns the states a device in state 's' may move to
+func (s DeviceState) Transitions() []DeviceState {
+	return slices.Clone(deviceStateTransitions[s])
+}
+
+// joinStates returns 'states' as a comma delimited string
+func joinStates(states []DeviceState) string {
+	list := make([]string, len(states))
+	for i, state := range states {
+		list[i] = state.ToString()
+	}
+
+	return strings.Join(list, ", ")
+}
+
 // / struct Device is the structure that holds the information for a single Device
+// Holder and HeldSince are only set while the device is checked out.
 type Device struct {
-	ID        int64     `json:"id,omitempty"`
-	Name      string    `json:"name"`
-	Brand     string    `json:"brand,omitempty"`
-	State     string    `json:"state"`
-	CreatedOn time.Time `json:"created_on"`
+	ID        int64       `json:"id,omitempty"`
+	Name      string      `json:"name"`
+	Brand     string      `json:"brand,omitempty"`
+	State     DeviceState `json:"state"`
+	CreatedOn time.Time   `json:"created_on"`
+	Holder    string      `json:"holder,omitempty"`
+	HeldSince *time.Time  `json:"held_since,omitempty"`
+
+	// The lease of an in-use device: when it ends and how many times it was renewed
+	LeaseExpiresOn *time.Time `json:"lease_expires_on,omitempty"`
+	LeaseRenewals  int        `json:"lease_renewals,omitempty"`
+
+	// Increased on every change, see ETag in the API
+	Version int64 `json:"version,omitempty"`
+
+	// When the device was deleted, only set on the deleted devices still kept
+	DeletedOn *time.Time `json:"deleted_on,omitempty"`
 }
 
 // / Devices is just a helper to use as a array of devices
@@ -0,0 +1,42 @@
+package dvapi_model
+
+import (
+	"testing"
+)
+
+func TestDeviceStateTransitions(t *testing.T) {
+	tests := []struct {
+		from    DeviceState
+		to      DeviceState
+		allowed bool
+	}{
+		{DeviceStateAvailable, DeviceStateInUse, true},
+		{DeviceStateAvailable, DeviceStateInactive, true},
+		{DeviceStateInactive, DeviceStateAvailable, true},
+		{DeviceStateInactive, DeviceStateInUse, false},
+		{DeviceStateInUse, DeviceStateAvailable, true},
+		{DeviceStateInUse, DeviceStateInactive, false},
+		{DeviceStateInUse, DeviceStateInUse, true},
+		{DeviceStateAvailable, "broken", false},
+	}
+
+	for _, tt := range tests {
+		if allowed := tt.from.CanTransitionTo(tt.to); allowed != tt.allowed {
+			t.Errorf("'%s' -> '%s': got %t want %t", tt.from, tt.to, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestParseDeviceState(t *testing.T) {
+	for _, state := range DeviceStates() {
+		if parsed, err := ParseDeviceState(state.ToString()); err != nil || parsed != state {
+			t.Errorf("could not parse '%s': %v", state, err)
+		}
+	}
+
+	for _, state := range []string{"", "In-Use", "busy"} {
+		if _, err := ParseDeviceState(state); err == nil {
+			t.Errorf("unknown state '%s' was accepted", state)
+		}
+	}
+}